@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -8,8 +9,10 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	clientConfig "github.com/appaegis/golang-common/pkg/config"
@@ -17,12 +20,12 @@ import (
 	"github.com/appaegis/golang-common/pkg/monitorpolicy"
 	"github.com/appaegis/golang-common/pkg/storage"
 	"github.com/appaegis/golang-common/pkg/utils"
-	"github.com/gorilla/websocket"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/wwt/guac/lib/geoip"
 	"github.com/wwt/guac/lib/logging"
+	"github.com/wwt/guac/lib/settings"
 	guac "github.com/wwt/guac/pkg"
 	guacSession "github.com/wwt/guac/pkg/session"
 )
@@ -31,8 +34,10 @@ var commitID string
 
 func main() {
 	geoip.Init()
+	settings.Init()
 	logging.Init()
 	defer logging.Close()
+	go closeLoggingOnSignal()
 	guac.InitK8S()
 	logrus.SetLevel(logrus.DebugLevel)
 	logrus.Debugln("Debug level enabled")
@@ -41,6 +46,8 @@ func main() {
 	_ = os.MkdirAll("/efs/rdp", 0o777)
 	_ = os.Chmod("/efs/rdp", os.ModePerm)
 
+	go guac.KeepRecordingLease()
+	go guac.ReconcileRecordings()
 	go cleanExpiredRdpFiles()
 
 	// XXX
@@ -51,7 +58,7 @@ func main() {
 
 	chManagement := guac.NewChannelManagement()
 
-	go connectToAstraea(pmHost, chManagement)
+	go subscribePolicyEvents(pmHost, chManagement)
 
 	sessions := guac.NewMemorySessionStore()
 	wsServer.OnConnect = sessions.Add
@@ -105,6 +112,16 @@ func main() {
 	}
 }
 
+// closeLoggingOnSignal delivers the queued audit events before the pod is stopped
+func closeLoggingOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	logrus.Infof("received %v, flushing the audit events", sig)
+	logging.Close()
+	os.Exit(0)
+}
+
 // DemoDoConnect creates the tunnel to the remote machine (via guacd)
 func DemoDoConnect(request *http.Request) (guac.Tunnel, error) {
 	config := guac.NewGuacamoleConfiguration()
@@ -180,6 +197,7 @@ func DemoDoConnect(request *http.Request) (guac.Tunnel, error) {
 	sessionDataKey := sessionId.String()
 
 	loggingInfo := logging.NewLoggingInfo(tenantId, userId, appName, clientIp, s3key, sku, enableRecording, clientPrivateIp)
+	loggingInfo.AppId = appId
 	if app != nil && app.EnableRecording {
 		loggingInfo.EnableRecording = true
 		config.Parameters["recording-path"] = "/efs/rdp"
@@ -211,14 +229,24 @@ func DemoDoConnect(request *http.Request) (guac.Tunnel, error) {
 
 		if app.MonitorPolicyEntryId != "" {
 			monitorPolicy := cli.QueryMonitorPolicyEntryById(app.MonitorPolicyEntryId)
-			session.MonitorPolicyId = monitorPolicy.ID
-			session.MonitorPolicyName = monitorPolicy.Name
-			session.MonitorRules = monitorpolicy.QueryMonitorRuleForUser(monitorPolicy.ID, userId)
+			session.SetMonitor(guacSession.MonitorPolicy{
+				Id:    monitorPolicy.ID,
+				Name:  monitorPolicy.Name,
+				Rules: monitorpolicy.QueryMonitorRuleForUser(monitorPolicy.ID, userId),
+			})
 		}
 		_, fail := storage.GetStorageByTenantId(tenantId, clientConfig.GetRegion())
 		if app.EnableRecording && !fail {
 			session.Recording = true
 		}
+		if app.EnableRecording {
+			session.RecordingName = loggingInfo.GetRecordingFileName()
+			loggingInfo.SessionId = sessionDataKey
+			loggingInfo.Lease = guac.RecordingLease
+			if e := logging.SaveRecordingInfo(loggingInfo); e != nil {
+				logrus.Errorf("cannot save recording info of %s: %v", session.RecordingName, e)
+			}
+		}
 
 		guac.SessionDataStore.Set(sessionDataKey, session)
 	} else { // join a existing rdp session
@@ -286,49 +314,37 @@ func DemoDoConnect(request *http.Request) (guac.Tunnel, error) {
 	return guac.NewSimpleTunnel(stream, sessionId, loggingInfo), nil
 }
 
-func connectToAstraea(pmHost string, chManagement *guac.ChannelManagement) {
-	for {
-		url := fmt.Sprintf("ws://%s/ws", pmHost)
-		logrus.Infof("ws connecting to %s", url)
-
-		c, _, err := websocket.DefaultDialer.Dial(url, nil)
-		if err != nil {
-			logrus.Fatalf("dial: %s", err.Error())
-			time.Sleep(10 * time.Second)
-			continue
-		}
-
-		for {
-			request := PolicyNotifyRequest{}
-			err = c.ReadJSON(&request)
-			if err != nil {
-				logrus.Errorf("read from ws err: %s", err.Error())
-				c.Close()
-				break
-			} else {
-				//  logrus.Infof("received msg %#v", request)
-				for _, event := range request.Events {
-					for _, id := range event.IDs {
-						_ = chManagement.BroadCast(id, 1)
-					}
+// subscribePolicyEvents publishes the changes in policy management to the sessions
+func subscribePolicyEvents(pmHost string, chManagement *guac.ChannelManagement) {
+	subscriber := guac.NewPolicySubscriber(fmt.Sprintf("ws://%s/ws", pmHost))
+	publish := func(scopes ...func(string) guac.Topic) func(guac.PolicyEvent) {
+		return func(event guac.PolicyEvent) {
+			for _, id := range event.IDs {
+				for _, topic := range scopes {
+					chManagement.Publish(topic(id), event.Type)
 				}
 			}
 		}
 	}
+	// the ids of policy changes are app or user ids
+	subscriber.Handle(guac.PolicyEventPolicy, publish(guac.AppTopic, guac.UserTopic))
+	subscriber.Handle(guac.PolicyEventUnknown, publish(guac.AppTopic, guac.UserTopic))
+	subscriber.Handle(guac.PolicyEventApp, publish(guac.AppTopic))
+	subscriber.Handle(guac.PolicyEventUser, publish(guac.UserTopic))
+	subscriber.Handle(guac.PolicyEventMonitorPolicy, func(event guac.PolicyEvent) {
+		for _, app := range guac.AppsWithMonitorPolicy(event.IDs) {
+			chManagement.Publish(guac.AppTopic(app), event.Type)
+		}
+	})
+	subscriber.Run(context.Background())
 }
 
+// cleanExpiredRdpFiles empties the drives of expired files and enforces the recording retention
 func cleanExpiredRdpFiles() {
 	tick := time.NewTicker(10 * time.Minute)
 	defer tick.Stop()
 	for range tick.C {
-		utils.CleanExpiredFiles("/efs/rdp/*", "*", 24*time.Hour)
+		utils.CleanExpiredFiles("/efs/rdp/rdp_system_*", "*", 24*time.Hour)
+		guac.ReapRecordings()
 	}
 }
-
-type PolicyNotifyEvent struct {
-	TypeName string   `json:"typeName"`
-	IDs      []string `json:"ids"`
-}
-type PolicyNotifyRequest struct {
-	Events []PolicyNotifyEvent `json:"events"`
-}
@@ -7,11 +7,14 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/wwt/guac/lib/logging"
+	"github.com/wwt/guac/lib/settings"
 	guac "github.com/wwt/guac/pkg"
 )
 
 func main() {
+	settings.Init()
 	logging.Init()
+	defer logging.Close()
 
 	podName := os.Getenv("POD_NAME")
 
@@ -27,5 +30,6 @@ func main() {
 		}
 	}
 	logrus.Infof("index %d", index)
+	guac.ReconcileRecordings()
 	guac.EncodeRecording(index)
 }
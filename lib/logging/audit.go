@@ -0,0 +1,301 @@
+package logging
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"github.com/wwt/guac/lib/settings"
+)
+
+// AuditSchemaVersion is the version of the fields of the audit events
+const AuditSchemaVersion = "1"
+
+const (
+	defaultAuditBufferSize    = 4096
+	defaultAuditBatchSize     = 100
+	defaultAuditFlushInterval = time.Second
+	defaultAuditEnrichWorkers = 16
+	auditRetryBackoff         = 500 * time.Millisecond
+	auditMaxRetryBackoff      = time.Minute
+	// auditCloseRetries bounds the retries of the batches still pending at shutdown
+	auditCloseRetries = 3
+)
+
+var (
+	auditDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "audit_dropped_events",
+		Help: "The audit events dropped as the queue of the pipeline was full",
+	})
+	auditSinkDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "audit_sink_dropped_events",
+		Help: "The audit events a sink dropped, as its queue was full, they were pending at shutdown or can't be encoded",
+	}, []string{"sink", "reason"})
+)
+
+// sinkName names a sink in the logs and metrics by its type
+func sinkName(sink AuditSink) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", sink), "*logging.")
+}
+
+// encodeEvents encodes the events of a batch for a sink and writes them, the events
+// which can't be encoded are skipped as no retry would deliver them
+func encodeEvents(sink AuditSink, encoder AuditEncoder, events []AuditEvent, write func(event AuditEvent, data []byte) error) error {
+	for _, event := range events {
+		data, err := encoder.Encode(event)
+		if err != nil {
+			logrus.Errorf("audit sink %s skips event %s, it can't be encoded: %v", sinkName(sink), event.Action.AppTag, err)
+			auditSinkDropped.WithLabelValues(sinkName(sink), "unencodable").Inc()
+			continue
+		}
+		if err = write(event, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AuditEvent is an action logged at Time
+type AuditEvent struct {
+	Time   time.Time
+	Action Action
+	// recordingName is the recording of the session the action is journaled to
+	recordingName string
+}
+
+// enrich runs the enrichment of the action, a panic loses the enrichment but not the event
+func (e *AuditEvent) enrich() {
+	enrich := e.Action.Enrich
+	if enrich == nil {
+		return
+	}
+	e.Action.Enrich = nil
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.Errorf("enrich audit event %s failed %v", e.Action.AppTag, r)
+		}
+	}()
+	enrich(&e.Action)
+}
+
+func (e *AuditEvent) journal() {
+	if e.recordingName != "" {
+		journal(e.recordingName, JournalEntry{Time: e.Time, Action: e.Action})
+	}
+}
+
+// AuditSink delivers batches of audit events. A batch which fails is written again,
+// so a sink must accept events it may already have received, and fail only to
+// deliver: an event it can't encode is skipped, see encodeEvents.
+type AuditSink interface {
+	Write(events []AuditEvent) error
+	Close() error
+}
+
+// AuditPipeline delivers the audit events to the sinks in the background. Publish
+// never blocks: every sink has a bounded queue, and events are dropped for a sink
+// whose queue is full. A queued event is retried until its sink accepts it.
+type AuditPipeline struct {
+	queue   chan AuditEvent
+	workers []*auditSinkWorker
+	done    sync.WaitGroup
+	// stop is closed by Close, it ends the unbounded retries
+	stop chan struct{}
+	// lock guards closed, which stops the publishing into the closed queue
+	lock    sync.RWMutex
+	closed  bool
+	dropped atomic.Int64
+}
+
+type auditSinkWorker struct {
+	sink          AuditSink
+	queue         chan AuditEvent
+	batchSize     int
+	flushInterval time.Duration
+	stop          <-chan struct{}
+	dropped       atomic.Int64
+}
+
+// NewAuditPipeline starts the delivery to the sinks
+func NewAuditPipeline(cfg settings.AuditSettings, sinks ...AuditSink) *AuditPipeline {
+	bufferSize, batchSize, flushInterval := cfg.BufferSize, cfg.BatchSize, time.Duration(cfg.FlushInterval)*time.Millisecond
+	enrichWorkers := cfg.EnrichWorkers
+	if bufferSize <= 0 {
+		bufferSize = defaultAuditBufferSize
+	}
+	if batchSize <= 0 {
+		batchSize = defaultAuditBatchSize
+	}
+	if flushInterval <= 0 {
+		flushInterval = defaultAuditFlushInterval
+	}
+	if enrichWorkers <= 0 {
+		enrichWorkers = defaultAuditEnrichWorkers
+	}
+
+	p := &AuditPipeline{queue: make(chan AuditEvent, bufferSize), stop: make(chan struct{})}
+	for _, sink := range sinks {
+		w := &auditSinkWorker{
+			sink:          sink,
+			queue:         make(chan AuditEvent, bufferSize),
+			batchSize:     batchSize,
+			flushInterval: flushInterval,
+			stop:          p.stop,
+		}
+		p.workers = append(p.workers, w)
+		p.done.Add(1)
+		go func() {
+			defer p.done.Done()
+			w.run()
+		}()
+	}
+	// the enriched events are delivered in the order they were published
+	pending := make(chan chan AuditEvent, enrichWorkers)
+	p.done.Add(2)
+	go func() {
+		defer p.done.Done()
+		p.dispatch(pending, enrichWorkers)
+	}()
+	go func() {
+		defer p.done.Done()
+		p.deliver(pending)
+	}()
+	return p
+}
+
+// Publish queues an event, it returns false if the event was dropped
+func (p *AuditPipeline) Publish(event AuditEvent) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.closed {
+		return false
+	}
+	select {
+	case p.queue <- event:
+		return true
+	default:
+		p.dropped.Add(1)
+		auditDropped.Inc()
+		return false
+	}
+}
+
+// dispatch enriches up to workers events at once, enriching may query the policy of
+// an action, and queues their results to pending in order
+func (p *AuditPipeline) dispatch(pending chan<- chan AuditEvent, workers int) {
+	running := make(chan struct{}, workers)
+	for event := range p.queue {
+		running <- struct{}{}
+		result := make(chan AuditEvent, 1)
+		pending <- result
+		go func(event AuditEvent) {
+			defer func() { <-running }()
+			event.enrich()
+			result <- event
+		}(event)
+	}
+	close(pending)
+}
+
+// deliver journals the enriched events and hands them to the sinks
+func (p *AuditPipeline) deliver(pending <-chan chan AuditEvent) {
+	for result := range pending {
+		event := <-result
+		event.journal()
+		for _, w := range p.workers {
+			select {
+			case w.queue <- event:
+			default:
+				auditSinkDropped.WithLabelValues(sinkName(w.sink), "full").Inc()
+				if w.dropped.Add(1) == 1 {
+					logrus.Errorf("audit sink %T is too slow, events are dropped", w.sink)
+				}
+			}
+		}
+	}
+	for _, w := range p.workers {
+		close(w.queue)
+	}
+}
+
+// Close delivers the queued events and closes the sinks
+func (p *AuditPipeline) Close() {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.queue)
+	close(p.stop)
+	p.lock.Unlock()
+	p.done.Wait()
+	for _, w := range p.workers {
+		if err := w.sink.Close(); err != nil {
+			logrus.Errorf("close audit sink %T failed %v", w.sink, err)
+		}
+	}
+	if dropped := p.dropped.Load(); dropped > 0 {
+		logrus.Errorf("%d audit events were dropped", dropped)
+	}
+}
+
+func (w *auditSinkWorker) run() {
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+	var batch []AuditEvent
+	for {
+		select {
+		case event, ok := <-w.queue:
+			if !ok {
+				w.write(batch)
+				return
+			}
+			if batch = append(batch, event); len(batch) >= w.batchSize {
+				w.write(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			w.write(batch)
+			batch = nil
+		}
+	}
+}
+
+// write retries a batch until the sink accepts it, a bounded number of times once
+// the pipeline is closing
+func (w *auditSinkWorker) write(batch []AuditEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	backoff := auditRetryBackoff
+	stopped := 0
+	for {
+		err := w.sink.Write(batch)
+		if err == nil {
+			return
+		}
+		select {
+		case <-w.stop:
+			if stopped++; stopped >= auditCloseRetries {
+				logrus.Errorf("audit sink %T lost %d events: %v", w.sink, len(batch), err)
+				auditSinkDropped.WithLabelValues(sinkName(w.sink), "closed").Add(float64(len(batch)))
+				return
+			}
+		default:
+		}
+		logrus.Errorf("audit sink %T failed, retry in %v: %v", w.sink, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-w.stop:
+		}
+		if backoff *= 2; backoff > auditMaxRetryBackoff {
+			backoff = auditMaxRetryBackoff
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	AuditFormatLine = "line"
+	AuditFormatJSON = "json"
+	AuditFormatCEF  = "cef"
+	AuditFormatOCSF = "ocsf"
+
+	auditVendor  = "Appaegis"
+	auditProduct = "guac"
+)
+
+// AuditEncoder encodes an event for a sink
+type AuditEncoder interface {
+	Encode(event AuditEvent) ([]byte, error)
+	// ContentType is the media type of the encoded events
+	ContentType() string
+}
+
+var auditEncoders = map[string]AuditEncoder{
+	AuditFormatLine: LineEncoder{},
+	AuditFormatJSON: JSONEncoder{},
+	AuditFormatCEF:  CEFEncoder{},
+	AuditFormatOCSF: OCSFEncoder{},
+}
+
+// GetAuditEncoder returns the encoder of a format
+func GetAuditEncoder(format string) (AuditEncoder, error) {
+	encoder, ok := auditEncoders[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown audit format %q", format)
+	}
+	return encoder, nil
+}
+
+// LineEncoder is the format of the log file, the time followed by the json of the action
+type LineEncoder struct{}
+
+func (LineEncoder) Encode(event AuditEvent) ([]byte, error) {
+	data, err := json.Marshal(event.Action)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(formatAuditLine(event.Time, data)), nil
+}
+
+func (LineEncoder) ContentType() string {
+	return "text/plain"
+}
+
+// JSONEncoder encodes the action with its time
+type JSONEncoder struct{}
+
+func (JSONEncoder) Encode(event AuditEvent) ([]byte, error) {
+	return json.Marshal(JournalEntry{Time: event.Time, Action: event.Action})
+}
+
+func (JSONEncoder) ContentType() string {
+	return "application/json"
+}
+
+// auditEventNames are the readable names of the app tags
+var auditEventNames = map[string]string{
+	"rdp.open":                   "RDP session opened",
+	"rdp.exit":                   "RDP session closed",
+	"rdp.join":                   "RDP session joined",
+	"rdp.leave":                  "RDP session left",
+	"rdp.access":                 "RDP access",
+	"rdp.upload":                 "File uploaded",
+	"rdp.download":               "File downloaded",
+	"rdp.upload.block":           "File upload blocked",
+	"rdp.download.block":         "File download blocked",
+	"rdp.copy":                   "Clipboard copied",
+	"rdp.paste":                  "Clipboard pasted",
+	"rdp.copy.block":             "Clipboard copy blocked",
+	"rdp.paste.block":            "Clipboard paste blocked",
+	"rdp.revoked":                "RDP access revoked",
+	"rdp.timeout":                "RDP session timed out",
+	"rdp.recording.delete":       "Recording deleted",
+	"rdp.recording.invalid":      "Recording invalid",
+	"rdp.recording.unattributed": "Recording unattributed",
+}
+
+func auditEventName(tag string) string {
+	if name, ok := auditEventNames[tag]; ok {
+		return name
+	}
+	return tag
+}
+
+func isBlocked(action Action) bool {
+	return strings.HasSuffix(action.AppTag, ".block") || action.BlockPolicyType != ""
+}
+
+// CEFEncoder encodes an event as an ArcSight Common Event Format message. The app
+// tag is the signature id, the ids and names guac has no CEF key for are custom strings.
+type CEFEncoder struct{}
+
+func (CEFEncoder) Encode(event AuditEvent) ([]byte, error) {
+	a := event.Action
+	severity := 3
+	switch {
+	case isBlocked(a):
+		severity = 7
+	case a.AppTag == "rdp.revoked" || a.AppTag == "rdp.timeout":
+		severity = 5
+	}
+
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "CEF:0|%s|%s|%s|%s|%s|%d|",
+		cefHeader(auditVendor), cefHeader(auditProduct), cefHeader(a.SchemaVersion),
+		cefHeader(a.AppTag), cefHeader(auditEventName(a.AppTag)), severity)
+
+	ext := cefExtensions{b: &b}
+	ext.add("rt", strconv.FormatInt(event.Time.UnixMilli(), 10))
+	ext.add("suser", a.UserEmail)
+	ext.add("src", a.ClientIP)
+	ext.add("dhost", a.Destination)
+	ext.add("app", strings.ToUpper(a.AppType))
+	ext.add("filePath", a.RemotePath)
+	ext.add("fname", strings.Join(a.Files, ","))
+	if a.FileCount > 0 {
+		ext.add("cnt", strconv.Itoa(a.FileCount))
+	}
+	if isBlocked(a) {
+		ext.add("act", "blocked")
+		ext.add("reason", a.BlockReason)
+	} else {
+		ext.add("reason", a.Reason)
+	}
+	ext.addCustom("cs1", "tenantId", a.TenantID)
+	ext.addCustom("cs2", "appId", a.AppID)
+	ext.addCustom("cs3", "appName", a.AppName)
+	ext.addCustom("cs4", "sessionId", a.RdpSessionId)
+	ext.addCustom("cs5", "policyName", a.PolicyName)
+	ext.addCustom("cs6", "blockPolicyType", a.BlockPolicyType)
+	ext.addCustom("flexString1", "clientPrivateIp", a.ClientPrivateIp)
+	ext.addCustom("flexString2", "monitorPolicyName", a.MonitorPolicyName)
+	return []byte(b.String()), nil
+}
+
+func (CEFEncoder) ContentType() string {
+	return "text/plain"
+}
+
+// cefExtensions writes the key value pairs of a CEF message, empty values are left out
+type cefExtensions struct {
+	b     *strings.Builder
+	count int
+}
+
+func (e *cefExtensions) add(key, value string) {
+	if value == "" {
+		return
+	}
+	if e.count > 0 {
+		e.b.WriteByte(' ')
+	}
+	e.count++
+	e.b.WriteString(key)
+	e.b.WriteByte('=')
+	e.b.WriteString(cefExtension(value))
+}
+
+// addCustom writes a custom field with the label naming it
+func (e *cefExtensions) addCustom(key, label, value string) {
+	if value == "" {
+		return
+	}
+	e.add(key+"Label", label)
+	e.add(key, value)
+}
+
+// cefHeader escapes a header field, where the pipe separates the fields
+func cefHeader(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ").Replace(value)
+}
+
+// cefExtension escapes an extension value, where the equal sign separates the key
+func cefExtension(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r\n", `\n`, "\n", `\n`, "\r", `\r`).Replace(value)
+}
+
+// OCSFVersion is the version of the OCSF schema of the encoded events
+const OCSFVersion = "1.1.0"
+
+const (
+	ocsfCategoryIAM         = 3
+	ocsfCategoryApplication = 6
+
+	ocsfClassBase           = 0
+	ocsfClassAuthentication = 3002
+	ocsfClassFileHosting    = 6006
+
+	ocsfActivityLogon    = 1
+	ocsfActivityLogoff   = 2
+	ocsfActivityUpload   = 1
+	ocsfActivityDownload = 2
+	ocsfActivityOther    = 99
+
+	ocsfLogonTypeRemoteInteractive = 10
+)
+
+type ocsfProduct struct {
+	Name       string `json:"name"`
+	VendorName string `json:"vendor_name"`
+}
+
+type ocsfMetadata struct {
+	Version   string      `json:"version"`
+	Product   ocsfProduct `json:"product"`
+	LogName   string      `json:"log_name,omitempty"`
+	TenantUID string      `json:"tenant_uid,omitempty"`
+}
+
+type ocsfUser struct {
+	EmailAddr string `json:"email_addr,omitempty"`
+	Name      string `json:"name,omitempty"`
+}
+
+type ocsfSession struct {
+	UID string `json:"uid"`
+}
+
+type ocsfActor struct {
+	User    *ocsfUser    `json:"user,omitempty"`
+	Session *ocsfSession `json:"session,omitempty"`
+}
+
+type ocsfEndpoint struct {
+	IP       string `json:"ip,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+}
+
+type ocsfService struct {
+	Name string `json:"name,omitempty"`
+	UID  string `json:"uid,omitempty"`
+}
+
+type ocsfPolicy struct {
+	Name string `json:"name,omitempty"`
+	UID  string `json:"uid,omitempty"`
+}
+
+type ocsfFile struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+	Type string `json:"type,omitempty"`
+}
+
+// ocsfEvent holds the fields of the classes guac encodes to, a class leaves the
+// fields of the others empty
+type ocsfEvent struct {
+	Metadata      ocsfMetadata   `json:"metadata"`
+	Time          int64          `json:"time"`
+	CategoryUID   int            `json:"category_uid"`
+	ClassUID      int            `json:"class_uid"`
+	ActivityID    int            `json:"activity_id"`
+	TypeUID       int            `json:"type_uid"`
+	SeverityID    int            `json:"severity_id"`
+	StatusID      int            `json:"status_id"`
+	ActionID      int            `json:"action_id,omitempty"`
+	DispositionID int            `json:"disposition_id,omitempty"`
+	Message       string         `json:"message"`
+	StatusDetail  string         `json:"status_detail,omitempty"`
+	Actor         ocsfActor      `json:"actor"`
+	User          *ocsfUser      `json:"user,omitempty"`
+	Session       *ocsfSession   `json:"session,omitempty"`
+	LogonTypeID   int            `json:"logon_type_id,omitempty"`
+	IsRemote      *bool          `json:"is_remote,omitempty"`
+	Service       *ocsfService   `json:"service,omitempty"`
+	File          *ocsfFile      `json:"file,omitempty"`
+	Policy        *ocsfPolicy    `json:"policy,omitempty"`
+	SrcEndpoint   *ocsfEndpoint  `json:"src_endpoint,omitempty"`
+	DstEndpoint   *ocsfEndpoint  `json:"dst_endpoint,omitempty"`
+	Unmapped      map[string]any `json:"unmapped,omitempty"`
+}
+
+// OCSFEncoder encodes an event in the Open Cybersecurity Schema Framework. Sessions
+// are authentication activity, logon when a user opens or joins a session and logoff
+// when the user leaves or is disconnected. Uploads and downloads are file hosting
+// activity, failed when they were blocked. The other actions are base events.
+type OCSFEncoder struct{}
+
+func (OCSFEncoder) Encode(event AuditEvent) ([]byte, error) {
+	a := event.Action
+	e := ocsfEvent{
+		Metadata: ocsfMetadata{
+			Version:   OCSFVersion,
+			Product:   ocsfProduct{Name: auditProduct, VendorName: auditVendor},
+			LogName:   a.AppTag,
+			TenantUID: a.TenantID,
+		},
+		Time:        event.Time.UnixMilli(),
+		CategoryUID: ocsfCategoryApplication,
+		ClassUID:    ocsfClassBase,
+		ActivityID:  ocsfActivityOther,
+		SeverityID:  1,
+		StatusID:    1,
+		Message:     auditEventName(a.AppTag),
+		Actor:       ocsfActor{User: &ocsfUser{EmailAddr: a.UserEmail, Name: a.Username}},
+	}
+	if a.RdpSessionId != "" {
+		e.Actor.Session = &ocsfSession{UID: a.RdpSessionId}
+	}
+	if a.ClientIP != "" {
+		e.SrcEndpoint = &ocsfEndpoint{IP: a.ClientIP}
+	}
+	if a.Destination != "" {
+		e.DstEndpoint = &ocsfEndpoint{Hostname: a.Destination}
+	}
+	if a.AppID != "" || a.AppName != "" {
+		e.Service = &ocsfService{Name: a.AppName, UID: a.AppID}
+	}
+	if a.PolicyID != "" || a.PolicyName != "" {
+		e.Policy = &ocsfPolicy{Name: a.PolicyName, UID: a.PolicyID}
+	}
+
+	switch strings.TrimSuffix(a.AppTag, ".block") {
+	case "rdp.open", "rdp.join":
+		e.setLogon(ocsfActivityLogon)
+	case "rdp.exit", "rdp.leave", "rdp.revoked", "rdp.timeout":
+		e.setLogon(ocsfActivityLogoff)
+	case "rdp.upload":
+		e.setFile(a, ocsfActivityUpload)
+	case "rdp.download":
+		e.setFile(a, ocsfActivityDownload)
+	}
+	if e.ClassUID == ocsfClassBase {
+		// a base event has no category
+		e.CategoryUID = 0
+	}
+	e.TypeUID = e.ClassUID*100 + e.ActivityID
+
+	if isBlocked(a) {
+		e.SeverityID, e.StatusID, e.ActionID, e.DispositionID = 4, 2, 2, 2
+		e.StatusDetail = a.BlockReason
+	} else if a.Reason != "" {
+		e.StatusDetail = a.Reason
+	}
+
+	unmapped := map[string]any{}
+	for key, value := range map[string]string{
+		"app_tag":             a.AppTag,
+		"schema_version":      a.SchemaVersion,
+		"client_private_ip":   a.ClientPrivateIp,
+		"monitor_policy_id":   a.MonitorPolicyId,
+		"monitor_policy_name": a.MonitorPolicyName,
+		"block_policy_type":   a.BlockPolicyType,
+	} {
+		if value != "" {
+			unmapped[key] = value
+		}
+	}
+	if a.Recording {
+		unmapped["recording"] = true
+	}
+	if len(a.Files) > 1 {
+		unmapped["files"] = a.Files
+	}
+	e.Unmapped = unmapped
+	return json.Marshal(e)
+}
+
+func (e *ocsfEvent) setLogon(activity int) {
+	remote := true
+	e.CategoryUID, e.ClassUID, e.ActivityID = ocsfCategoryIAM, ocsfClassAuthentication, activity
+	e.User = e.Actor.User
+	e.Session = e.Actor.Session
+	e.LogonTypeID = ocsfLogonTypeRemoteInteractive
+	e.IsRemote = &remote
+}
+
+func (e *ocsfEvent) setFile(a Action, activity int) {
+	e.CategoryUID, e.ClassUID, e.ActivityID = ocsfCategoryApplication, ocsfClassFileHosting, activity
+	e.File = &ocsfFile{Path: a.RemotePath, Type: "File"}
+	if len(a.Files) == 1 {
+		e.File.Name = a.Files[0]
+	}
+}
+
+func (OCSFEncoder) ContentType() string {
+	return "application/json"
+}
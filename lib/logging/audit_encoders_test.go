@@ -0,0 +1,100 @@
+package logging
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var update = flag.Bool("update", false, "update the golden files of the encoders")
+
+func sampleAuditEvents() []AuditEvent {
+	at := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	session := Action{
+		AppType:         "rdp",
+		ProductType:     "Portal",
+		SchemaVersion:   AuditSchemaVersion,
+		TenantID:        "tenant-1",
+		AppID:           "app-1",
+		AppName:         "Finance Desktop",
+		RdpSessionId:    "session-1",
+		UserEmail:       "alice@example.com",
+		ClientIP:        "203.0.113.7",
+		ClientPrivateIp: "10.0.0.7",
+		Destination:     "finance.internal",
+		PolicyID:        "policy-1",
+		PolicyName:      "Finance | Access",
+	}
+	with := func(tag string, change func(a *Action)) AuditEvent {
+		a := session
+		a.AppTag = tag
+		if change != nil {
+			change(&a)
+		}
+		return AuditEvent{Time: at, Action: a}
+	}
+	return []AuditEvent{
+		with("rdp.open", nil),
+		with("rdp.join", func(a *Action) { a.UserEmail = "bob@example.com" }),
+		with("rdp.leave", func(a *Action) { a.UserEmail = "bob@example.com" }),
+		with("rdp.exit", nil),
+		with("rdp.timeout", func(a *Action) { a.Reason = "idle for 30m" }),
+		with("rdp.upload", func(a *Action) {
+			a.RemotePath = `\\tsclient\drive`
+			a.Files = []string{"report=q1.xlsx"}
+			a.FileCount = 1
+		}),
+		with("rdp.download.block", func(a *Action) {
+			a.RemotePath = "/home/alice"
+			a.Files = []string{"a.txt", "b.txt"}
+			a.FileCount = 2
+			a.BlockPolicyType = "dlp"
+			a.BlockReason = "credit card\nnumbers"
+		}),
+		with("rdp.paste.block", func(a *Action) {
+			a.RemotePath = "Clipboard"
+			a.BlockPolicyType = "policy"
+			a.BlockReason = "Denied by policy"
+		}),
+		with("rdp.access", nil),
+	}
+}
+
+func testGolden(t *testing.T, encoder AuditEncoder, name string) {
+	out := bytes.Buffer{}
+	for _, event := range sampleAuditEvents() {
+		data, err := encoder.Encode(event)
+		assert.Nil(t, err)
+		out.Write(data)
+		out.WriteByte('\n')
+	}
+	path := filepath.Join("testdata", name)
+	if *update {
+		assert.Nil(t, os.WriteFile(path, out.Bytes(), 0o644))
+	}
+	golden, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, string(golden), out.String())
+}
+
+func TestCEFEncoder(t *testing.T) {
+	testGolden(t, CEFEncoder{}, "cef.golden")
+}
+
+func TestOCSFEncoder(t *testing.T) {
+	testGolden(t, OCSFEncoder{}, "ocsf.golden")
+}
+
+func TestGetAuditEncoder(t *testing.T) {
+	for _, format := range []string{AuditFormatLine, AuditFormatJSON, AuditFormatCEF, AuditFormatOCSF} {
+		_, err := GetAuditEncoder(format)
+		assert.Nil(t, err, format)
+	}
+	_, err := GetAuditEncoder("leef")
+	assert.NotNil(t, err)
+}
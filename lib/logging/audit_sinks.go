@@ -0,0 +1,322 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wwt/guac/lib/settings"
+)
+
+const (
+	AuditSinkFile    = "file"
+	AuditSinkStdout  = "stdout"
+	AuditSinkWebhook = "webhook"
+	AuditSinkSyslog  = "syslog"
+	AuditSinkKafka   = "kafka"
+
+	// syslogPriority is facility local0 and severity informational
+	syslogPriority = 16*8 + 6
+	syslogAppName  = "appaegis_guac"
+	defaultTopic   = "audit"
+)
+
+// NewAuditSink returns the sink of the settings
+func NewAuditSink(cfg settings.AuditSinkSettings) (AuditSink, error) {
+	format := cfg.Format
+	if format == "" {
+		format = AuditFormatJSON
+		if cfg.Type == AuditSinkFile || cfg.Type == AuditSinkStdout {
+			format = AuditFormatLine
+		}
+	}
+	encoder, err := GetAuditEncoder(format)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.Type {
+	case AuditSinkFile:
+		return NewFileSink(cfg.Path, encoder)
+	case AuditSinkStdout:
+		return &LineSink{Writer: os.Stdout, Encoder: encoder}, nil
+	case AuditSinkWebhook:
+		return &WebhookSink{URL: cfg.URL, Client: &http.Client{Timeout: 10 * time.Second}, Encoder: encoder}, nil
+	case AuditSinkSyslog:
+		return NewSyslogSink(cfg.Network, cfg.Address, encoder), nil
+	case AuditSinkKafka:
+		topic := cfg.Topic
+		if topic == "" {
+			topic = defaultTopic
+		}
+		producer, err := NewLocalProducer(cfg.Path, cfg.Partitions)
+		if err != nil {
+			return nil, err
+		}
+		return &KafkaSink{Producer: producer, Topic: topic, Encoder: encoder}, nil
+	default:
+		return nil, fmt.Errorf("unknown audit sink %q", cfg.Type)
+	}
+}
+
+// LineSink writes an event per line
+type LineSink struct {
+	Writer  io.Writer
+	Encoder AuditEncoder
+	closer  io.Closer
+}
+
+// NewFileSink appends the events to a file
+func NewFileSink(path string, encoder AuditEncoder) (*LineSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &LineSink{Writer: f, Encoder: encoder, closer: f}, nil
+}
+
+func (s *LineSink) Write(events []AuditEvent) error {
+	buf := bytes.Buffer{}
+	_ = encodeEvents(s, s.Encoder, events, func(_ AuditEvent, data []byte) error {
+		buf.Write(data)
+		buf.WriteByte('\n')
+		return nil
+	})
+	if buf.Len() == 0 {
+		return nil
+	}
+	_, err := s.Writer.Write(buf.Bytes())
+	return err
+}
+
+func (s *LineSink) Close() error {
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	return nil
+}
+
+// WebhookSink posts a batch, as a json array when the encoder encodes json and as
+// lines otherwise
+type WebhookSink struct {
+	URL     string
+	Client  *http.Client
+	Encoder AuditEncoder
+}
+
+func (s *WebhookSink) Write(events []AuditEvent) error {
+	jsonArray := s.Encoder.ContentType() == "application/json"
+	buf := bytes.Buffer{}
+	if jsonArray {
+		buf.WriteByte('[')
+	}
+	encoded := 0
+	_ = encodeEvents(s, s.Encoder, events, func(_ AuditEvent, data []byte) error {
+		if encoded > 0 && jsonArray {
+			buf.WriteByte(',')
+		}
+		encoded++
+		buf.Write(data)
+		if !jsonArray {
+			buf.WriteByte('\n')
+		}
+		return nil
+	})
+	if encoded == 0 {
+		return nil
+	}
+	if jsonArray {
+		buf.WriteByte(']')
+	}
+	resp, err := s.Client.Post(s.URL, s.Encoder.ContentType(), &buf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s returned %d", s.URL, resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *WebhookSink) Close() error {
+	return nil
+}
+
+// SyslogSink sends the events as RFC 5424 messages. Over tcp the messages are
+// framed by octet counting (RFC 6587), over udp a message is a datagram.
+type SyslogSink struct {
+	Network  string
+	Address  string
+	Hostname string
+	Encoder  AuditEncoder
+
+	conn net.Conn
+}
+
+func NewSyslogSink(network, address string, encoder AuditEncoder) *SyslogSink {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	return &SyslogSink{Network: network, Address: address, Hostname: hostname, Encoder: encoder}
+}
+
+func (s *SyslogSink) Write(events []AuditEvent) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.Network, s.Address, 10*time.Second)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	return encodeEvents(s, s.Encoder, events, func(event AuditEvent, data []byte) error {
+		message := s.format(event, data)
+		if s.Network != "udp" {
+			message = append([]byte(fmt.Sprintf("%d ", len(message))), message...)
+		}
+		if _, err := s.conn.Write(message); err != nil {
+			// the batch is retried on a new connection
+			s.conn.Close()
+			s.conn = nil
+			return err
+		}
+		return nil
+	})
+}
+
+// format returns the RFC 5424 message of an encoded event, the app tag is the MSGID
+func (s *SyslogSink) format(event AuditEvent, data []byte) []byte {
+	return []byte(fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+		syslogPriority,
+		event.Time.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogField(s.Hostname, 255),
+		syslogAppName,
+		os.Getpid(),
+		syslogField(event.Action.AppTag, 32),
+		data))
+}
+
+// syslogField is a header field of printable ascii without spaces, "-" if it's empty
+func syslogField(value string, maxLen int) string {
+	field := strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, value)
+	if len(field) > maxLen {
+		field = field[:maxLen]
+	}
+	if field == "" {
+		return "-"
+	}
+	return field
+}
+
+func (s *SyslogSink) Close() error {
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
+
+// Producer publishes records to the partitions of a topic, as a Kafka producer does
+type Producer interface {
+	Produce(topic string, key, value []byte) error
+	Close() error
+}
+
+// KafkaSink produces the events keyed by tenant, which keeps the events of a tenant in order
+type KafkaSink struct {
+	Producer Producer
+	Topic    string
+	Encoder  AuditEncoder
+}
+
+func (s *KafkaSink) Write(events []AuditEvent) error {
+	return encodeEvents(s, s.Encoder, events, func(event AuditEvent, value []byte) error {
+		return s.Producer.Produce(s.Topic, []byte(event.Action.TenantID), value)
+	})
+}
+
+func (s *KafkaSink) Close() error {
+	return s.Producer.Close()
+}
+
+// LocalRecord is a record of a partition of a LocalProducer
+type LocalRecord struct {
+	Offset int64  `json:"offset"`
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+}
+
+// LocalProducer stands in for a Kafka producer where there is no broker. The
+// partitions of a topic are files of records in Dir named <topic>-<partition>.log,
+// and a record goes to the partition of the hash of its key.
+type LocalProducer struct {
+	Dir        string
+	Partitions int
+
+	lock    sync.Mutex
+	offsets map[string]int64
+}
+
+func NewLocalProducer(dir string, partitions int) (*LocalProducer, error) {
+	if partitions <= 0 {
+		partitions = 1
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &LocalProducer{Dir: dir, Partitions: partitions, offsets: map[string]int64{}}, nil
+}
+
+// PartitionPath returns the file of a partition of a topic
+func (p *LocalProducer) PartitionPath(topic string, partition int) string {
+	return filepath.Join(p.Dir, fmt.Sprintf("%s-%d.log", topic, partition))
+}
+
+func (p *LocalProducer) Produce(topic string, key, value []byte) error {
+	h := fnv.New32a()
+	_, _ = h.Write(key)
+	path := p.PartitionPath(topic, int(h.Sum32()%uint32(p.Partitions)))
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	offset, ok := p.offsets[path]
+	if !ok {
+		// continues the offsets of a partition written before a restart
+		if data, err := os.ReadFile(path); err == nil {
+			offset = int64(bytes.Count(data, []byte{'\n'}))
+		}
+	}
+	record, err := json.Marshal(LocalRecord{Offset: offset, Key: string(key), Value: string(value)})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Write(append(record, '\n')); err != nil {
+		return err
+	}
+	p.offsets[path] = offset + 1
+	return nil
+}
+
+func (p *LocalProducer) Close() error {
+	return nil
+}
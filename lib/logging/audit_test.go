@@ -0,0 +1,260 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/wwt/guac/lib/settings"
+)
+
+type fakeSink struct {
+	lock    sync.Mutex
+	fails   int
+	block   chan struct{}
+	batches [][]AuditEvent
+	closed  bool
+}
+
+func (s *fakeSink) Write(events []AuditEvent) error {
+	if s.block != nil {
+		<-s.block
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.fails > 0 {
+		s.fails--
+		return errors.New("unavailable")
+	}
+	s.batches = append(s.batches, append([]AuditEvent{}, events...))
+	return nil
+}
+
+func (s *fakeSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func (s *fakeSink) tags() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var tags []string
+	for _, batch := range s.batches {
+		for _, event := range batch {
+			tags = append(tags, event.Action.AppTag)
+		}
+	}
+	return tags
+}
+
+func TestAuditPipelineBatchesAndRetries(t *testing.T) {
+	sink := &fakeSink{fails: 1}
+	p := NewAuditPipeline(settings.AuditSettings{BatchSize: 2, FlushInterval: 10}, sink)
+	for _, tag := range []string{"rdp.a", "rdp.b", "rdp.c"} {
+		assert.True(t, p.Publish(AuditEvent{Time: time.Now(), Action: Action{AppTag: tag}}))
+	}
+	p.Close()
+
+	assert.Equal(t, []string{"rdp.a", "rdp.b", "rdp.c"}, sink.tags())
+	assert.Len(t, sink.batches[0], 2)
+	assert.True(t, sink.closed)
+	assert.False(t, p.Publish(AuditEvent{Action: Action{AppTag: "rdp.late"}}))
+}
+
+func TestAuditPipelineDropsWhenFull(t *testing.T) {
+	sink := &fakeSink{block: make(chan struct{})}
+	p := NewAuditPipeline(settings.AuditSettings{BufferSize: 1, BatchSize: 1}, sink)
+
+	done := make(chan int)
+	go func() {
+		dropped := 0
+		for i := 0; i < 100; i++ {
+			if !p.Publish(AuditEvent{Action: Action{AppTag: "rdp.access"}}) {
+				dropped++
+			}
+		}
+		done <- dropped
+	}()
+	published := testutil.ToFloat64(auditDropped)
+	select {
+	case dropped := <-done:
+		assert.Greater(t, dropped, 0)
+		assert.Equal(t, published+float64(dropped), testutil.ToFloat64(auditDropped))
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish blocked on a slow sink")
+	}
+	close(sink.block)
+	p.Close()
+}
+
+func TestAuditPipelineEnrich(t *testing.T) {
+	sink := &fakeSink{}
+	p := NewAuditPipeline(settings.AuditSettings{}, sink)
+	p.Publish(AuditEvent{Action: Action{AppTag: "rdp.access", Enrich: func(a *Action) { a.PolicyID = "policy-1" }}})
+	p.Publish(AuditEvent{Action: Action{AppTag: "rdp.copy", Enrich: func(a *Action) { panic("no dao") }}})
+	p.Close()
+
+	assert.Len(t, sink.batches, 1)
+	assert.Equal(t, "policy-1", sink.batches[0][0].Action.PolicyID)
+	assert.Equal(t, "rdp.copy", sink.batches[0][1].Action.AppTag)
+}
+
+func TestLineSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFileSink(path, LineEncoder{})
+	assert.Nil(t, err)
+	at := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	assert.Nil(t, sink.Write([]AuditEvent{{Time: at, Action: Action{AppTag: "rdp.access", SchemaVersion: AuditSchemaVersion}}}))
+	assert.Nil(t, sink.Close())
+
+	data, _ := os.ReadFile(path)
+	assert.True(t, strings.HasPrefix(string(data), `2024-05-01T10:00:00.000Z {"app_tag":"rdp.access"`))
+	assert.Contains(t, string(data), `"schema_version":"1"`)
+}
+
+// failingEncoder can't encode the events of a tag
+type failingEncoder struct {
+	AuditEncoder
+	tag string
+}
+
+func (e failingEncoder) Encode(event AuditEvent) ([]byte, error) {
+	if event.Action.AppTag == e.tag {
+		return nil, errors.New("unencodable")
+	}
+	return e.AuditEncoder.Encode(event)
+}
+
+func TestSinkSkipsUnencodableEvents(t *testing.T) {
+	skipped := testutil.ToFloat64(auditSinkDropped.WithLabelValues("LineSink", "unencodable"))
+	buf := bytes.Buffer{}
+	sink := &LineSink{Writer: &buf, Encoder: failingEncoder{AuditEncoder: JSONEncoder{}, tag: "rdp.bad"}}
+	events := []AuditEvent{{Action: Action{AppTag: "rdp.a"}}, {Action: Action{AppTag: "rdp.bad"}}, {Action: Action{AppTag: "rdp.b"}}}
+
+	// the batch isn't retried for an event no retry would deliver
+	assert.Nil(t, sink.Write(events))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[1], `"app_tag":"rdp.b"`)
+	assert.Equal(t, skipped+1, testutil.ToFloat64(auditSinkDropped.WithLabelValues("LineSink", "unencodable")))
+}
+
+func TestWebhookSink(t *testing.T) {
+	var received [][]Action
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var actions []Action
+		_ = json.NewDecoder(r.Body).Decode(&actions)
+		received = append(received, actions)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sink := &WebhookSink{URL: server.URL, Client: server.Client(), Encoder: JSONEncoder{}}
+	events := []AuditEvent{{Action: Action{AppTag: "rdp.upload"}}, {Action: Action{AppTag: "rdp.download"}}}
+	assert.NotNil(t, sink.Write(events))
+	status = http.StatusOK
+	assert.Nil(t, sink.Write(events))
+	assert.Len(t, received, 2)
+	assert.Equal(t, "rdp.download", received[1][1].AppTag)
+}
+
+func TestSyslogSink(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	sink := NewSyslogSink("tcp", listener.Addr().String(), JSONEncoder{})
+	sink.Hostname = "guac 0"
+	at := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	written := make(chan error)
+	go func() {
+		written <- sink.Write([]AuditEvent{{Time: at, Action: Action{AppTag: "rdp.access"}}})
+	}()
+
+	conn, err := listener.Accept()
+	assert.Nil(t, err)
+	defer conn.Close()
+	frame, err := bufio.NewReader(conn).ReadString('}')
+	assert.Nil(t, err)
+	length, message, _ := strings.Cut(frame, " ")
+	assert.Equal(t, length, strings.TrimSpace(length))
+	assert.True(t, strings.HasPrefix(message, "<134>1 2024-05-01T10:00:00.000000Z guac0 appaegis_guac "), message)
+	assert.Contains(t, message, " rdp.access - {")
+	assert.Nil(t, <-written)
+	assert.Nil(t, sink.Close())
+}
+
+func TestLocalProducerPartitionsByKey(t *testing.T) {
+	dir := t.TempDir()
+	producer, err := NewLocalProducer(dir, 4)
+	assert.Nil(t, err)
+	sink := &KafkaSink{Producer: producer, Topic: "audit", Encoder: JSONEncoder{}}
+	events := []AuditEvent{
+		{Action: Action{AppTag: "rdp.a", TenantID: "tenant-1"}},
+		{Action: Action{AppTag: "rdp.b", TenantID: "tenant-2"}},
+		{Action: Action{AppTag: "rdp.c", TenantID: "tenant-1"}},
+	}
+	assert.Nil(t, sink.Write(events))
+	assert.Nil(t, sink.Close())
+
+	// a restarted producer continues the offsets
+	producer, _ = NewLocalProducer(dir, 4)
+	assert.Nil(t, (&KafkaSink{Producer: producer, Topic: "audit", Encoder: JSONEncoder{}}).Write(events[:1]))
+
+	tenant1 := map[string][]LocalRecord{}
+	files, _ := filepath.Glob(filepath.Join(dir, "audit-*.log"))
+	for _, file := range files {
+		data, _ := os.ReadFile(file)
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			record := LocalRecord{}
+			assert.Nil(t, json.Unmarshal([]byte(line), &record))
+			if record.Key == "tenant-1" {
+				tenant1[file] = append(tenant1[file], record)
+			}
+		}
+	}
+	assert.Len(t, tenant1, 1)
+	for _, records := range tenant1 {
+		assert.Len(t, records, 3)
+		assert.Greater(t, records[2].Offset, records[1].Offset)
+	}
+}
+
+func TestAuditPipelineEnrichConcurrently(t *testing.T) {
+	sink := &fakeSink{}
+	p := NewAuditPipeline(settings.AuditSettings{EnrichWorkers: 4}, sink)
+	// the enrichments wait for each other, they'd never finish one after another
+	var started sync.WaitGroup
+	started.Add(4)
+	for i := 0; i < 4; i++ {
+		id := strconv.Itoa(i)
+		p.Publish(AuditEvent{Action: Action{AppTag: "rdp.copy", Enrich: func(a *Action) {
+			started.Done()
+			started.Wait()
+			a.PolicyID = id
+		}}})
+	}
+	p.Close()
+
+	var ids []string
+	for _, batch := range sink.batches {
+		for _, event := range batch {
+			ids = append(ids, event.Action.PolicyID)
+		}
+	}
+	assert.Equal(t, []string{"0", "1", "2", "3"}, ids)
+}
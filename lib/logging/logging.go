@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/wwt/guac/lib/settings"
 	"github.com/wwt/guac/pkg/session"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -15,12 +17,15 @@ import (
 
 const (
 	LOG_FILE = "/var/log/appaegis/appaegis_guac.log"
+	// RecordingInfoSuffix is the suffix of the logging info kept next to a raw recording
+	RecordingInfoSuffix = ".info.json"
 )
 
 var (
-	reportFile      *os.File
 	logger          *log.Logger
+	audit           *AuditPipeline
 	recordingLogger *zap.Logger
+	journalLock     sync.Mutex
 )
 
 // Action is user action, the log object
@@ -51,21 +56,87 @@ type Action struct {
 
 	BlockPolicyType string `json:"blockPolicyType"`
 	BlockReason     string `json:"blockReason"`
+
+	// Reason explains actions taken by guac itself, such as deleting a recording
+	Reason string `json:"reason,omitempty"`
+
+	// Summary describes a finished session, it's set on the summary action only
+	Summary *SessionSummary `json:"summary,omitempty"`
+
+	SchemaVersion string `json:"schema_version"`
+
+	// Enrich completes the action off the path of the caller, e.g. with the policy
+	// which matched it. It's run once before the action is written.
+	Enrich func(*Action) `json:"-"`
 }
 
+// FillAttribute copies the session attributes, actions without a session keep their own
 func (a *Action) FillAttribute() {
+	if a.Session == nil {
+		return
+	}
 	a.TenantID = a.Session.TenantID
 	a.AppID = a.Session.AppID
 	a.AppName = a.Session.AppName
 	a.RdpSessionId = a.Session.RdpSessionId
-	a.MonitorPolicyId = a.Session.MonitorPolicyId
-	a.MonitorPolicyName = a.Session.MonitorPolicyName
+	monitor := a.Session.Monitor()
+	a.MonitorPolicyId = monitor.Id
+	a.MonitorPolicyName = monitor.Name
+}
+
+// SessionSummary is what happened in a session from its start to its end
+type SessionSummary struct {
+	Start           time.Time            `json:"start"`
+	End             time.Time            `json:"end"`
+	DurationSeconds int64                `json:"durationSeconds"`
+	Participants    []SessionParticipant `json:"participants"`
+	// BytesToClient and BytesFromClient are the guacd traffic of all participants
+	BytesToClient    int64          `json:"bytesToClient"`
+	BytesFromClient  int64          `json:"bytesFromClient"`
+	Uploads          int            `json:"uploads"`
+	Downloads        int            `json:"downloads"`
+	BlockedUploads   int            `json:"blockedUploads"`
+	BlockedDownloads int            `json:"blockedDownloads"`
+	FileTransfers    []FileTransfer `json:"fileTransfers"`
+	// RecordingS3Key names the recording in the storage of the tenant, where it is
+	// stored as <tenant>/<email>/<S3Key>.mp4 under the rdp prefix
+	RecordingS3Key string `json:"recordingS3Key,omitempty"`
+	// Traffic is relayed by the participants, by direction and opcode class
+	Traffic []TrafficCount `json:"traffic"`
+}
+
+// TrafficCount is the traffic of an opcode class, such as image or clipboard, in a direction
+type TrafficCount struct {
+	Direction    string `json:"direction"`
+	Class        string `json:"class"`
+	Bytes        int64  `json:"bytes"`
+	Instructions int64  `json:"instructions"`
+}
+
+// SessionParticipant is a user who was connected to a session
+type SessionParticipant struct {
+	UserEmail string    `json:"userEmail"`
+	Role      string    `json:"role"`
+	Joined    time.Time `json:"joined"`
+	Left      time.Time `json:"left"`
+	// LeftReason is why the participant left, such as a missed heartbeat
+	LeftReason string `json:"leftReason,omitempty"`
+}
+
+// FileTransfer is a file uploaded or downloaded in a session
+type FileTransfer struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	UserEmail string    `json:"userEmail"`
+	File      string    `json:"file"`
+	Blocked   bool      `json:"blocked"`
 }
 
 type LoggingInfo struct {
 	TenantId        string    `json:"tenantId"`
 	Email           string    `json:"email"`
 	AppName         string    `json:"appName"`
+	AppId           string    `json:"appId"`
 	ClientIp        string    `json:"clientIp"`
 	ClientPrivateIp string    `json:"clientPrivateIp"`
 	S3Key           string    `json:"s3key"`
@@ -73,12 +144,41 @@ type LoggingInfo struct {
 	StartTime       time.Time `json:"startTime"`
 	Sku             string    `json:"sku"`
 	SessionId       string    `json:"sessionid"`
+	// Lease is the lease of the guac process recording the session
+	Lease string `json:"lease,omitempty"`
 }
 
 func (l *LoggingInfo) GetRecordingFileName() string {
 	return fmt.Sprintf("%s-%s", l.Email, l.S3Key)
 }
 
+// JournalEntry is an action of a recorded session, kept next to the recording
+type JournalEntry struct {
+	Time time.Time `json:"time"`
+	Action
+}
+
+// GetJournalPath returns the file the actions of a recorded session are journaled to
+func GetJournalPath(recordingName string) string {
+	return fmt.Sprintf("/efs/rdp/%s.events", recordingName)
+}
+
+// GetRecordingInfoPath returns the file the logging info of a recording is kept in
+// until the recording is uploaded
+func GetRecordingInfoPath(recordingName string) string {
+	return fmt.Sprintf("/efs/rdp/%s%s", recordingName, RecordingInfoSuffix)
+}
+
+// SaveRecordingInfo keeps the logging info next to the recording, so a recording
+// left behind by a crash can still be attributed to its tenant and app
+func SaveRecordingInfo(info LoggingInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(GetRecordingInfoPath(info.GetRecordingFileName()), data, 0o744)
+}
+
 func NewLoggingInfo(tenantId, email, appName, clientIp, s3key, sku string, enableRecording bool, clientPrivateIp string) LoggingInfo {
 	return LoggingInfo{
 		TenantId:        tenantId,
@@ -97,13 +197,24 @@ func init() {
 	logger = log.Default() // default logger for unit test
 }
 
-// Init manually create report file
+// Init starts the audit pipeline to the sinks of the settings, the log file by default
 func Init() {
-	reportFile, err := os.OpenFile(LOG_FILE, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o755)
-	if err != nil {
-		logrus.Fatal(err)
+	cfg := settings.AuditSettings{}
+	if s := settings.Get().Audit; s != nil {
+		cfg = *s
+	}
+	if len(cfg.Sinks) == 0 {
+		cfg.Sinks = []settings.AuditSinkSettings{{Type: AuditSinkFile, Path: LOG_FILE}}
+	}
+	sinks := make([]AuditSink, 0, len(cfg.Sinks))
+	for _, sinkCfg := range cfg.Sinks {
+		sink, err := NewAuditSink(sinkCfg)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		sinks = append(sinks, sink)
 	}
-	logger = log.New(reportFile, "", 0)
+	audit = NewAuditPipeline(cfg, sinks...)
 
 	recordingLogger, _ = NewSessionRecordingLogger()
 }
@@ -120,9 +231,10 @@ func NewSessionRecordingLogger() (*zap.Logger, error) {
 	return cfg.Build()
 }
 
-func LogRecording(loggingInfo LoggingInfo, key string, bucket, keyId, storageType, region, sessionid string) {
-	recordingLogger.Info(
-		"rdp-session",
+// LogRecording logs an uploaded recording, extras are additional fields such as the keys of
+// files stored next to the recording
+func LogRecording(loggingInfo LoggingInfo, key string, bucket, keyId, storageType, region, sessionid string, extras ...zap.Field) {
+	fields := []zap.Field{
 		zap.Time("ts", loggingInfo.StartTime),
 		zap.String("tenant", loggingInfo.TenantId),
 		zap.String("username", loggingInfo.Email),
@@ -135,24 +247,64 @@ func LogRecording(loggingInfo LoggingInfo, key string, bucket, keyId, storageTyp
 		zap.String("key_id", keyId),
 		zap.String("storage_type", storageType),
 		zap.String("sessionid", sessionid),
-	)
+	}
+	recordingLogger.Info("rdp-session", append(fields, extras...)...)
 }
 
+// Log queues an action to the audit pipeline, before Init it's written right away
 func Log(action Action) {
 	action.AppType = "rdp"
 	action.ProductType = "Portal"
+	action.SchemaVersion = AuditSchemaVersion
+	// the session may change once the caller returns, so it's read now
 	action.FillAttribute()
-	data, err := json.Marshal(action)
+	event := AuditEvent{Time: time.Now(), Action: action}
+	if action.Session != nil {
+		event.recordingName = action.Session.RecordingName
+	}
+	if audit != nil {
+		if !audit.Publish(event) {
+			logrus.Errorf("audit event %s of %s dropped", action.AppTag, action.UserEmail)
+		}
+		return
+	}
+	event.enrich()
+	data, err := json.Marshal(event.Action)
 	if err != nil {
 		logrus.Errorf("unmarshall failed %s", err.Error())
 		return
 	}
-	now := time.Now().Format("2006-01-02T15:04:05.000Z")
-	logger.Printf("%s %s\n", now, string(data))
+	logger.Printf("%s\n", formatAuditLine(event.Time, data))
+	event.journal()
+}
+
+// formatAuditLine is the line of an action in the log file
+func formatAuditLine(t time.Time, data []byte) string {
+	return fmt.Sprintf("%s %s", t.UTC().Format("2006-01-02T15:04:05.000Z"), data)
+}
+
+func journal(recordingName string, entry JournalEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		logrus.Errorf("marshal journal entry failed %v", err)
+		return
+	}
+	journalLock.Lock()
+	defer journalLock.Unlock()
+	f, err := os.OpenFile(GetJournalPath(recordingName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o744)
+	if err != nil {
+		logrus.Errorf("open journal of %s failed %v", recordingName, err)
+		return
+	}
+	defer f.Close()
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		logrus.Errorf("write journal of %s failed %v", recordingName, err)
+	}
 }
 
+// Close delivers the queued audit events
 func Close() {
-	if reportFile != nil {
-		reportFile.Close()
+	if audit != nil {
+		audit.Close()
 	}
 }
@@ -0,0 +1,522 @@
+package settings
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultSettingsFile = "/home/appaegis/guac-assets/settings.json"
+
+// StorageDeletes returns if the storage of a tenant can delete recordings, it's set by
+// the package uploading the recordings
+var StorageDeletes = func(tenantID string) bool { return false }
+
+// Settings is the guac runtime configuration. Per session features are
+// configured in scopes: the default scope applies to everyone, a tenant
+// scope overrides it and an app scope inside a tenant overrides both.
+// Each section of a scope is resolved on its own, the most specific scope
+// that sets a section wins.
+type Settings struct {
+	Default Scope                   `json:"default"`
+	Tenants map[string]*TenantScope `json:"tenants"`
+	// Audit configures the delivery of the audit events for the whole process
+	Audit *AuditSettings `json:"audit,omitempty"`
+	// Origins are allowed for the whole process, the tenant of an upgrade isn't authenticated
+	Origins *OriginSettings `json:"origins,omitempty"`
+}
+
+// TenantScope is the configuration of one tenant and its apps
+type TenantScope struct {
+	Scope
+	Apps map[string]*Scope `json:"apps"`
+}
+
+// Scope holds the configurable sections, nil sections are inherited
+type Scope struct {
+	Keylog   *KeylogSettings   `json:"keylog,omitempty"`
+	Timeline *TimelineSettings `json:"timeline,omitempty"`
+	// Encryption is usually set per tenant
+	Encryption *EncryptionSettings `json:"encryption,omitempty"`
+	Retention  *RetentionSettings  `json:"retention,omitempty"`
+	Clipboard  *ClipboardSettings  `json:"clipboard,omitempty"`
+	// FileTransfer rules apply to the file streams relayed by guac
+	FileTransfer *FileTransferSettings `json:"fileTransfer,omitempty"`
+	UploadScan   *UploadScanSettings   `json:"uploadScan,omitempty"`
+	Watermark    *WatermarkSettings    `json:"watermark,omitempty"`
+	Masks        *MaskSettings         `json:"masks,omitempty"`
+	Limits       *SessionLimitSettings `json:"limits,omitempty"`
+	Latency      *LatencySettings      `json:"latency,omitempty"`
+	FanOut       *FanOutSettings       `json:"fanOut,omitempty"`
+	Websocket    *WebsocketSettings    `json:"websocket,omitempty"`
+}
+
+// KeylogSettings configures the keystroke transcript built from recordings
+type KeylogSettings struct {
+	// Enabled is opt in, transcripts include typed passwords unless redacted
+	Enabled bool               `json:"enabled"`
+	Redact  []KeylogRedactRule `json:"redact"`
+}
+
+// KeylogRedactRule hides transcript lines, Pattern is a regular expression
+// matched against the typed text of each line.
+type KeylogRedactRule struct {
+	Pattern string `json:"pattern"`
+	// Next redacts the line following a matching line instead of the
+	// match itself, e.g. the password typed after the user name
+	Next bool `json:"next"`
+}
+
+// TimelineSettings configures the thumbnails and activity timeline built from recordings
+type TimelineSettings struct {
+	Enabled bool `json:"enabled"`
+	// ThumbnailInterval is the number of seconds between thumbnails
+	ThumbnailInterval int `json:"thumbnailInterval"`
+	ThumbnailWidth    int `json:"thumbnailWidth"`
+	// Columns is the number of thumbnails in a row of the sprite sheet
+	Columns int `json:"columns"`
+	// IdleThreshold is the number of seconds without input which makes an idle period
+	IdleThreshold int `json:"idleThreshold"`
+}
+
+// EncryptionSettings configures client side encryption of recordings before upload
+type EncryptionSettings struct {
+	Enabled bool `json:"enabled"`
+	// Provider is the name of the key provider issuing the tenant data keys
+	Provider string `json:"provider"`
+	// KeyDir holds the tenant keys of the file key provider
+	KeyDir string `json:"keyDir"`
+}
+
+// RetentionSettings configures how long recordings are kept, durations are hours
+type RetentionSettings struct {
+	// RawTTL is how long a raw recording which was never uploaded stays on EFS,
+	// uploaded recordings are removed from EFS right after the upload
+	RawTTL int `json:"rawTTL"`
+	// StorageTTL is how long uploaded recordings are kept in storage, 0 keeps them
+	// forever. It's set per tenant, for tenants whose storage can delete recordings.
+	StorageTTL int `json:"storageTTL"`
+	// LegalHold blocks the deletion of all recordings of the scope
+	LegalHold bool `json:"legalHold"`
+	// LegalHoldUsers blocks the deletion of the recordings of these users
+	LegalHoldUsers []string `json:"legalHoldUsers"`
+}
+
+// Held returns true if the recordings of the user must not be deleted
+func (r RetentionSettings) Held(email string) bool {
+	if r.LegalHold {
+		return true
+	}
+	for _, u := range r.LegalHoldUsers {
+		if strings.EqualFold(u, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClipboardSettings configures the inspection and limits of clipboard transfers
+type ClipboardSettings struct {
+	// Enabled turns on the inspection of the transfers, the limits always apply
+	Enabled bool `json:"enabled"`
+	// Inspector is the name of the content inspector, the default inspector applies Rules
+	Inspector string          `json:"inspector"`
+	Rules     []ClipboardRule `json:"rules"`
+	// Copy limits the transfers out of the remote desktop and Paste the transfers into it
+	Copy  ClipboardLimits `json:"copy"`
+	Paste ClipboardLimits `json:"paste"`
+}
+
+// ClipboardLimits limits the clipboard transfers of a user in one direction, 0 is unlimited
+type ClipboardLimits struct {
+	// MaxBytes is the largest transfer
+	MaxBytes int `json:"maxBytes"`
+	// TransfersPerMinute and BytesPerMinute limit the rate of transfers
+	TransfersPerMinute int `json:"transfersPerMinute"`
+	BytesPerMinute     int `json:"bytesPerMinute"`
+}
+
+// ClipboardRule matches clipboard text by a regular expression or by keywords
+type ClipboardRule struct {
+	Name     string   `json:"name"`
+	Pattern  string   `json:"pattern"`
+	Keywords []string `json:"keywords"`
+	// Action is "block" or "redact"
+	Action string `json:"action"`
+	// Direction is "copy" out of or "paste" into the remote desktop, empty for both
+	Direction string `json:"direction"`
+}
+
+// FileTransferSettings configures the rules blocking file transfers
+type FileTransferSettings struct {
+	Rules []FileTransferRule `json:"rules"`
+}
+
+// FileTransferRule blocks the files whose name matches Pattern or whose
+// mimetype is one of Mimetypes
+type FileTransferRule struct {
+	Name      string   `json:"name"`
+	Pattern   string   `json:"pattern"`
+	Mimetypes []string `json:"mimetypes"`
+	// Direction is "upload" or "download", empty for both
+	Direction string `json:"direction"`
+}
+
+// UploadScanSettings configures the scan of uploads, enabled uploads are spooled
+// to the quarantine dir and only released to the drive when the scanner finds
+// them clean.
+type UploadScanSettings struct {
+	Enabled bool `json:"enabled"`
+	// Scanner is "clamd" or "stub"
+	Scanner string `json:"scanner"`
+	// Network and Address of the clamd socket, e.g. "unix" and "/var/run/clamav/clamd.ctl"
+	Network string `json:"network"`
+	Address string `json:"address"`
+	// Timeout is the number of seconds a scan may take
+	Timeout       int    `json:"timeout"`
+	QuarantineDir string `json:"quarantineDir"`
+	// MaxBytes is the largest upload spooled, 0 is unlimited
+	MaxBytes int64 `json:"maxBytes"`
+}
+
+// WatermarkSettings configures the watermark shown on sessions and burned into their recordings
+type WatermarkSettings struct {
+	Enabled bool `json:"enabled"`
+	// Format is the text of the watermark, {email}, {ip} and {time} are replaced
+	// by the user, client ip and start of the session
+	Format string `json:"format"`
+	// Opacity is between 0 and 1
+	Opacity  float64 `json:"opacity"`
+	FontSize int     `json:"fontSize"`
+}
+
+// MaskSettings are the screen regions hidden from the participants of a session other than the host
+type MaskSettings struct {
+	Regions []MaskRegion `json:"regions"`
+}
+
+// MaskRegion is a rectangle of the remote display in pixels
+type MaskRegion struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// SessionLimitSettings configures how long a session may last, a zero limit is disabled
+type SessionLimitSettings struct {
+	// IdleTimeout is the number of minutes without key or mouse input of any participant
+	IdleTimeout int `json:"idleTimeout"`
+	// MaxDuration is the number of minutes from the start of the session
+	MaxDuration int `json:"maxDuration"`
+	// Warning is the number of seconds before a limit the participants are warned
+	Warning int `json:"warning"`
+}
+
+// LatencySettings configures when a participant is flagged as slow, from the syncs
+// the client echoes. Durations are milliseconds.
+type LatencySettings struct {
+	// SlowRoundTrip is the round trip of a sync above which it's slow
+	SlowRoundTrip int `json:"slowRoundTrip"`
+	// SlowLag is how far the client may be behind the frames sent to it
+	SlowLag int `json:"slowLag"`
+	// SlowSamples is the number of consecutive slow syncs which flag the participant,
+	// as many fast ones clear the flag
+	SlowSamples int `json:"slowSamples"`
+}
+
+// FanOutSettings configures relaying the guacd connection of the host to the viewers
+// of a shared session, in place of a guacd connection per viewer
+type FanOutSettings struct {
+	Enabled bool `json:"enabled"`
+	// QueueSize is the instructions queued for a viewer, a viewer falling further behind is disconnected
+	QueueSize int `json:"queueSize"`
+	// KeyframeTimeout is the milliseconds a joining viewer waits for the display from guacd
+	KeyframeTimeout int `json:"keyframeTimeout"`
+}
+
+// WebsocketSettings configures the writes to the websockets of the participants
+type WebsocketSettings struct {
+	// QueueSize is the messages of display queued to a websocket
+	QueueSize int `json:"queueSize"`
+	// WriteTimeout is the milliseconds a write may take before the websocket is disconnected
+	WriteTimeout int `json:"writeTimeout"`
+	// Overflow is what happens once the display queue is full, "disconnect" the
+	// participant or "block" until the queue has room for up to WriteTimeout
+	Overflow string `json:"overflow"`
+	// PingInterval is the milliseconds between pings, a negative interval disables them
+	PingInterval int `json:"pingInterval"`
+	// PongTimeout is the milliseconds a pong may be late before the participant is disconnected
+	PongTimeout int `json:"pongTimeout"`
+	// MaxMessageSize is the largest message read from a participant, 0 is the read buffer size
+	MaxMessageSize int `json:"maxMessageSize"`
+}
+
+// OriginSettings are the origins of the pages allowed to open the websockets of the
+// sessions, the origin of the websocket itself is always allowed
+type OriginSettings struct {
+	// Allowed are hosts such as app.example.com, or *.example.com for its subdomains,
+	// optionally with a scheme as in https://app.example.com
+	Allowed []string `json:"allowed"`
+	// Portal allows the portal, and the portals of the IdP domains of the tenants
+	Portal bool `json:"portal"`
+}
+
+// AuditSettings configures the audit pipeline, without sinks the events go to the log file
+type AuditSettings struct {
+	// BufferSize is the number of events queued for a sink, more are dropped
+	BufferSize int `json:"bufferSize"`
+	// BatchSize is the most events written to a sink at once
+	BatchSize int `json:"batchSize"`
+	// FlushInterval is the number of milliseconds a partial batch waits
+	FlushInterval int `json:"flushInterval"`
+	// EnrichWorkers is the number of events enriched at once, e.g. querying their policy
+	EnrichWorkers int                 `json:"enrichWorkers"`
+	Sinks         []AuditSinkSettings `json:"sinks"`
+}
+
+// AuditSinkSettings configures a sink of the audit events
+type AuditSinkSettings struct {
+	// Type is "file", "stdout", "webhook", "syslog" or "kafka"
+	Type string `json:"type"`
+	// Format is "line", the default of file and stdout, "json", the default of the
+	// others, "cef" or "ocsf"
+	Format string `json:"format"`
+	// Path is the file of a file sink and the dir of the local topics of a kafka sink
+	Path string `json:"path"`
+	URL  string `json:"url"`
+	// Network and Address of a syslog sink, e.g. "udp" and "localhost:514"
+	Network    string `json:"network"`
+	Address    string `json:"address"`
+	Topic      string `json:"topic"`
+	Partitions int    `json:"partitions"`
+}
+
+var current atomic.Pointer[Settings]
+
+func init() {
+	current.Store(Defaults())
+}
+
+// Defaults returns the settings used when no settings file is deployed
+func Defaults() *Settings {
+	return &Settings{
+		Default: Scope{
+			Keylog: &KeylogSettings{},
+			Timeline: &TimelineSettings{
+				Enabled:           true,
+				ThumbnailInterval: 10,
+				ThumbnailWidth:    160,
+				Columns:           10,
+				IdleThreshold:     60,
+			},
+			Retention: &RetentionSettings{RawTTL: 7 * 24},
+			Watermark: &WatermarkSettings{
+				Format:   "{email} {ip} {time}",
+				Opacity:  0.3,
+				FontSize: 24,
+			},
+			UploadScan: &UploadScanSettings{
+				Scanner:       "clamd",
+				Network:       "unix",
+				Address:       "/var/run/clamav/clamd.ctl",
+				Timeout:       60,
+				QuarantineDir: "/efs/rdp/quarantine",
+			},
+			Latency: &LatencySettings{
+				SlowRoundTrip: 500,
+				SlowLag:       1000,
+				SlowSamples:   30,
+			},
+			FanOut: &FanOutSettings{
+				QueueSize:       8192,
+				KeyframeTimeout: 2000,
+			},
+			Websocket: &WebsocketSettings{
+				QueueSize:    256,
+				WriteTimeout: 10000,
+				Overflow:     "disconnect",
+				PingInterval: 30000,
+				PongTimeout:  15000,
+			},
+		},
+		Origins: &OriginSettings{
+			Portal: true,
+		},
+	}
+}
+
+// Init loads the settings file, the path can be overridden by GUAC_SETTINGS
+func Init() {
+	path := defaultSettingsFile
+	if os.Getenv("GUAC_SETTINGS") != "" {
+		path = os.Getenv("GUAC_SETTINGS")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Infof("settings file %s not loaded, use defaults: %v", path, err)
+		return
+	}
+	s := Defaults()
+	if err = json.Unmarshal(data, s); err != nil {
+		log.Errorf("failed to parse settings file %s: %v", path, err)
+		return
+	}
+	restrictStorageTTL(s)
+	Set(s)
+	log.Infof("success to load settings: %s", path)
+}
+
+// restrictStorageTTL disables the storage retention the recordings couldn't be deleted
+// for, which is any set by the default scope or for a tenant whose storage can't delete
+func restrictStorageTTL(s *Settings) {
+	disable := func(scope *Scope, reason string) {
+		if scope != nil && scope.Retention != nil && scope.Retention.StorageTTL > 0 {
+			log.Errorf("storage retention disabled, %s", reason)
+			scope.Retention.StorageTTL = 0
+		}
+	}
+	disable(&s.Default, "it is set per tenant")
+	for tenantID, tenant := range s.Tenants {
+		if tenant == nil || StorageDeletes(tenantID) {
+			continue
+		}
+		reason := "the storage of tenant " + tenantID + " can't delete recordings"
+		disable(&tenant.Scope, reason)
+		for _, app := range tenant.Apps {
+			disable(app, reason)
+		}
+	}
+}
+
+// Get returns the active settings
+func Get() *Settings {
+	return current.Load()
+}
+
+// Set replaces the active settings
+func Set(s *Settings) {
+	current.Store(s)
+}
+
+// Keylog returns the keystroke transcript settings of an app
+func Keylog(tenantID, appID string) KeylogSettings {
+	return resolve(tenantID, appID, func(s *Scope) *KeylogSettings { return s.Keylog })
+}
+
+// Timeline returns the recording timeline settings of an app
+func Timeline(tenantID, appID string) TimelineSettings {
+	return resolve(tenantID, appID, func(s *Scope) *TimelineSettings { return s.Timeline })
+}
+
+// Encryption returns the recording encryption settings of an app
+func Encryption(tenantID, appID string) EncryptionSettings {
+	return resolve(tenantID, appID, func(s *Scope) *EncryptionSettings { return s.Encryption })
+}
+
+// Retention returns the recording retention settings of an app
+func Retention(tenantID, appID string) RetentionSettings {
+	return resolve(tenantID, appID, func(s *Scope) *RetentionSettings { return s.Retention })
+}
+
+// Clipboard returns the clipboard inspection settings of an app
+func Clipboard(tenantID, appID string) ClipboardSettings {
+	return resolve(tenantID, appID, func(s *Scope) *ClipboardSettings { return s.Clipboard })
+}
+
+// FileTransfer returns the file transfer rules of an app
+func FileTransfer(tenantID, appID string) FileTransferSettings {
+	return resolve(tenantID, appID, func(s *Scope) *FileTransferSettings { return s.FileTransfer })
+}
+
+// UploadScan returns the upload scan settings of an app
+func UploadScan(tenantID, appID string) UploadScanSettings {
+	return resolve(tenantID, appID, func(s *Scope) *UploadScanSettings { return s.UploadScan })
+}
+
+// Watermark returns the watermark settings of an app
+func Watermark(tenantID, appID string) WatermarkSettings {
+	return resolve(tenantID, appID, func(s *Scope) *WatermarkSettings { return s.Watermark })
+}
+
+// Masks returns the screen masks of an app
+func Masks(tenantID, appID string) MaskSettings {
+	return resolve(tenantID, appID, func(s *Scope) *MaskSettings { return s.Masks })
+}
+
+// Limits returns the session limits of an app
+func Limits(tenantID, appID string) SessionLimitSettings {
+	return resolve(tenantID, appID, func(s *Scope) *SessionLimitSettings { return s.Limits })
+}
+
+// Latency returns the thresholds of slow sessions of an app
+func Latency(tenantID, appID string) LatencySettings {
+	return resolve(tenantID, appID, func(s *Scope) *LatencySettings { return s.Latency })
+}
+
+// FanOut returns if and how the viewers of shared sessions of an app share the guacd connection of the host
+func FanOut(tenantID, appID string) FanOutSettings {
+	cfg := resolve(tenantID, appID, func(s *Scope) *FanOutSettings { return s.FanOut })
+	// the fields a scope leaves unset are the defaults
+	def := Defaults().Default.FanOut
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = def.QueueSize
+	}
+	if cfg.KeyframeTimeout <= 0 {
+		cfg.KeyframeTimeout = def.KeyframeTimeout
+	}
+	return cfg
+}
+
+// Websocket returns how the websockets of the participants of an app are written to
+func Websocket(tenantID, appID string) WebsocketSettings {
+	cfg := resolve(tenantID, appID, func(s *Scope) *WebsocketSettings { return s.Websocket })
+	// the fields a scope leaves unset are the defaults
+	def := Defaults().Default.Websocket
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = def.QueueSize
+	}
+	if cfg.WriteTimeout <= 0 {
+		cfg.WriteTimeout = def.WriteTimeout
+	}
+	if cfg.Overflow == "" {
+		cfg.Overflow = def.Overflow
+	}
+	if cfg.PingInterval == 0 {
+		cfg.PingInterval = def.PingInterval
+	}
+	if cfg.PongTimeout <= 0 {
+		cfg.PongTimeout = def.PongTimeout
+	}
+	return cfg
+}
+
+// Origins returns the origins allowed to open the websockets of the sessions
+func Origins() OriginSettings {
+	if s := Get().Origins; s != nil {
+		return *s
+	}
+	return *Defaults().Origins
+}
+
+func resolve[T any](tenantID, appID string, pick func(*Scope) *T) T {
+	s := Get()
+	if tenant, ok := s.Tenants[tenantID]; ok && tenant != nil {
+		if app, ok := tenant.Apps[appID]; ok && app != nil {
+			if v := pick(app); v != nil {
+				return *v
+			}
+		}
+		if v := pick(&tenant.Scope); v != nil {
+			return *v
+		}
+	}
+	if v := pick(&s.Default); v != nil {
+		return *v
+	}
+	var zero T
+	return zero
+}
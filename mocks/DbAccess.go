@@ -64,6 +64,66 @@ func (_m *DbAccess) GetTenantById(tenantId string) schema.TenantEntry {
 	return r0
 }
 
+// QueryMonitorPolicyEntryById provides a mock function with given fields: monitorPolicyId
+func (_m *DbAccess) QueryMonitorPolicyEntryById(monitorPolicyId string) schema.MonitorPolicyEntry {
+	ret := _m.Called(monitorPolicyId)
+
+	var r0 schema.MonitorPolicyEntry
+	if rf, ok := ret.Get(0).(func(string) schema.MonitorPolicyEntry); ok {
+		r0 = rf(monitorPolicyId)
+	} else {
+		r0 = ret.Get(0).(schema.MonitorPolicyEntry)
+	}
+
+	return r0
+}
+
+// QueryMonitorRuleForUser provides a mock function with given fields: monitorPolicyId, userId
+func (_m *DbAccess) QueryMonitorRuleForUser(monitorPolicyId string, userId string) map[string]*schema.MonitorPolicyRule {
+	ret := _m.Called(monitorPolicyId, userId)
+
+	var r0 map[string]*schema.MonitorPolicyRule
+	if rf, ok := ret.Get(0).(func(string, string) map[string]*schema.MonitorPolicyRule); ok {
+		r0 = rf(monitorPolicyId, userId)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(map[string]*schema.MonitorPolicyRule)
+		}
+	}
+
+	return r0
+}
+
+// QueryPolicyByAstraea provides a mock function with given fields: appId, userId
+func (_m *DbAccess) QueryPolicyByAstraea(appId string, userId string) schema.PolicyEntry {
+	ret := _m.Called(appId, userId)
+
+	var r0 schema.PolicyEntry
+	if rf, ok := ret.Get(0).(func(string, string) schema.PolicyEntry); ok {
+		r0 = rf(appId, userId)
+	} else {
+		r0 = ret.Get(0).(schema.PolicyEntry)
+	}
+
+	return r0
+}
+
+// QueryResource provides a mock function with given fields: appId
+func (_m *DbAccess) QueryResource(appId string) *schema.Resource {
+	ret := _m.Called(appId)
+
+	var r0 *schema.Resource
+	if rf, ok := ret.Get(0).(func(string) *schema.Resource); ok {
+		r0 = rf(appId)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*schema.Resource)
+		}
+	}
+
+	return r0
+}
+
 // QueryUsersByTenantAndUserPrefix provides a mock function with given fields: tenantId, userPrefix
 func (_m *DbAccess) QueryUsersByTenantAndUserPrefix(tenantId string, userPrefix string) ([]schema.UserEntry, error) {
 	ret := _m.Called(tenantId, userPrefix)
@@ -6,50 +6,143 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// maxPendingEvents bounds the events a subscription keeps until they are drained
+const maxPendingEvents = 64
+
+// TopicScope is the kind of object a topic is about
+type TopicScope string
+
+const (
+	ScopeApp  TopicScope = "app"
+	ScopeUser TopicScope = "user"
+)
+
+// Topic is what subscribers subscribe to and events are published to
+type Topic struct {
+	Scope TopicScope
+	ID    string
+}
+
+func AppTopic(id string) Topic  { return Topic{Scope: ScopeApp, ID: id} }
+func UserTopic(id string) Topic { return Topic{Scope: ScopeUser, ID: id} }
+
+// ChannelEvent is an event published to a topic
+type ChannelEvent struct {
+	Type  PolicyEventType
+	Topic Topic
+}
+
+// ChannelManagement is the hub delivering the policy events to the sessions.
+// Publishing never blocks: the events are queued in the subscription, where
+// repeated events are coalesced, and the subscriber is signaled to drain them.
 type ChannelManagement struct {
-	ChannelList map[string]map[string]chan int
-	mu          sync.Mutex
+	mu     sync.RWMutex
+	topics map[Topic]map[*Subscription]struct{}
 }
 
 func NewChannelManagement() *ChannelManagement {
 	return &ChannelManagement{
-		ChannelList: map[string]map[string]chan int{},
+		topics: map[Topic]map[*Subscription]struct{}{},
 	}
 }
 
-func (c *ChannelManagement) Add(key string, ID string, ch chan int) error {
+// Subscription receives the events of its topics until it's unsubscribed
+type Subscription struct {
+	hub    *ChannelManagement
+	topics []Topic
+	signal chan struct{}
+
+	mu       sync.Mutex
+	pending  []ChannelEvent
+	overflow bool
+	closed   bool
+}
+
+// Subscribe returns a subscription of the events of the topics
+func (c *ChannelManagement) Subscribe(topics ...Topic) *Subscription {
+	s := &Subscription{hub: c, topics: topics, signal: make(chan struct{}, 1)}
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if _, ok := c.ChannelList[key]; !ok {
-		c.ChannelList[key] = map[string]chan int{}
+	for _, topic := range topics {
+		if _, ok := c.topics[topic]; !ok {
+			c.topics[topic] = map[*Subscription]struct{}{}
+		}
+		c.topics[topic][s] = struct{}{}
 	}
-	c.ChannelList[key][ID] = ch
-	return nil
+	return s
 }
 
-func (c *ChannelManagement) Remove(appID string, userID string, ID string) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	logrus.Info("Remove channel")
-	if appList, ok := c.ChannelList[appID]; ok {
-		if appCH, ok := appList[ID]; ok {
-			close(appCH)
-			delete(appList, ID)
+// Publish delivers an event to the subscribers of the topic without waiting for them
+func (c *ChannelManagement) Publish(topic Topic, eventType PolicyEventType) {
+	c.mu.RLock()
+	subscriptions := make([]*Subscription, 0, len(c.topics[topic]))
+	for s := range c.topics[topic] {
+		subscriptions = append(subscriptions, s)
+	}
+	c.mu.RUnlock()
+
+	event := ChannelEvent{Type: eventType, Topic: topic}
+	for _, s := range subscriptions {
+		s.deliver(event)
+	}
+}
+
+func (s *Subscription) deliver(event ChannelEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	for _, e := range s.pending {
+		if e == event {
+			return
 		}
 	}
-	if userList, ok := c.ChannelList[userID]; ok {
-		delete(userList, ID)
+	if len(s.pending) < maxPendingEvents {
+		s.pending = append(s.pending, event)
+	} else if !s.overflow {
+		logrus.Errorf("subscription of %v is too slow, events are dropped", s.topics)
+		s.overflow = true
+	}
+	select {
+	case s.signal <- struct{}{}:
+	default:
+		// the subscriber is already signaled
 	}
-	return nil
 }
 
-func (c *ChannelManagement) BroadCast(key string, op int) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if list, ok := c.ChannelList[key]; ok {
-		for _, ch := range list {
-			ch <- op
+// C is signaled when there are events to drain, it's closed by Unsubscribe
+func (s *Subscription) C() <-chan struct{} {
+	return s.signal
+}
+
+// Drain returns the pending events. Overflowed is true if events were dropped since
+// the last drain, the subscriber should then assume anything changed.
+func (s *Subscription) Drain() (events []ChannelEvent, overflowed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events, overflowed = s.pending, s.overflow
+	s.pending, s.overflow = nil, false
+	return events, overflowed
+}
+
+// Unsubscribe stops the delivery of events, it may be called more than once
+func (s *Subscription) Unsubscribe() {
+	s.hub.mu.Lock()
+	for _, topic := range s.topics {
+		if subscriptions, ok := s.hub.topics[topic]; ok {
+			delete(subscriptions, s)
+			if len(subscriptions) == 0 {
+				delete(s.hub.topics, topic)
+			}
 		}
 	}
-	return nil
+	s.hub.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.signal)
+	}
 }
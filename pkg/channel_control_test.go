@@ -0,0 +1,54 @@
+package guac
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChannelManagement(t *testing.T) {
+	hub := NewChannelManagement()
+	host := hub.Subscribe(AppTopic("a1"), UserTopic("u1"))
+	viewer := hub.Subscribe(AppTopic("a1"), UserTopic("u2"))
+
+	// publishing doesn't wait for the subscribers, repeated events are coalesced
+	for i := 0; i < 3; i++ {
+		hub.Publish(AppTopic("a1"), PolicyEventPolicy)
+	}
+	hub.Publish(UserTopic("u1"), PolicyEventUser)
+	hub.Publish(UserTopic("u3"), PolicyEventPolicy)
+
+	<-host.C()
+	events, overflowed := host.Drain()
+	assert.False(t, overflowed)
+	assert.Equal(t, []ChannelEvent{
+		{Type: PolicyEventPolicy, Topic: AppTopic("a1")},
+		{Type: PolicyEventUser, Topic: UserTopic("u1")},
+	}, events)
+	events, _ = host.Drain()
+	assert.Empty(t, events)
+
+	<-viewer.C()
+	events, _ = viewer.Drain()
+	assert.Equal(t, []ChannelEvent{{Type: PolicyEventPolicy, Topic: AppTopic("a1")}}, events)
+
+	// the pending events are bounded
+	for i := 0; i <= maxPendingEvents; i++ {
+		hub.Publish(UserTopic("u2"), PolicyEventType(string(rune('a'+i%26))+string(rune('a'+i/26))))
+	}
+	events, overflowed = viewer.Drain()
+	assert.Equal(t, maxPendingEvents, len(events))
+	assert.True(t, overflowed)
+
+	// unsubscribing closes the channel, later events are ignored
+	viewer.Unsubscribe()
+	viewer.Unsubscribe()
+	hub.Publish(AppTopic("a1"), PolicyEventApp)
+	for range viewer.C() {
+		// a signal still buffered is received before the close
+	}
+	events, _ = viewer.Drain()
+	assert.Empty(t, events)
+	assert.Equal(t, 1, len(hub.topics[AppTopic("a1")]))
+	assert.NotContains(t, hub.topics, UserTopic("u2"))
+}
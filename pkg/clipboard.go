@@ -0,0 +1,393 @@
+package guac
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/appaegis/golang-common/pkg/constants"
+	"github.com/sirupsen/logrus"
+	"github.com/wwt/guac/lib/settings"
+	"github.com/wwt/guac/pkg/session"
+)
+
+const (
+	ClipboardCopy  = "copy"
+	ClipboardPaste = "paste"
+
+	clipboardRedacted = "[REDACTED]"
+	// clipboardMaxHold caps the transfers held for inspection
+	clipboardMaxHold = 16 * 1024 * 1024
+	// clipboardBlobSize is the size of the decoded data of a rewritten blob
+	clipboardBlobSize = 4096
+
+	// guacamole status codes of blocked streams
+	guacStatusForbidden = "771" // CLIENT_FORBIDDEN
+	guacStatusOverrun   = "781" // CLIENT_OVERRUN
+	guacStatusTooMany   = "783" // CLIENT_TOO_MANY
+)
+
+var (
+	clipboardOpcodeIns = []byte("9.clipboard,")
+	blobOpcodeIns      = []byte("4.blob,")
+	endOpcodeIns       = []byte("3.end,")
+)
+
+// ClipboardVerdict is the outcome of a clipboard inspection
+type ClipboardVerdict string
+
+const (
+	ClipboardAllow  ClipboardVerdict = "allow"
+	ClipboardRedact ClipboardVerdict = "redact"
+	ClipboardBlock  ClipboardVerdict = "block"
+)
+
+// InspectionResult is the verdict on a clipboard transfer, Content replaces the
+// transfer when it's redacted and Reason names the rule which matched.
+type InspectionResult struct {
+	Verdict ClipboardVerdict
+	Content string
+	Reason  string
+}
+
+// ContentInspector decides if clipboard text may be transferred
+type ContentInspector interface {
+	Inspect(direction, content string) InspectionResult
+}
+
+var contentInspectors = map[string]func(settings.ClipboardSettings) (ContentInspector, error){
+	"": func(cfg settings.ClipboardSettings) (ContentInspector, error) {
+		return NewRuleInspector(cfg.Rules)
+	},
+}
+
+// RegisterContentInspector makes a content inspector available to the clipboard settings
+func RegisterContentInspector(name string, factory func(settings.ClipboardSettings) (ContentInspector, error)) {
+	contentInspectors[name] = factory
+}
+
+// GetContentInspector returns the content inspector configured by the clipboard settings
+func GetContentInspector(cfg settings.ClipboardSettings) (ContentInspector, error) {
+	factory, ok := contentInspectors[cfg.Inspector]
+	if !ok {
+		return nil, fmt.Errorf("unknown content inspector %s", cfg.Inspector)
+	}
+	return factory(cfg)
+}
+
+type clipboardRule struct {
+	settings.ClipboardRule
+	pattern *regexp.Regexp
+}
+
+// RuleInspector applies the regular expression and keyword rules of the clipboard settings,
+// a blocking rule wins over redacting rules.
+type RuleInspector struct {
+	rules []clipboardRule
+}
+
+// NewRuleInspector compiles the rules, keywords match case insensitive
+func NewRuleInspector(rules []settings.ClipboardRule) (*RuleInspector, error) {
+	inspector := &RuleInspector{}
+	for _, rule := range rules {
+		var parts []string
+		if rule.Pattern != "" {
+			parts = append(parts, rule.Pattern)
+		}
+		for _, keyword := range rule.Keywords {
+			parts = append(parts, "(?i)"+regexp.QuoteMeta(keyword))
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		pattern, err := regexp.Compile(strings.Join(parts, "|"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid clipboard rule %s: %v", rule.Name, err)
+		}
+		inspector.rules = append(inspector.rules, clipboardRule{ClipboardRule: rule, pattern: pattern})
+	}
+	return inspector, nil
+}
+
+// Inspect implements ContentInspector
+func (i *RuleInspector) Inspect(direction, content string) InspectionResult {
+	result := InspectionResult{Verdict: ClipboardAllow, Content: content}
+	var redacted []string
+	for _, rule := range i.rules {
+		if rule.Direction != "" && rule.Direction != direction {
+			continue
+		}
+		if !rule.pattern.MatchString(result.Content) {
+			continue
+		}
+		if rule.Action == "redact" {
+			result.Verdict = ClipboardRedact
+			result.Content = rule.pattern.ReplaceAllLiteralString(result.Content, clipboardRedacted)
+			redacted = append(redacted, rule.Name)
+			continue
+		}
+		return InspectionResult{Verdict: ClipboardBlock, Reason: rule.Name}
+	}
+	result.Reason = strings.Join(redacted, ",")
+	return result
+}
+
+// clipboardFilter enforces the clipboard limits on the clipboard streams of one
+// direction. It holds the instructions of a stream until the transfer is complete,
+// so a transfer exceeding a limit is dropped as a whole, and with inspection enabled
+// replaces them with the inspected transfer.
+type clipboardFilter struct {
+	direction string
+	ses       *session.SessionCommonData
+	user      string
+	// notify sends the verdict instructions to the client
+	notify func(*Instruction)
+	// ack sends the error status of a blocked stream to its sender, the client for pastes
+	ack func(*Instruction)
+	// allowed returns if the policy grants the transfers, nil allows them
+	allowed func() bool
+
+	cfg      settings.ClipboardSettings
+	limits   settings.ClipboardLimits
+	stream   string
+	mimetype string
+	inspect  bool
+	// dropped discards the rest of a stream which exceeded a limit
+	dropped bool
+	held    []byte
+	data    []byte
+	size    int
+	// quota are the recent transfers of the user, transfer is the one of the stream
+	quota    *clipboardQuota
+	transfer *clipboardTransfer
+}
+
+type clipboardTransfer struct {
+	start time.Time
+	size  int
+}
+
+// clipboardQuota are the transfers of a user in one direction during the last minute, for
+// the rate limits. It's kept by the room so the connections of the user share it.
+type clipboardQuota struct {
+	lock   sync.Mutex
+	recent []*clipboardTransfer
+}
+
+// start adds a transfer unless the user made limit of them in the last minute, no limit if 0
+func (q *clipboardQuota) start(now time.Time, limit int) (*clipboardTransfer, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for len(q.recent) > 0 && now.Sub(q.recent[0].start) > time.Minute {
+		q.recent = q.recent[1:]
+	}
+	if limit > 0 && len(q.recent) >= limit {
+		return nil, false
+	}
+	transfer := &clipboardTransfer{start: now}
+	q.recent = append(q.recent, transfer)
+	return transfer, true
+}
+
+// add counts size bytes of the transfer and returns the bytes of the transfers of the last minute
+func (q *clipboardQuota) add(transfer *clipboardTransfer, size int) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	transfer.size += size
+	total := 0
+	for _, t := range q.recent {
+		total += t.size
+	}
+	return total
+}
+
+func newClipboardFilter(direction string, ses *session.SessionCommonData, user string, notify func(*Instruction)) *clipboardFilter {
+	f := &clipboardFilter{direction: direction, ses: ses, user: user, notify: notify, quota: &clipboardQuota{}}
+	if direction == ClipboardPaste {
+		f.ack = notify
+	}
+	if ses != nil {
+		if room, ok := lookupRdpSessionRoom(ses.RdpSessionId); ok {
+			f.quota = room.clipboardQuota(user, direction)
+		}
+	}
+	return f
+}
+
+// filter returns the instructions to forward in place of ins, nothing while a transfer is held
+func (f *clipboardFilter) filter(ins []byte) []byte {
+	if f == nil || f.ses == nil {
+		return ins
+	}
+	if bytes.HasPrefix(ins, clipboardOpcodeIns) {
+		return f.start(ins)
+	}
+	if f.stream == "" || !(bytes.HasPrefix(ins, blobOpcodeIns) || bytes.HasPrefix(ins, endOpcodeIns)) {
+		return ins
+	}
+	instruction, err := Parse(ins)
+	if err != nil || len(instruction.Args) == 0 || instruction.Args[0] != f.stream {
+		return ins
+	}
+	if instruction.Opcode == "end" {
+		if f.dropped {
+			f.stream = ""
+			return nil
+		}
+		return f.finish()
+	}
+	if f.dropped || len(instruction.Args) < 2 {
+		return nil
+	}
+	data, err := base64.StdEncoding.DecodeString(instruction.Args[1])
+	if err != nil {
+		logrus.Errorf("invalid clipboard blob %v", err)
+		return nil
+	}
+	f.size += len(data)
+	if reason, status := f.exceeded(f.quota.add(f.transfer, len(data))); reason != "" {
+		return f.drop(reason, status)
+	}
+	f.held = append(f.held, ins...)
+	f.data = append(f.data, data...)
+	return nil
+}
+
+func (f *clipboardFilter) start(ins []byte) []byte {
+	instruction, err := Parse(ins)
+	if err != nil || len(instruction.Args) < 2 {
+		return ins
+	}
+	f.cfg = settings.Clipboard(f.ses.TenantID, f.ses.AppID)
+	f.limits = f.cfg.Copy
+	if f.direction == ClipboardPaste {
+		f.limits = f.cfg.Paste
+	}
+	f.stream = ""
+	if f.allowed != nil && !f.allowed() {
+		f.stream = instruction.Args[0]
+		f.inspect = false
+		f.dropped = true
+		f.report(InspectionResult{Verdict: ClipboardBlock, Reason: "Denied by policy"}, guacStatusForbidden)
+		return nil
+	}
+	if !f.cfg.Enabled && f.limits == (settings.ClipboardLimits{}) {
+		return ins
+	}
+	f.stream = instruction.Args[0]
+	f.mimetype = instruction.Args[1]
+	f.inspect = f.cfg.Enabled
+	f.dropped = false
+	f.held = append(f.held[:0], ins...)
+	f.data = f.data[:0]
+	f.size = 0
+
+	var ok bool
+	if f.transfer, ok = f.quota.start(time.Now(), f.limits.TransfersPerMinute); !ok {
+		f.dropped = true
+		f.report(InspectionResult{Verdict: ClipboardBlock, Reason: "Out of quota"}, guacStatusTooMany)
+	}
+	return nil
+}
+
+// exceeded returns the reason and status if the transfer exceeded a limit, recent are
+// the bytes transferred by the user in the last minute
+func (f *clipboardFilter) exceeded(recent int) (string, string) {
+	if f.limits.MaxBytes > 0 && f.size > f.limits.MaxBytes {
+		return "Size limit exceeded", guacStatusOverrun
+	}
+	if f.size > clipboardMaxHold {
+		return "Size limit exceeded", guacStatusOverrun
+	}
+	if f.limits.BytesPerMinute > 0 && recent > f.limits.BytesPerMinute {
+		return "Out of quota", guacStatusTooMany
+	}
+	return "", ""
+}
+
+// drop discards the stream, the receiver never gets any of it
+func (f *clipboardFilter) drop(reason, status string) []byte {
+	f.dropped = true
+	f.held = nil
+	f.data = nil
+	f.report(InspectionResult{Verdict: ClipboardBlock, Reason: reason}, status)
+	return nil
+}
+
+// report tells the client the verdict on a transfer and logs blocks and redactions,
+// a blocked stream is acked with the error status so the sender stops sending.
+func (f *clipboardFilter) report(result InspectionResult, status string) {
+	logrus.Infof("clipboard %s of %s in session %s: %s %s", f.direction, f.user, f.ses.RdpSessionId, result.Verdict, result.Reason)
+	if f.notify != nil {
+		f.notify(NewInstruction(CLIPBOARD_VERDICT, f.direction, string(result.Verdict), result.Reason))
+	}
+	if result.Verdict == ClipboardBlock && f.ack != nil {
+		f.ack(NewInstruction("ack", f.stream, "clipboard blocked", status))
+	}
+	if result.Verdict != ClipboardAllow {
+		f.log(string(result.Verdict), result.Reason)
+	}
+}
+
+func (f *clipboardFilter) finish() []byte {
+	stream := f.stream
+	end := NewInstruction("end", stream).Byte()
+
+	if !f.inspect {
+		f.stream = ""
+		return append(append([]byte{}, f.held...), end...)
+	}
+
+	var result InspectionResult
+	if inspector, err := GetContentInspector(f.cfg); err != nil {
+		logrus.Errorf("cannot inspect clipboard, block it: %v", err)
+		result = InspectionResult{Verdict: ClipboardBlock, Reason: "inspection failed"}
+	} else {
+		// text may be sent as any mimetype, so all of them are inspected as text
+		result = inspector.Inspect(f.direction, string(f.data))
+		if result.Verdict == ClipboardRedact && !strings.HasPrefix(f.mimetype, "text/") {
+			// images and other data would be corrupted by a redaction
+			result = InspectionResult{Verdict: ClipboardBlock, Reason: result.Reason}
+		}
+	}
+	f.report(result, guacStatusForbidden)
+	f.stream = ""
+
+	switch result.Verdict {
+	case ClipboardBlock:
+		return nil
+	case ClipboardRedact:
+		out := NewInstruction("clipboard", stream, f.mimetype).Byte()
+		content := []byte(result.Content)
+		for len(content) > 0 {
+			n := len(content)
+			if n > clipboardBlobSize {
+				n = clipboardBlobSize
+			}
+			out = append(out, NewInstruction("blob", stream, base64.StdEncoding.EncodeToString(content[:n])).Byte()...)
+			content = content[n:]
+		}
+		return append(out, end...)
+	}
+	return append(append([]byte{}, f.held...), end...)
+}
+
+func (f *clipboardFilter) log(action, reason string) {
+	event := constants.PolicyV2EventDownload
+	if f.direction == ClipboardPaste {
+		event = constants.PolicyV2EventUpload
+	}
+	go sendBlockEvent(BlockEvent{
+		Event:           event,
+		Tag:             fmt.Sprintf("rdp.%s.%s", f.direction, action),
+		UserEmail:       f.user,
+		RemotePath:      "Clipboard",
+		Session:         f.ses,
+		BlockPolicyType: "clipboard",
+		BlockReason:     reason,
+	})
+}
@@ -0,0 +1,192 @@
+package guac
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wwt/guac/lib/logging"
+	"github.com/wwt/guac/lib/settings"
+	"github.com/wwt/guac/pkg/session"
+)
+
+var clipboardTestRules = []settings.ClipboardRule{
+	{Name: "card", Pattern: `\b(?:\d[ -]?){13,16}\b`, Action: "block"},
+	{Name: "secret", Keywords: []string{"password", "api_key"}, Action: "redact", Direction: ClipboardCopy},
+}
+
+func TestRuleInspector(t *testing.T) {
+	inspector, err := NewRuleInspector(clipboardTestRules)
+	assert.Nil(t, err)
+
+	result := inspector.Inspect(ClipboardCopy, "hello world")
+	assert.Equal(t, ClipboardAllow, result.Verdict)
+	assert.Equal(t, "hello world", result.Content)
+
+	result = inspector.Inspect(ClipboardPaste, "pay with 4111 1111 1111 1111")
+	assert.Equal(t, ClipboardBlock, result.Verdict)
+	assert.Equal(t, "card", result.Reason)
+
+	result = inspector.Inspect(ClipboardCopy, "the Password is hunter2")
+	assert.Equal(t, ClipboardRedact, result.Verdict)
+	assert.Equal(t, "the [REDACTED] is hunter2", result.Content)
+
+	// the keyword rule only applies to copy
+	result = inspector.Inspect(ClipboardPaste, "password")
+	assert.Equal(t, ClipboardAllow, result.Verdict)
+
+	_, err = NewRuleInspector([]settings.ClipboardRule{{Name: "bad", Pattern: "("}})
+	assert.NotNil(t, err)
+}
+
+func clipboardStream(stream, text string) [][]byte {
+	return [][]byte{
+		NewInstruction("clipboard", stream, "text/plain").Byte(),
+		NewInstruction("blob", stream, base64.StdEncoding.EncodeToString([]byte(text[:len(text)/2]))).Byte(),
+		NewInstruction("blob", stream, base64.StdEncoding.EncodeToString([]byte(text[len(text)/2:]))).Byte(),
+		NewInstruction("end", stream).Byte(),
+	}
+}
+
+func TestClipboardFilter(t *testing.T) {
+	s := settings.Defaults()
+	s.Default.Clipboard = &settings.ClipboardSettings{
+		Enabled: true,
+		Rules:   clipboardTestRules,
+		Copy:    settings.ClipboardLimits{MaxBytes: 64},
+	}
+	settings.Set(s)
+	defer settings.Set(settings.Defaults())
+
+	var notices []*Instruction
+	ses := &session.SessionCommonData{TenantID: "t1", AppID: "a1", Email: "host@appaegis.com"}
+	filter := newClipboardFilter(ClipboardCopy, ses, "viewer@appaegis.com", func(ins *Instruction) {
+		notices = append(notices, ins)
+	})
+	var acks []*Instruction
+	filter.ack = func(ins *Instruction) { acks = append(acks, ins) }
+	run := func(instructions [][]byte) []byte {
+		var out []byte
+		for _, ins := range instructions {
+			out = append(out, filter.filter(ins)...)
+		}
+		return out
+	}
+
+	// other streams pass while the clipboard is held
+	img := NewInstruction("blob", "3", "AAAA").Byte()
+	transfer := clipboardStream("1", "plain text")
+	out := run([][]byte{transfer[0], transfer[1], img})
+	assert.Equal(t, string(img), string(out))
+	out = run(transfer[2:])
+	assert.Equal(t, string(transfer[0])+string(transfer[1])+string(transfer[2])+string(transfer[3]), string(out))
+	assert.Equal(t, []string{ClipboardCopy, "allow", ""}, notices[0].Args)
+
+	out = run(clipboardStream("1", "my password"))
+	redacted := NewInstruction("clipboard", "1", "text/plain").String() +
+		NewInstruction("blob", "1", base64.StdEncoding.EncodeToString([]byte("my [REDACTED]"))).String() +
+		NewInstruction("end", "1").String()
+	assert.Equal(t, redacted, string(out))
+	assert.Equal(t, []string{ClipboardCopy, "redact", "secret"}, notices[1].Args)
+
+	out = run(clipboardStream("1", "4111-1111-1111-1111"))
+	assert.Empty(t, out)
+	assert.Equal(t, []string{ClipboardCopy, "block", "card"}, notices[2].Args)
+
+	out = run(clipboardStream("1", string(make([]byte, 100))))
+	assert.Empty(t, out)
+	assert.Equal(t, []string{ClipboardCopy, "block", "Size limit exceeded"}, notices[3].Args)
+	// guacd gets the error status of the blocked copies
+	assert.Equal(t, 2, len(acks))
+	assert.Equal(t, []string{"1", "clipboard blocked", guacStatusOverrun}, acks[1].Args)
+
+	// other mimetypes are inspected as text, they are blocked rather than redacted
+	image := func(content string) [][]byte {
+		return [][]byte{
+			NewInstruction("clipboard", "1", "image/png").Byte(),
+			NewInstruction("blob", "1", base64.StdEncoding.EncodeToString([]byte(content))).Byte(),
+			NewInstruction("end", "1").Byte(),
+		}
+	}
+	assert.Empty(t, run(image("4111-1111-1111-1111")))
+	assert.Equal(t, []string{ClipboardCopy, "block", "card"}, notices[4].Args)
+	assert.Empty(t, run(image("my password")))
+	assert.Equal(t, []string{ClipboardCopy, "block", "secret"}, notices[5].Args)
+	transfer = image("\x89PNG")
+	assert.Equal(t, string(transfer[0])+string(transfer[1])+string(transfer[2]), string(run(transfer)))
+	assert.Equal(t, []string{ClipboardCopy, "allow", ""}, notices[6].Args)
+
+	// disabled for the app
+	s.Tenants = map[string]*settings.TenantScope{"t1": {Apps: map[string]*settings.Scope{
+		"a1": {Clipboard: &settings.ClipboardSettings{}},
+	}}}
+	transfer = clipboardStream("1", "4111-1111-1111-1111")
+	assert.Equal(t, transfer[0], run(transfer[:1]))
+	assert.Equal(t, transfer[3], run(transfer[3:]))
+	assert.Equal(t, 7, len(notices))
+}
+
+func TestClipboardFilterLimits(t *testing.T) {
+	s := settings.Defaults()
+	s.Default.Clipboard = &settings.ClipboardSettings{
+		Paste: settings.ClipboardLimits{MaxBytes: 10, TransfersPerMinute: 2},
+	}
+	settings.Set(s)
+	defer settings.Set(settings.Defaults())
+
+	var notices []*Instruction
+	ses := &session.SessionCommonData{TenantID: "t1", AppID: "a1", Email: "host@appaegis.com"}
+	filter := newClipboardFilter(ClipboardPaste, ses, "host@appaegis.com", func(ins *Instruction) {
+		notices = append(notices, ins)
+	})
+	run := func(instructions [][]byte) []string {
+		var out []string
+		for _, ins := range instructions {
+			out = append(out, string(filter.filter(ins)))
+		}
+		return out
+	}
+
+	// without inspection the stream is relayed once it is complete
+	transfer := clipboardStream("2", "small")
+	assert.Equal(t, []string{"", "", "", string(transfer[0]) + string(transfer[1]) + string(transfer[2]) + string(transfer[3])}, run(transfer))
+	assert.Empty(t, notices)
+
+	// none of a stream too large is relayed and the client gets the error status
+	transfer = clipboardStream("2", "far too large text")
+	assert.Equal(t, []string{"", "", "", ""}, run(transfer))
+	assert.Equal(t, []string{ClipboardPaste, "block", "Size limit exceeded"}, notices[0].Args)
+	assert.Equal(t, []string{"2", "clipboard blocked", guacStatusOverrun}, notices[1].Args)
+
+	// a third transfer within a minute is out of quota
+	transfer = clipboardStream("2", "small")
+	assert.Equal(t, []string{"", "", "", ""}, run(transfer))
+	assert.Equal(t, []string{ClipboardPaste, "block", "Out of quota"}, notices[2].Args)
+	assert.Equal(t, []string{"2", "clipboard blocked", guacStatusTooMany}, notices[3].Args)
+}
+
+func TestClipboardQuotaSharedByConnections(t *testing.T) {
+	s := settings.Defaults()
+	s.Default.Clipboard = &settings.ClipboardSettings{
+		Paste: settings.ClipboardLimits{TransfersPerMinute: 1},
+	}
+	settings.Set(s)
+	defer settings.Set(settings.Defaults())
+
+	ses := &session.SessionCommonData{TenantID: "t1", AppID: "a1", Email: "host@appaegis.com", RdpSessionId: "clipboard-session"}
+	NewRdpSessionRoom(ses.RdpSessionId, "host@appaegis.com", &fakeWriterCloser{}, "c1", true, "a1", "app", logging.LoggingInfo{})
+	defer delete(rdpRooms, ses.RdpSessionId)
+
+	run := func(filter *clipboardFilter) []byte {
+		var out []byte
+		for _, ins := range clipboardStream("2", "small") {
+			out = append(out, filter.filter(ins)...)
+		}
+		return out
+	}
+	assert.NotEmpty(t, run(newClipboardFilter(ClipboardPaste, ses, "host@appaegis.com", nil)))
+
+	// a reconnect or second tab doesn't reset the quota of the user
+	assert.Empty(t, run(newClipboardFilter(ClipboardPaste, ses, "host@appaegis.com", nil)))
+	assert.NotEmpty(t, run(newClipboardFilter(ClipboardPaste, ses, "viewer@appaegis.com", nil)))
+}
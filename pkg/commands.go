@@ -7,7 +7,6 @@ import (
 	"os"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/appaegis/golang-common/pkg/config"
@@ -18,6 +17,7 @@ import (
 	"github.com/appaegis/golang-common/pkg/monitorpolicy"
 	"github.com/sirupsen/logrus"
 	"github.com/wwt/guac/lib/logging"
+	"github.com/wwt/guac/lib/settings"
 	"github.com/wwt/guac/pkg/session"
 )
 
@@ -39,83 +39,70 @@ type BlockEvent struct {
 	FileCount       int
 	BlockPolicyType string
 	BlockReason     string
+	// Tag overrides the app tag derived from Event
+	Tag string
+	// UserEmail overrides the user of the session, e.g. for a shared session viewer
+	UserEmail string
 }
 
 func SendEvent(action string, payload logging.Action) {
-	wg := sync.WaitGroup{}
-
 	payload.AppTag = fmt.Sprintf("rdp.%s", action)
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		defer func() {
-			if r := recover(); r != nil {
-				fmt.Println("Recovered in sendBlockEvent", r)
-			}
-		}()
-
-		event := constants.PolicyV2EventAccess
-		switch action {
-		case "upload":
-			event = constants.PolicyV2EventUpload
-		case "download":
-			event = constants.PolicyV2EventDownload
-		}
+	event := constants.PolicyV2EventAccess
+	switch action {
+	case "upload":
+		event = constants.PolicyV2EventUpload
+	case "download":
+		event = constants.PolicyV2EventDownload
+	}
+	if payload.Session != nil {
+		payload.Enrich = enrichPolicyMeta(payload.Session.AppID, payload.UserEmail, payload.Session.TenantID, event)
+	}
+	logging.Log(payload)
+}
 
+// enrichPolicyMeta sets the policy which matched the event of the user, the query runs
+// in the audit pipeline rather than on the connection
+func enrichPolicyMeta(appId, user, tenantId string, event constants.PolicyV2Event) func(*logging.Action) {
+	return func(action *logging.Action) {
 		metas := adaptor.GetDefaultDaoClient().QueryPolicyMetaByAstraea(
-			payload.Session.AppID,
-			payload.UserEmail,
-			payload.Session.TenantID,
+			appId,
+			user,
+			tenantId,
 			string(constants.PolicyV2ResourceTypeRdp),
 		)
+		if metas == nil {
+			return
+		}
 		if meta, ok := (*metas)[event]; ok {
-			payload.PolicyID = meta.ID
-			payload.PolicyName = meta.Name
+			action.PolicyID = meta.ID
+			action.PolicyName = meta.Name
 		}
-	}()
-	wg.Wait()
-
-	logging.Log(payload)
+	}
 }
 
 func sendBlockEvent(event BlockEvent) {
-	wg := sync.WaitGroup{}
-	policyMeta := schema.PolicyV2Meta{}
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		defer func() {
-			if r := recover(); r != nil {
-				fmt.Println("Recovered in sendBlockEvent", r)
-			}
-		}()
-		metas := adaptor.GetDefaultDaoClient().QueryPolicyMetaByAstraea(
-			event.Session.AppID,
-			event.Session.Email,
-			event.Session.TenantID,
-			string(constants.PolicyV2ResourceTypeRdp),
-		)
-		if meta, ok := (*metas)[event.Event]; ok {
-			policyMeta = meta
-		}
-	}()
-	wg.Wait()
+	user := event.Session.Email
+	if event.UserEmail != "" {
+		user = event.UserEmail
+	}
 
+	tag := fmt.Sprintf("rdp.%s.block", event.Event)
+	if event.Tag != "" {
+		tag = event.Tag
+	}
 	logging.Log(logging.Action{
 		Session:         event.Session,
-		AppTag:          fmt.Sprintf("rdp.%s.block", event.Event),
-		UserEmail:       event.Session.Email,
+		AppTag:          tag,
+		UserEmail:       user,
 		ClientIP:        event.Session.ClientIP,
 		ClientPrivateIp: event.Session.ClientPrivateIp,
 		RemotePath:      event.RemotePath,
 		Files:           event.Files,
 		FileCount:       event.FileCount,
-		PolicyID:        policyMeta.ID,
-		PolicyName:      policyMeta.Name,
 		BlockPolicyType: event.BlockPolicyType,
 		BlockReason:     event.BlockReason,
+		Enrich:          enrichPolicyMeta(event.Session.AppID, user, event.Session.TenantID, event.Event),
 	})
 }
 
@@ -132,6 +119,7 @@ func init() {
 	commands[REMOVE_SHARE] = RemoveShareCommand{}
 	commands[CHECK_USER] = CheckUserCommand{}
 	commands[STOP_SHARE] = StopShareCommand{}
+	commands[SET_MASKS] = SetMasksCommand{}
 }
 
 func GetCommandByOp(instruction *Instruction) (Command, error) {
@@ -145,14 +133,19 @@ func GetCommandByOp(instruction *Instruction) (Command, error) {
 }
 
 func GetSharingUrl(sessionId, tenantId string) string {
+	url := fmt.Sprintf("https://%s/share_session?shareSessionId=%s", tenantPortal(tenantId), sessionId)
+	return url
+}
+
+// tenantPortal returns the host of the portal of the tenant, on its IdP domain if it has one
+func tenantPortal(tenantId string) string {
 	portal := config.GetPortalHostName()
 	tenant := dbAccess.GetTenantById(tenantId)
 	if tenant.IdpDomain != "" {
 		suffix := strings.Join(strings.Split(portal, ".")[1:], ".")
 		portal = fmt.Sprintf("%s.%s", tenant.IdpDomain, suffix)
 	}
-	url := fmt.Sprintf("https://%s/share_session?shareSessionId=%s", portal, sessionId)
-	return url
+	return portal
 }
 
 type StopShareCommand struct{}
@@ -307,6 +300,29 @@ func (c SetPermissions) Exec(instruction *Instruction, session *session.SessionC
 	return getResponseCommand(instruction.Args[0], "200")
 }
 
+type SetMasksCommand struct{}
+
+// Exec replaces the masks of the room with the json list of regions in the third argument,
+// only the host can as the masks hide the display from the other participants
+func (c SetMasksCommand) Exec(instruction *Instruction, session *session.SessionCommonData, client *RdpClient) *Instruction {
+	requestId := instruction.Args[0]
+	if client.Role != ROLE_ADMIN {
+		logrus.Errorf("user %s didn't have permission to set masks", client.UserId)
+		return getResponseCommand(requestId, "403")
+	}
+	room, ok := lookupRdpSessionRoom(session.RdpSessionId)
+	if !ok {
+		return getResponseCommand(requestId, "404")
+	}
+	var masks []settings.MaskRegion
+	if len(instruction.Args) < 3 || json.Unmarshal([]byte(instruction.Args[2]), &masks) != nil {
+		return getResponseCommand(requestId, "400")
+	}
+	logrus.Infof("%s set %d masks in session %s", client.UserId, len(masks), session.RdpSessionId)
+	room.SetMasks(masks)
+	return getResponseCommand(requestId, "200")
+}
+
 type SearchUserResp struct {
 	Users []string `json:"users"`
 }
@@ -434,6 +450,7 @@ func (c DlpDownloadCommand) Exec(instruction *Instruction, ses *session.SessionC
 		fileName = fileTokens[len(fileTokens)-1]
 	}
 
+	recordTransfer(ses, FileDownload, ses.Email, []string{fileName}, false)
 	go SendEvent("download", logging.Action{
 		Session:         ses,
 		UserEmail:       ses.Email,
@@ -481,6 +498,7 @@ func (c DlpUploadCommand) Exec(instruction *Instruction, ses *session.SessionCom
 	fileName := instruction.Args[2]
 	logrus.Debug("dlp-upload: ", fileName)
 
+	recordTransfer(ses, FileUpload, ses.Email, []string{fileName}, false)
 	go SendEvent("upload", logging.Action{
 		Session:         ses,
 		UserEmail:       ses.Email,
@@ -542,9 +560,12 @@ func (c UploadCheckCommand) Exec(instruction *Instruction, ses *session.SessionC
 		Country:     ses.ClientIsoCountry,
 		ActionCount: fileCount,
 		Now:         time.Now(),
-		Rules:       ses.MonitorRules,
+		Rules:       ses.Monitor().Rules,
 	})
 	logrus.Infof("check upload rule result: %s", action)
+	if action != "deny" {
+		client.grantTransfers("upload", fileCount)
+	}
 	if action == "deny" {
 		fileName := instruction.Args[2]
 		event := BlockEvent{
@@ -586,9 +607,12 @@ func (c DownloadCheckCommand) Exec(instruction *Instruction, ses *session.Sessio
 		Country:     ses.ClientIsoCountry,
 		ActionCount: fileCount,
 		Now:         time.Now(),
-		Rules:       ses.MonitorRules,
+		Rules:       ses.Monitor().Rules,
 	})
 	logrus.Infof("check rule result: %s", action)
+	if action != "deny" {
+		client.grantTransfers("download", fileCount)
+	}
 	if action == "deny" {
 		filePath := instruction.Args[2]
 		fileTokens := strings.Split(filePath, "/")
@@ -24,6 +24,13 @@ const (
 	SEARCH_USER     = "search-user"
 	SEARCH_USER_ACK = "search-user-ack"
 	CHECK_USER      = "check-user"
+	SET_MASKS       = "set-masks"
+
+	CLIPBOARD_VERDICT = "clipboard-verdict"
+	FILE_VERDICT      = "file-verdict"
+	UPLOAD_SCAN       = "upload-scan"
+	WATERMARK         = "watermark"
+	SESSION_LIMIT     = "session-limit"
 
 	MAIL_SENDER = "account@appaegis.com"
 
@@ -3,6 +3,7 @@ package guac
 import (
 	"github.com/appaegis/golang-common/pkg/db_data/adaptor"
 	"github.com/appaegis/golang-common/pkg/db_data/schema"
+	"github.com/appaegis/golang-common/pkg/monitorpolicy"
 )
 
 var dbAccess DbAccess = DynamodbAccess{}
@@ -15,6 +16,10 @@ type DbAccess interface {
 	QueryUsersByTenantAndUserPrefix(tenantId, userPrefix string) ([]schema.UserEntry, error)
 	RemoveInvitee(sessionId, user string) error
 	GetTenantById(tenantId string) schema.TenantEntry
+	QueryPolicyByAstraea(appId, userId string) schema.PolicyEntry
+	QueryResource(appId string) *schema.Resource
+	QueryMonitorPolicyEntryById(monitorPolicyId string) schema.MonitorPolicyEntry
+	QueryMonitorRuleForUser(monitorPolicyId, userId string) map[string]*schema.MonitorPolicyRule
 }
 
 type DynamodbAccess struct{}
@@ -46,3 +51,19 @@ func (d DynamodbAccess) RemoveInvitee(sessionId, user string) error {
 func (d DynamodbAccess) GetTenantById(tenantId string) schema.TenantEntry {
 	return adaptor.GetDefaultDaoClient().GetTenantById(tenantId)
 }
+
+func (d DynamodbAccess) QueryPolicyByAstraea(appId, userId string) schema.PolicyEntry {
+	return adaptor.GetDefaultDaoClient().QueryPolicyByAstraea(appId, userId)
+}
+
+func (d DynamodbAccess) QueryResource(appId string) *schema.Resource {
+	return adaptor.GetDefaultDaoClient().QueryResource(appId)
+}
+
+func (d DynamodbAccess) QueryMonitorPolicyEntryById(monitorPolicyId string) schema.MonitorPolicyEntry {
+	return adaptor.GetDefaultDaoClient().QueryMonitorPolicyEntryById(monitorPolicyId)
+}
+
+func (d DynamodbAccess) QueryMonitorRuleForUser(monitorPolicyId, userId string) map[string]*schema.MonitorPolicyRule {
+	return monitorpolicy.QueryMonitorRuleForUser(monitorPolicyId, userId)
+}
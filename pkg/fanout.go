@@ -0,0 +1,326 @@
+package guac
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/wwt/guac/lib/settings"
+)
+
+// fanOutHostOpcodes are the instructions guacd sends the host only
+var fanOutHostOpcodes = map[string]bool{
+	"ack":         true,
+	"required":    true,
+	"filesystem":  true,
+	"server_info": true,
+}
+
+// fanOutHostStreams are the streams guacd opens to the host only, by the arg of their index
+var fanOutHostStreams = map[string]int{
+	"file": 0,
+	"pipe": 0,
+	"argv": 0,
+	"body": 1,
+}
+
+// fanOutInputOpcodes are the instructions of the viewers written to the connection of the host
+var fanOutInputOpcodes = map[string]bool{
+	"mouse": true,
+	"key":   true,
+	"touch": true,
+}
+
+// roomFanOut relays the guacd connection of the host to the viewers of a room, so
+// guacd renders the display once however many watch it. Each viewer is behind its
+// own queue, and disconnected if it overruns rather than holding up the host.
+// Only viewers are relayed, the host and cohosts have guacd connections of their own.
+type roomFanOut struct {
+	cfg      settings.FanOutSettings
+	viewers  prometheus.Gauge
+	overruns prometheus.Counter
+
+	lock   sync.Mutex
+	feeds  map[*fanOutFeed]struct{}
+	input  io.Writer
+	closed bool
+
+	// streams are the streams of the host hidden from the viewers, only used by the relay of the host
+	streams map[string]bool
+}
+
+// newRoomFanOut returns the fan out of a room of the app, nil if disabled
+func newRoomFanOut(tenantId, appId string) *roomFanOut {
+	cfg := settings.FanOut(tenantId, appId)
+	if !cfg.Enabled {
+		return nil
+	}
+	return &roomFanOut{
+		cfg:      cfg,
+		viewers:  fanOutViewers.WithLabelValues(tenantId),
+		overruns: fanOutOverruns.WithLabelValues(tenantId),
+		feeds:    map[*fanOutFeed]struct{}{},
+		streams:  map[string]bool{},
+	}
+}
+
+// source returns reader relaying what it reads to the viewers, whose input is written to writer.
+// reader and writer are the guacd connection of the host.
+func (f *roomFanOut) source(reader InstructionReader, writer io.Writer) InstructionReader {
+	if f == nil {
+		return reader
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.input = writer
+	return &fanOutSource{InstructionReader: reader, fanOut: f}
+}
+
+// subscribe returns the feed of a viewer, nil if the room has no fan out or it's closed
+func (f *roomFanOut) subscribe() *fanOutFeed {
+	if f == nil {
+		return nil
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return nil
+	}
+	feed := &fanOutFeed{
+		fanOut: f,
+		queue:  make(chan []byte, f.cfg.QueueSize),
+		done:   make(chan struct{}),
+	}
+	f.feeds[feed] = struct{}{}
+	f.viewers.Inc()
+	return feed
+}
+
+// publish queues an instruction of the host to the viewers
+func (f *roomFanOut) publish(ins []byte) {
+	if !f.visible(ins) {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(f.feeds) == 0 {
+		return
+	}
+	relayed := append([]byte{}, ins...)
+	for feed := range f.feeds {
+		select {
+		case feed.queue <- relayed:
+		default:
+			logrus.Warnf("viewer fell %d instructions behind the host, disconnect it", len(feed.queue))
+			f.overruns.Inc()
+			f.remove(feed, ErrClientOverrun.NewError("Viewer fell behind the host."))
+		}
+	}
+}
+
+// visible returns if the viewers are sent an instruction of the host
+func (f *roomFanOut) visible(ins []byte) bool {
+	elements, size := scanInstruction(ins, 3)
+	if size == 0 {
+		return true
+	}
+	opcode := elements[0]
+	switch {
+	case opcode == "blob" || opcode == "end":
+		if len(elements) < 2 || !f.streams[elements[1]] {
+			return true
+		}
+		if opcode == "end" {
+			delete(f.streams, elements[1])
+		}
+		return false
+	case fanOutHostOpcodes[opcode]:
+		return false
+	}
+	if arg, ok := fanOutHostStreams[opcode]; ok {
+		if arg+1 < len(elements) {
+			f.streams[elements[arg+1]] = true
+		}
+		return false
+	}
+	return true
+}
+
+// writer returns the connection of the host the input of the viewers is written to
+func (f *roomFanOut) writer() io.Writer {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.input
+}
+
+// remove disconnects a feed, the lock must be held
+func (f *roomFanOut) remove(feed *fanOutFeed, err error) {
+	if _, ok := f.feeds[feed]; !ok {
+		return
+	}
+	delete(f.feeds, feed)
+	f.viewers.Dec()
+	feed.err = err
+	close(feed.done)
+}
+
+// close disconnects the viewers as the connection of the host closes
+func (f *roomFanOut) close() {
+	if f == nil {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return
+	}
+	f.closed = true
+	for feed := range f.feeds {
+		f.remove(feed, ErrConnectionClosed.NewError("Connection of the host is closed."))
+	}
+}
+
+// fanOutSource is the reader of the guacd connection of the host
+type fanOutSource struct {
+	InstructionReader
+	fanOut *roomFanOut
+}
+
+func (s *fanOutSource) ReadSome() ([]byte, error) {
+	ins, err := s.InstructionReader.ReadSome()
+	if err != nil {
+		s.fanOut.close()
+		return ins, err
+	}
+	s.fanOut.publish(ins)
+	return ins, nil
+}
+
+// fanOutFeed is the guacd connection of a viewer relayed from the host. It reads the
+// display guacd sends as the viewer joins, then the instructions of the host queued
+// after that frame, and writes the input of the viewer to the connection of the host.
+type fanOutFeed struct {
+	fanOut *roomFanOut
+	queue  chan []byte
+	// done is closed with err once the feed is disconnected
+	done chan struct{}
+	err  error
+
+	keyframe [][]byte
+	// align is the timestamp of the sync ending the keyframe, the queued frames through it are skipped
+	align    int64
+	aligning bool
+}
+
+// join reads the display guacd sends the viewer joining its connection, up to the end
+// of the frame. reader must be closed after, it may still be read.
+func (f *fanOutFeed) join(reader InstructionReader) {
+	read := make(chan []byte, 64)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer close(read)
+		for {
+			ins, err := reader.ReadSome()
+			if err != nil {
+				return
+			}
+			select {
+			case read <- append([]byte{}, ins...):
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	timer := time.NewTimer(time.Duration(f.fanOut.cfg.KeyframeTimeout) * time.Millisecond)
+	defer timer.Stop()
+	for {
+		select {
+		case ins, ok := <-read:
+			if !ok {
+				return
+			}
+			f.keyframe = append(f.keyframe, ins)
+			if timestamp, ok := syncTimestamp(ins); ok {
+				f.align, f.aligning = timestamp, true
+				return
+			}
+		case <-timer.C:
+			// the display is idle, the queue follows from what the viewer has
+			logrus.Infof("no frame from guacd after %d instructions of the display of a viewer", len(f.keyframe))
+			return
+		}
+	}
+}
+
+// ReadSome returns the next instruction of the keyframe or of the host
+func (f *fanOutFeed) ReadSome() ([]byte, error) {
+	if len(f.keyframe) > 0 {
+		ins := f.keyframe[0]
+		f.keyframe = f.keyframe[1:]
+		return ins, nil
+	}
+	for {
+		select {
+		case <-f.done:
+			return nil, f.err
+		default:
+		}
+		var ins []byte
+		select {
+		case ins = <-f.queue:
+		case <-f.done:
+			return nil, f.err
+		}
+		if f.aligning {
+			if timestamp, ok := syncTimestamp(ins); ok && timestamp >= f.align {
+				f.aligning = false
+			}
+			continue
+		}
+		return ins, nil
+	}
+}
+
+// Available returns true if there are instructions queued
+func (f *fanOutFeed) Available() bool {
+	return len(f.keyframe) > 0 || len(f.queue) > 0
+}
+
+// Flush is a no-op, the queued instructions aren't buffered
+func (f *fanOutFeed) Flush() {}
+
+// Write writes the input instructions of data to the connection of the host, the
+// others, such as syncs and streams, are dropped
+func (f *fanOutFeed) Write(data []byte) (int, error) {
+	var relayed []byte
+	for rest := data; len(rest) > 0; {
+		elements, size := scanInstruction(rest, 1)
+		if size == 0 {
+			break
+		}
+		if fanOutInputOpcodes[elements[0]] {
+			relayed = append(relayed, rest[:size]...)
+		}
+		rest = rest[size:]
+	}
+	if input := f.fanOut.writer(); len(relayed) > 0 && input != nil {
+		if _, err := input.Write(relayed); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// Close disconnects the viewer from the host
+func (f *fanOutFeed) Close() {
+	if f == nil {
+		return
+	}
+	f.fanOut.lock.Lock()
+	defer f.fanOut.lock.Unlock()
+	f.fanOut.remove(f, ErrConnectionClosed.NewError("Viewer left."))
+}
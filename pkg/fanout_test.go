@@ -0,0 +1,164 @@
+package guac
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/wwt/guac/lib/settings"
+)
+
+// blockingReader reads instructions until they run out, then blocks until closed
+type blockingReader struct {
+	instructions [][]byte
+	closed       chan struct{}
+}
+
+func (r *blockingReader) ReadSome() ([]byte, error) {
+	if len(r.instructions) > 0 {
+		ins := r.instructions[0]
+		r.instructions = r.instructions[1:]
+		return ins, nil
+	}
+	<-r.closed
+	return nil, ErrConnectionClosed.NewError("closed")
+}
+
+func (r *blockingReader) Available() bool {
+	return len(r.instructions) > 0
+}
+
+func (r *blockingReader) Flush() {}
+
+func setFanOut(t *testing.T, queueSize int) {
+	s := settings.Defaults()
+	s.Default.FanOut = &settings.FanOutSettings{Enabled: true, QueueSize: queueSize, KeyframeTimeout: 50}
+	settings.Set(s)
+	t.Cleanup(func() { settings.Set(settings.Defaults()) })
+}
+
+func readAll(feed *fanOutFeed) [][]byte {
+	var out [][]byte
+	for feed.Available() {
+		ins, err := feed.ReadSome()
+		if err != nil {
+			break
+		}
+		out = append(out, ins)
+	}
+	return out
+}
+
+func TestFanOutDisabled(t *testing.T) {
+	assert.Nil(t, newRoomFanOut("fanout-tenant", "a1"))
+	var f *roomFanOut
+	assert.Nil(t, f.subscribe())
+	reader := &blockingReader{}
+	assert.Equal(t, InstructionReader(reader), f.source(reader, nil))
+}
+
+func TestFanOutPartialSettings(t *testing.T) {
+	s := settings.Defaults()
+	s.Tenants = map[string]*settings.TenantScope{"fanout-tenant": {Scope: settings.Scope{FanOut: &settings.FanOutSettings{Enabled: true}}}}
+	settings.Set(s)
+	defer settings.Set(settings.Defaults())
+
+	// the fields the tenant leaves unset are the defaults
+	f := newRoomFanOut("fanout-tenant", "a1")
+	assert.Equal(t, settings.FanOutSettings{Enabled: true, QueueSize: 8192, KeyframeTimeout: 2000}, f.cfg)
+}
+
+func TestFanOutRelaysToViewers(t *testing.T) {
+	setFanOut(t, 16)
+	f := newRoomFanOut("fanout-tenant", "a1")
+	host := &bytes.Buffer{}
+	img := NewInstruction("img", "1", "14", "0", "image/png", "0", "0").Byte()
+	blob := NewInstruction("blob", "1", "AAAA").Byte()
+	end := NewInstruction("end", "1").Byte()
+	download := NewInstruction("file", "2", "text/plain", "a.txt").Byte()
+	downloadBlob := NewInstruction("blob", "2", "AAAA").Byte()
+	downloadEnd := NewInstruction("end", "2").Byte()
+	ack := NewInstruction("ack", "3", "OK", "0").Byte()
+	source := f.source(NewStream(&fakeConn{ToRead: bytes.Join([][]byte{
+		img, download, blob, downloadBlob, ack, end, downloadEnd, syncIns(1),
+	}, nil)}, time.Minute), host)
+
+	first, second := f.subscribe(), f.subscribe()
+	assert.Equal(t, float64(2), testutil.ToFloat64(fanOutViewers.WithLabelValues("fanout-tenant")))
+	for i := 0; i < 8; i++ {
+		_, err := source.ReadSome()
+		assert.Nil(t, err)
+	}
+	// what guacd sends the host only is hidden from the viewers
+	assert.Equal(t, [][]byte{img, blob, end, syncIns(1)}, readAll(first))
+	assert.Equal(t, [][]byte{img, blob, end, syncIns(1)}, readAll(second))
+
+	// the connection of the host closed
+	_, err := source.ReadSome()
+	assert.NotNil(t, err)
+	_, err = first.ReadSome()
+	assert.NotNil(t, err)
+	assert.Nil(t, f.subscribe())
+	assert.Zero(t, testutil.ToFloat64(fanOutViewers.WithLabelValues("fanout-tenant")))
+
+	// only the input of viewers is written to the connection of the host
+	mouse := NewInstruction("mouse", "1", "2", "0").Byte()
+	n, err := first.Write(bytes.Join([][]byte{syncIns(1), mouse, NewInstruction("disconnect").Byte()}, nil))
+	assert.Nil(t, err)
+	assert.Positive(t, n)
+	assert.Equal(t, string(mouse), host.String())
+}
+
+func TestFanOutOverrun(t *testing.T) {
+	setFanOut(t, 2)
+	overruns := testutil.ToFloat64(fanOutOverruns.WithLabelValues("overrun-tenant"))
+	f := newRoomFanOut("overrun-tenant", "a1")
+	f.source(&blockingReader{}, nil)
+	slow, fast := f.subscribe(), f.subscribe()
+
+	f.publish(syncIns(1))
+	f.publish(syncIns(2))
+	assert.Equal(t, [][]byte{syncIns(1), syncIns(2)}, readAll(fast))
+	f.publish(syncIns(3))
+
+	// the slow viewer is disconnected, the others keep up
+	_, err := slow.ReadSome()
+	assert.NotNil(t, err)
+	assert.Equal(t, overruns+1, testutil.ToFloat64(fanOutOverruns.WithLabelValues("overrun-tenant")))
+	assert.Equal(t, [][]byte{syncIns(3)}, readAll(fast))
+	fast.Close()
+	_, err = fast.ReadSome()
+	assert.NotNil(t, err)
+}
+
+func TestFanOutJoin(t *testing.T) {
+	setFanOut(t, 16)
+	f := newRoomFanOut("fanout-tenant", "a1")
+	rect := NewInstruction("rect", "0", "0", "0", "10", "10").Byte()
+	cfill := NewInstruction("cfill", "14", "0", "0", "0", "0", "255").Byte()
+
+	feed := f.subscribe()
+	// queued as the viewer joins guacd
+	f.publish(rect)
+	f.publish(syncIns(1))
+	f.publish(cfill)
+	f.publish(syncIns(2))
+	f.publish(rect)
+
+	// guacd sends the display then ends the frame
+	joined := &blockingReader{instructions: [][]byte{cfill, rect, syncIns(1)}, closed: make(chan struct{})}
+	feed.join(joined)
+	close(joined.closed)
+	assert.Equal(t, [][]byte{cfill, rect, syncIns(1), cfill, syncIns(2), rect}, readAll(feed))
+
+	// the display is idle
+	feed = f.subscribe()
+	f.publish(rect)
+	idle := &blockingReader{instructions: [][]byte{cfill}, closed: make(chan struct{})}
+	feed.join(idle)
+	close(idle.closed)
+	assert.Equal(t, [][]byte{cfill, rect}, readAll(feed))
+	f.close()
+}
@@ -0,0 +1,161 @@
+package guac
+
+import (
+	"bytes"
+	"regexp"
+	"time"
+
+	"github.com/appaegis/golang-common/pkg/constants"
+	"github.com/appaegis/golang-common/pkg/monitorpolicy"
+	"github.com/sirupsen/logrus"
+	"github.com/wwt/guac/lib/settings"
+	"github.com/wwt/guac/pkg/session"
+)
+
+const (
+	FileUpload   = "upload"
+	FileDownload = "download"
+
+	// streamIndexMimetype is the mimetype of the directory listings of a filesystem object
+	streamIndexMimetype = "application/vnd.glyptodon.guacamole.stream-index+json"
+)
+
+var (
+	fileOpcodeIns = []byte("4.file,")
+	putOpcodeIns  = []byte("3.put,")
+	bodyOpcodeIns = []byte("4.body,")
+)
+
+// fileTransferFilter enforces the file transfer policy on the file streams of
+// one direction. Uploads are the file and put streams of the client, downloads
+// the file and body streams of guacd. A blocked stream is acked with an error,
+// which makes the sender abort it, and its remaining instructions are dropped.
+type fileTransferFilter struct {
+	direction string
+	ses       *session.SessionCommonData
+	client    *RdpClient
+	// ack sends an instruction to the sender of the streams
+	ack func(*Instruction)
+	// blocked are the indices of the blocked streams
+	blocked map[string]bool
+}
+
+func newFileTransferFilter(direction string, ses *session.SessionCommonData, client *RdpClient, ack func(*Instruction)) *fileTransferFilter {
+	return &fileTransferFilter{direction: direction, ses: ses, client: client, ack: ack, blocked: map[string]bool{}}
+}
+
+// filter returns ins if it may be forwarded
+func (f *fileTransferFilter) filter(ins []byte) []byte {
+	if f == nil || f.ses == nil || len(ins) == 0 {
+		return ins
+	}
+	if len(f.blocked) > 0 && (bytes.HasPrefix(ins, blobOpcodeIns) || bytes.HasPrefix(ins, endOpcodeIns)) {
+		instruction, err := Parse(ins)
+		if err != nil || len(instruction.Args) == 0 || !f.blocked[instruction.Args[0]] {
+			return ins
+		}
+		if instruction.Opcode == "end" {
+			delete(f.blocked, instruction.Args[0])
+		}
+		return nil
+	}
+
+	// file,<stream>,<mimetype>,<name> for both directions, put,<object>,<stream>,<mimetype>,<name>
+	// for uploads and body,<object>,<stream>,<mimetype>,<name> for downloads
+	var argStart int
+	switch {
+	case bytes.HasPrefix(ins, fileOpcodeIns):
+		argStart = 0
+	case f.direction == FileUpload && bytes.HasPrefix(ins, putOpcodeIns),
+		f.direction == FileDownload && bytes.HasPrefix(ins, bodyOpcodeIns):
+		argStart = 1
+	default:
+		return ins
+	}
+	instruction, err := Parse(ins)
+	if err != nil || len(instruction.Args) < argStart+3 {
+		return ins
+	}
+	stream, mimetype, name := instruction.Args[argStart], instruction.Args[argStart+1], instruction.Args[argStart+2]
+	if mimetype == streamIndexMimetype {
+		return ins
+	}
+	policyType, reason := f.check(name, mimetype)
+	if reason == "" {
+		return ins
+	}
+
+	logrus.Infof("block %s of %s in session %s by %s: %s", f.direction, name, f.ses.RdpSessionId, policyType, reason)
+	f.blocked[stream] = true
+	f.ack(NewInstruction("ack", stream, "transfer blocked", guacStatusForbidden))
+	if f.client != nil {
+		f.client.WriteMessage(NewInstruction(FILE_VERDICT, f.direction, name, "block", reason))
+	}
+	event := constants.PolicyV2EventDownload
+	if f.direction == FileUpload {
+		event = constants.PolicyV2EventUpload
+	}
+	var user string
+	if f.client != nil {
+		user = f.client.UserId
+	}
+	recordTransfer(f.ses, f.direction, user, []string{name}, true)
+	go sendBlockEvent(BlockEvent{
+		Event:           event,
+		Files:           []string{name},
+		FileCount:       1,
+		RemotePath:      "Filesystem on Appaegis RDP",
+		Session:         f.ses,
+		UserEmail:       user,
+		BlockPolicyType: policyType,
+		BlockReason:     reason,
+	})
+	return nil
+}
+
+// check returns the policy type and reason blocking a transfer, an empty reason allows it
+func (f *fileTransferFilter) check(name, mimetype string) (string, string) {
+	for _, rule := range settings.FileTransfer(f.ses.TenantID, f.ses.AppID).Rules {
+		if rule.Direction != "" && rule.Direction != f.direction {
+			continue
+		}
+		if fileTransferRuleMatch(rule, name, mimetype) {
+			return "dlp", rule.Name
+		}
+	}
+
+	// a transfer checked by the client already counts against the quota
+	if f.client != nil && f.client.takeTransfer(f.direction) {
+		return "", ""
+	}
+	action := monitorpolicy.CheckMonitorRule(&monitorpolicy.CheckActionRequest{
+		AppId:       f.ses.AppID,
+		Action:      f.direction,
+		User:        f.ses.Email,
+		Country:     f.ses.ClientIsoCountry,
+		ActionCount: 1,
+		Now:         time.Now(),
+		Rules:       f.ses.Monitor().Rules,
+	})
+	if action == "deny" {
+		return "monitorpolicy", "Out of quota"
+	}
+	return "", ""
+}
+
+func fileTransferRuleMatch(rule settings.FileTransferRule, name, mimetype string) bool {
+	for _, m := range rule.Mimetypes {
+		if m == mimetype {
+			return true
+		}
+	}
+	if rule.Pattern == "" {
+		return false
+	}
+	pattern, err := regexp.Compile(rule.Pattern)
+	if err != nil {
+		logrus.Errorf("invalid file transfer rule %s: %v", rule.Name, err)
+		return false
+	}
+	return pattern.MatchString(name)
+}
@@ -0,0 +1,66 @@
+package guac
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wwt/guac/lib/settings"
+	"github.com/wwt/guac/pkg/session"
+)
+
+func TestFileTransferFilter(t *testing.T) {
+	s := settings.Defaults()
+	s.Default.FileTransfer = &settings.FileTransferSettings{Rules: []settings.FileTransferRule{
+		{Name: "executables", Pattern: `(?i)\.exe$`, Direction: FileUpload},
+		{Name: "archives", Mimetypes: []string{"application/zip"}},
+	}}
+	settings.Set(s)
+	defer settings.Set(settings.Defaults())
+
+	ses := &session.SessionCommonData{TenantID: "t1", AppID: "a1", Email: "host@appaegis.com"}
+	client := &RdpClient{UserId: "host@appaegis.com", Websocket: &fakeWriterCloser{}}
+	var acks []*Instruction
+	uploads := newFileTransferFilter(FileUpload, ses, client, func(ins *Instruction) { acks = append(acks, ins) })
+
+	allowed := NewInstruction("file", "1", "text/plain", "notes.txt").Byte()
+	assert.Equal(t, allowed, uploads.filter(allowed))
+
+	blocked := [][]byte{
+		NewInstruction("put", "0", "2", "application/octet-stream", "setup.EXE").Byte(),
+		NewInstruction("blob", "2", "AAAA").Byte(),
+		NewInstruction("end", "2").Byte(),
+	}
+	for _, ins := range blocked {
+		assert.Empty(t, uploads.filter(ins))
+	}
+	assert.Equal(t, []string{"2", "transfer blocked", guacStatusForbidden}, acks[0].Args)
+	assert.Empty(t, uploads.blocked)
+	// blobs of other streams still pass
+	blob := NewInstruction("blob", "1", "AAAA").Byte()
+	assert.Equal(t, blob, uploads.filter(blob))
+
+	// the upload rule doesn't apply to downloads, the mimetype rule does
+	downloads := newFileTransferFilter(FileDownload, ses, client, func(ins *Instruction) { acks = append(acks, ins) })
+	exe := NewInstruction("body", "0", "5", "application/octet-stream", "setup.exe").Byte()
+	assert.Equal(t, exe, downloads.filter(exe))
+	assert.Empty(t, downloads.filter(NewInstruction("file", "6", "application/zip", "a.zip").Byte()))
+	assert.Equal(t, []string{"6", "transfer blocked", guacStatusForbidden}, acks[1].Args)
+
+	listing := NewInstruction("body", "0", "7", streamIndexMimetype, "/").Byte()
+	assert.Equal(t, listing, downloads.filter(listing))
+
+	// transfers allowed by a check are used up by the streams
+	client.grantTransfers(FileDownload, 1)
+	assert.True(t, client.takeTransfer(FileDownload))
+	assert.False(t, client.takeTransfer(FileDownload))
+}
+
+type fakeWriterCloser struct {
+	fakeMessageWriter
+	Closed bool
+}
+
+func (f *fakeWriterCloser) Close() error {
+	f.Closed = true
+	return nil
+}
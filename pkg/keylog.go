@@ -0,0 +1,300 @@
+package guac
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wwt/guac/lib/settings"
+)
+
+const (
+	// keylogLineGap starts a new transcript line when typing pauses this long
+	keylogLineGap  = 5 * time.Second
+	keylogRedacted = "[REDACTED]"
+)
+
+// special keysyms, see X11 keysymdef.h
+var keysymNames = map[int]string{
+	0xff08: "BackSpace",
+	0xff09: "Tab",
+	0xff0d: "Return",
+	0xff13: "Pause",
+	0xff14: "Scroll_Lock",
+	0xff1b: "Escape",
+	0xff50: "Home",
+	0xff51: "Left",
+	0xff52: "Up",
+	0xff53: "Right",
+	0xff54: "Down",
+	0xff55: "Page_Up",
+	0xff56: "Page_Down",
+	0xff57: "End",
+	0xff61: "Print",
+	0xff63: "Insert",
+	0xff67: "Menu",
+	0xff7f: "Num_Lock",
+	0xff8d: "KP_Enter",
+	0xffe5: "Caps_Lock",
+	0xffff: "Delete",
+}
+
+// modifier keysyms and the name they are rendered with
+var keysymModifiers = map[int]string{
+	0xffe3: "Ctrl",
+	0xffe4: "Ctrl",
+	0xffe7: "Meta",
+	0xffe8: "Meta",
+	0xffe9: "Alt",
+	0xffea: "Alt",
+	0xffeb: "Win",
+	0xffec: "Win",
+	0xfe03: "AltGr",
+}
+
+// keysyms of keys which only change the following key
+var keysymIgnored = map[int]bool{
+	0xffe1: true, // Shift_L
+	0xffe2: true, // Shift_R
+}
+
+// KeystrokeLine is one line of a keystroke transcript
+type KeystrokeLine struct {
+	Time time.Time
+	Text string
+	// End is the key which ended the line, empty if typing paused
+	End string
+}
+
+// KeystrokeTranscript is the human readable keyboard input of a recording
+type KeystrokeTranscript struct {
+	Start time.Time
+	Lines []KeystrokeLine
+}
+
+// KeysymToString maps a keysym to the text it types, ok is false for keys
+// which don't type text and are rendered by name.
+func KeysymToString(keysym int) (text string, ok bool) {
+	switch {
+	case keysym >= 0x20 && keysym <= 0x7e, keysym >= 0xa0 && keysym <= 0xff:
+		// Latin-1 keysyms are the code point
+		return string(rune(keysym)), true
+	case keysym >= 0x01000100 && keysym <= 0x0110ffff:
+		// Unicode keysyms
+		r := rune(keysym - 0x01000000)
+		if utf8.ValidRune(r) {
+			return string(r), true
+		}
+	case keysym == 0xff80:
+		return " ", true
+	case keysym >= 0xffb0 && keysym <= 0xffb9:
+		return string(rune('0' + keysym - 0xffb0)), true
+	case keysym >= 0xffaa && keysym <= 0xffaf:
+		return string("*+,-./"[keysym-0xffaa]), true
+	}
+	return KeysymName(keysym), false
+}
+
+// KeysymName returns the name of a non printable key
+func KeysymName(keysym int) string {
+	if name, ok := keysymNames[keysym]; ok {
+		return name
+	}
+	if name, ok := keysymModifiers[keysym]; ok {
+		return name
+	}
+	if keysym >= 0xffbe && keysym <= 0xffe0 {
+		return fmt.Sprintf("F%d", keysym-0xffbe+1)
+	}
+	return fmt.Sprintf("0x%04x", keysym)
+}
+
+// BuildKeystrokeTranscript decodes the key instructions of a recording.
+// The time of a key is its own timestamp when guacd recorded one, or the
+// last sync before it otherwise.
+func BuildKeystrokeTranscript(recording io.Reader) (*KeystrokeTranscript, error) {
+	reader := NewRecordingReader(recording)
+	builder := keystrokeBuilder{held: map[int]bool{}}
+
+	var now time.Time
+	for {
+		ins, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// a recording cut off by a crash still has a useful transcript
+			logrus.Infof("stop reading recording for transcript: %v", err)
+			break
+		}
+		switch ins.Opcode {
+		case "sync":
+			if len(ins.Args) > 0 {
+				if ts, e := parseGuacTimestamp(ins.Args[0]); e == nil {
+					now = ts
+				}
+			}
+		case "key":
+			if len(ins.Args) < 2 {
+				continue
+			}
+			keysym, e := strconv.Atoi(ins.Args[0])
+			if e != nil {
+				continue
+			}
+			t := now
+			if len(ins.Args) > 2 {
+				if ts, e := parseGuacTimestamp(ins.Args[2]); e == nil {
+					t = ts
+				}
+			}
+			builder.key(keysym, ins.Args[1] == "1", t)
+		}
+	}
+	builder.flush("")
+	return &builder.transcript, nil
+}
+
+func parseGuacTimestamp(value string) (time.Time, error) {
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(ms), nil
+}
+
+type keystrokeBuilder struct {
+	transcript KeystrokeTranscript
+	held       map[int]bool
+	line       strings.Builder
+	lineStart  time.Time
+	last       time.Time
+	// deletable is the number of runes typed since the last rendered key, which BackSpace can delete
+	deletable int
+}
+
+func (b *keystrokeBuilder) key(keysym int, pressed bool, t time.Time) {
+	if _, ok := keysymModifiers[keysym]; ok {
+		b.held[keysym] = pressed
+		return
+	}
+	if !pressed || keysymIgnored[keysym] {
+		return
+	}
+	if b.transcript.Start.IsZero() {
+		b.transcript.Start = t
+	}
+	if b.line.Len() > 0 && t.Sub(b.last) > keylogLineGap {
+		b.flush("")
+	}
+	if b.line.Len() == 0 {
+		b.lineStart = t
+	}
+	b.last = t
+
+	text, printable := KeysymToString(keysym)
+	modifiers := b.modifiers()
+	switch {
+	case modifiers != "":
+		b.write(fmt.Sprintf("<%s+%s>", modifiers, text), false)
+	case keysym == 0xff08 && b.deletable > 0:
+		line := b.line.String()
+		_, size := utf8.DecodeLastRuneInString(line)
+		b.line.Reset()
+		b.line.WriteString(line[:len(line)-size])
+		b.deletable--
+	case keysym == 0xff0d, keysym == 0xff8d, keysym == 0xff09:
+		b.flush(text)
+	case printable:
+		b.write(text, true)
+	default:
+		b.write(fmt.Sprintf("<%s>", text), false)
+	}
+}
+
+func (b *keystrokeBuilder) modifiers() string {
+	var names []string
+	for _, keysym := range []int{0xffe3, 0xffe4, 0xffe9, 0xffea, 0xffe7, 0xffe8, 0xffeb, 0xffec} {
+		if !b.held[keysym] {
+			continue
+		}
+		name := keysymModifiers[keysym]
+		if len(names) == 0 || names[len(names)-1] != name {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, "+")
+}
+
+func (b *keystrokeBuilder) write(text string, printable bool) {
+	b.line.WriteString(text)
+	if printable {
+		b.deletable += utf8.RuneCountInString(text)
+	} else {
+		b.deletable = 0
+	}
+}
+
+func (b *keystrokeBuilder) flush(end string) {
+	if b.line.Len() == 0 && end == "" {
+		return
+	}
+	b.transcript.Lines = append(b.transcript.Lines, KeystrokeLine{
+		Time: b.lineStart,
+		Text: b.line.String(),
+		End:  end,
+	})
+	b.line.Reset()
+	b.deletable = 0
+}
+
+// Redact hides lines matching the redaction rules
+func (t *KeystrokeTranscript) Redact(rules []settings.KeylogRedactRule) {
+	for _, rule := range rules {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			logrus.Errorf("invalid keylog redact pattern %s: %v", rule.Pattern, err)
+			continue
+		}
+		for i := 0; i < len(t.Lines); i++ {
+			if !pattern.MatchString(t.Lines[i].Text) {
+				continue
+			}
+			if !rule.Next {
+				t.Lines[i].Text = keylogRedacted
+			} else if i+1 < len(t.Lines) {
+				t.Lines[i+1].Text = keylogRedacted
+				i++
+			}
+		}
+	}
+}
+
+// WriteTo writes the transcript, one line per row with the offset from the
+// start of the session, the wall clock time and the typed text.
+func (t *KeystrokeTranscript) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for _, line := range t.Lines {
+		text := line.Text
+		if line.End != "" {
+			text += fmt.Sprintf("<%s>", line.End)
+		}
+		offset := line.Time.Sub(t.Start).Truncate(time.Second)
+		n, err := fmt.Fprintf(w, "[%s] %s %s\n", formatOffset(offset), line.Time.UTC().Format(time.RFC3339), text)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func formatOffset(d time.Duration) string {
+	seconds := int(d.Seconds())
+	return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+}
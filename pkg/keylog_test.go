@@ -0,0 +1,86 @@
+package guac
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wwt/guac/lib/settings"
+)
+
+func TestKeysymToString(t *testing.T) {
+	text, ok := KeysymToString('a')
+	assert.True(t, ok)
+	assert.Equal(t, "a", text)
+
+	text, ok = KeysymToString(0x01000000 + '中')
+	assert.True(t, ok)
+	assert.Equal(t, "中", text)
+
+	text, ok = KeysymToString(0xffb7)
+	assert.True(t, ok)
+	assert.Equal(t, "7", text)
+
+	text, ok = KeysymToString(0xffc0)
+	assert.False(t, ok)
+	assert.Equal(t, "F3", text)
+}
+
+func TestBuildKeystrokeTranscript(t *testing.T) {
+	recording := strings.Join([]string{
+		"4.sync,13.1700000000000;",
+		"3.key,3.117,1.1,13.1700000000100;", // u
+		"3.key,3.117,1.0,13.1700000000150;",
+		"3.key,3.115,1.1,13.1700000000200;",   // s
+		"3.key,3.120,1.1,13.1700000000250;",   // x
+		"3.key,5.65288,1.1,13.1700000000300;", // BackSpace
+		"3.key,3.101,1.1,13.1700000000350;",   // e
+		"3.key,3.114,1.1,13.1700000000400;",   // r
+		"3.key,5.65289,1.1,13.1700000000500;", // Tab
+		"3.key,3.112,1.1,13.1700000000600;",   // p
+		"3.key,3.119,1.1,13.1700000000700;",   // w
+		"3.key,5.65293,1.1,13.1700000000800;", // Return
+		"4.sync,13.1700000010000;",
+		"3.key,5.65507,1.1;", // Control_L
+		"3.key,2.99,1.1;",    // c
+		"3.key,5.65507,1.0;",
+		"4.size,1.0,4.1024",
+	}, "")
+
+	transcript, err := BuildKeystrokeTranscript(strings.NewReader(recording))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(transcript.Lines))
+	assert.Equal(t, "user", transcript.Lines[0].Text)
+	assert.Equal(t, "Tab", transcript.Lines[0].End)
+	assert.Equal(t, "pw", transcript.Lines[1].Text)
+	assert.Equal(t, "<Ctrl+c>", transcript.Lines[2].Text)
+
+	transcript.Redact([]settings.KeylogRedactRule{{Pattern: "^user$", Next: true}})
+	assert.Equal(t, "user", transcript.Lines[0].Text)
+	assert.Equal(t, keylogRedacted, transcript.Lines[1].Text)
+
+	var out bytes.Buffer
+	_, err = transcript.WriteTo(&out)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, "[00:00:00] 2023-11-14T22:13:20Z user<Tab>", lines[0])
+	assert.Equal(t, "[00:00:09] 2023-11-14T22:13:30Z <Ctrl+c>", lines[2])
+}
+
+func TestKeystrokeBackSpace(t *testing.T) {
+	builder := keystrokeBuilder{held: map[int]bool{}}
+	at := time.UnixMilli(1700000000000)
+	builder.key('a', true, at)
+	builder.key('b', true, at)
+	builder.key(0xffe3, true, at) // Control_L
+	builder.key('c', true, at)
+	builder.key(0xffe3, false, at)
+	builder.key('x', true, at)
+	// the rendered key can't be deleted, the BackSpace is kept instead
+	builder.key(0xff08, true, at)
+	builder.key(0xff08, true, at)
+	builder.flush("")
+	assert.Equal(t, "ab<Ctrl+c><BackSpace>", builder.transcript.Lines[0].Text)
+}
@@ -0,0 +1,185 @@
+package guac
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wwt/guac/lib/settings"
+	"github.com/wwt/guac/pkg/session"
+)
+
+const (
+	// maskMaxHold caps the images held to be masked
+	maskMaxHold = 16 * 1024 * 1024
+	// maskBlobSize is the size of the decoded data of a rewritten blob, as guacd sends them
+	maskBlobSize = 6048
+	// maskCompositeOver is the OVER channel mask of the guacamole drawing instructions
+	maskCompositeOver = "14"
+)
+
+var (
+	imgOpcodeIns  = []byte("3.img,")
+	syncOpcodeIns = []byte("4.sync,")
+)
+
+// maskFilter hides the masked regions of the display from a participant other
+// than the host. The images drawn to the default layer are held until complete
+// and the masked regions blacked out, and the regions are filled before every
+// frame is shown, which covers what is copied from the buffers of guacd.
+type maskFilter struct {
+	ses    *session.SessionCommonData
+	client *RdpClient
+	// room has the masks of the host, nil if the session has no room
+	room *RdpSessionRoom
+
+	// stream is the image being held, its img instruction and data
+	stream  string
+	img     *Instruction
+	held    []byte
+	data    []byte
+	dropped bool
+}
+
+func newMaskFilter(ses *session.SessionCommonData, client *RdpClient) *maskFilter {
+	f := &maskFilter{ses: ses, client: client}
+	if ses != nil {
+		f.room, _ = lookupRdpSessionRoom(ses.RdpSessionId)
+	}
+	return f
+}
+
+// regions returns the masks of the app and of the host, none for the host
+func (f *maskFilter) regions() []settings.MaskRegion {
+	if f.ses == nil || f.client == nil || f.client.Role == ROLE_ADMIN {
+		return nil
+	}
+	regions := settings.Masks(f.ses.TenantID, f.ses.AppID).Regions
+	if f.room != nil {
+		regions = append(append([]settings.MaskRegion{}, regions...), f.room.Masks()...)
+	}
+	return regions
+}
+
+// filter returns the instructions to forward in place of ins, nothing while an image is held
+func (f *maskFilter) filter(ins []byte) []byte {
+	if f == nil || len(ins) == 0 {
+		return ins
+	}
+	switch {
+	case bytes.HasPrefix(ins, syncOpcodeIns):
+		return f.cover(ins)
+	case bytes.HasPrefix(ins, imgOpcodeIns):
+		return f.start(ins)
+	case f.stream == "" || !(bytes.HasPrefix(ins, blobOpcodeIns) || bytes.HasPrefix(ins, endOpcodeIns)):
+		return ins
+	}
+	instruction, err := Parse(ins)
+	if err != nil || len(instruction.Args) == 0 || instruction.Args[0] != f.stream {
+		return ins
+	}
+	if instruction.Opcode == "end" {
+		return f.finish(ins)
+	}
+	if f.dropped || len(instruction.Args) < 2 {
+		return nil
+	}
+	data, err := base64.StdEncoding.DecodeString(instruction.Args[1])
+	if err != nil || len(f.data)+len(data) > maskMaxHold {
+		logrus.Errorf("cannot hold image %s to mask it, drop it", f.stream)
+		f.dropped = true
+		return nil
+	}
+	f.held = append(f.held, ins...)
+	f.data = append(f.data, data...)
+	return nil
+}
+
+// start holds img,<stream>,<mask>,<layer>,<mimetype>,<x>,<y> if it's drawn to the default layer
+func (f *maskFilter) start(ins []byte) []byte {
+	f.stream = ""
+	regions := f.regions()
+	if len(regions) == 0 {
+		return ins
+	}
+	instruction, err := Parse(ins)
+	if err != nil || len(instruction.Args) < 6 || instruction.Args[2] != "0" {
+		return ins
+	}
+	f.stream = instruction.Args[0]
+	f.img = instruction
+	f.held = append(f.held[:0], ins...)
+	f.data = f.data[:0]
+	f.dropped = false
+	return nil
+}
+
+func (f *maskFilter) finish(end []byte) []byte {
+	stream := f.stream
+	f.stream = ""
+	if f.dropped {
+		return nil
+	}
+	x, errX := strconv.Atoi(f.img.Args[4])
+	y, errY := strconv.Atoi(f.img.Args[5])
+	src, _, err := image.Decode(bytes.NewReader(f.data))
+	if err != nil || errX != nil || errY != nil {
+		// e.g. webp, which can't be masked
+		logrus.Errorf("cannot decode %s image to mask it, drop it: %v", f.img.Args[3], err)
+		return nil
+	}
+
+	bounds := src.Bounds()
+	var masked *image.RGBA
+	for _, region := range f.regions() {
+		r := image.Rect(region.X-x, region.Y-y, region.X-x+region.Width, region.Y-y+region.Height).Add(bounds.Min).Intersect(bounds)
+		if r.Empty() {
+			continue
+		}
+		if masked == nil {
+			masked = image.NewRGBA(bounds)
+			draw.Draw(masked, bounds, src, bounds.Min, draw.Src)
+		}
+		draw.Draw(masked, r, image.Black, image.Point{}, draw.Src)
+	}
+	if masked == nil {
+		return append(append([]byte{}, f.held...), end...)
+	}
+
+	var encoded bytes.Buffer
+	if err = png.Encode(&encoded, masked); err != nil {
+		logrus.Errorf("cannot encode masked image, drop it: %v", err)
+		return nil
+	}
+	out := NewInstruction("img", stream, f.img.Args[1], "0", "image/png", f.img.Args[4], f.img.Args[5]).Byte()
+	content := encoded.Bytes()
+	for len(content) > 0 {
+		n := len(content)
+		if n > maskBlobSize {
+			n = maskBlobSize
+		}
+		out = append(out, NewInstruction("blob", stream, base64.StdEncoding.EncodeToString(content[:n])).Byte()...)
+		content = content[n:]
+	}
+	return append(out, end...)
+}
+
+// cover fills the masked regions of the default layer before the frame is shown
+func (f *maskFilter) cover(sync []byte) []byte {
+	regions := f.regions()
+	if len(regions) == 0 {
+		return sync
+	}
+	var out []byte
+	for _, region := range regions {
+		out = append(out, NewInstruction("rect", "0",
+			strconv.Itoa(region.X), strconv.Itoa(region.Y), strconv.Itoa(region.Width), strconv.Itoa(region.Height)).Byte()...)
+		out = append(out, NewInstruction("cfill", maskCompositeOver, "0", "0", "0", "0", "255").Byte()...)
+	}
+	return append(out, sync...)
+}
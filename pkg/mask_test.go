@@ -0,0 +1,98 @@
+package guac
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wwt/guac/lib/logging"
+	"github.com/wwt/guac/lib/settings"
+	"github.com/wwt/guac/pkg/session"
+)
+
+func TestMaskFilter(t *testing.T) {
+	s := settings.Defaults()
+	s.Default.Masks = &settings.MaskSettings{Regions: []settings.MaskRegion{{X: 10, Y: 10, Width: 5, Height: 5}}}
+	settings.Set(s)
+	defer settings.Set(settings.Defaults())
+
+	ses := &session.SessionCommonData{TenantID: "t1", AppID: "a1", Email: "host@appaegis.com", RdpSessionId: "mask-session"}
+	host := NewRdpSessionRoom(ses.RdpSessionId, "host@appaegis.com", &fakeWriterCloser{}, "c1", true, "a1", "app", logging.LoggingInfo{})
+	room, _ := GetRdpSessionRoom(ses.RdpSessionId)
+	defer delete(rdpRooms, ses.RdpSessionId)
+	viewer := room.join("viewer@appaegis.com", &fakeWriterCloser{}, "")
+
+	src := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for i := range src.Pix {
+		src.Pix[i] = 0xff
+	}
+	var encoded bytes.Buffer
+	assert.Nil(t, png.Encode(&encoded, src))
+	// the image at 8,8 overlaps the mask from 2,2
+	img := [][]byte{
+		NewInstruction("img", "1", "14", "0", "image/png", "8", "8").Byte(),
+		NewInstruction("blob", "1", base64.StdEncoding.EncodeToString(encoded.Bytes())).Byte(),
+		NewInstruction("end", "1").Byte(),
+	}
+	sync := NewInstruction("sync", "1234", "0").Byte()
+	run := func(f *maskFilter, instructions ...[]byte) []byte {
+		var out []byte
+		for _, ins := range instructions {
+			out = append(out, f.filter(ins)...)
+		}
+		return out
+	}
+
+	// the host sees everything
+	out := run(newMaskFilter(ses, host), append(img, sync)...)
+	assert.Equal(t, string(bytes.Join(append(img, sync), nil)), string(out))
+
+	masks := newMaskFilter(ses, viewer)
+	assert.Empty(t, run(masks, img[:2]...))
+	out = masks.filter(img[2])
+	stream := NewStream(&fakeConn{ToRead: out}, time.Minute)
+	var data []byte
+	for {
+		ins, err := stream.ReadSome()
+		if err != nil {
+			break
+		}
+		instruction, _ := Parse(ins)
+		if instruction.Opcode == "img" {
+			assert.Equal(t, []string{"1", "14", "0", "image/png", "8", "8"}, instruction.Args)
+		}
+		if instruction.Opcode == "blob" {
+			blob, _ := base64.StdEncoding.DecodeString(instruction.Args[1])
+			data = append(data, blob...)
+		}
+	}
+	masked, err := png.Decode(bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, color.RGBAModel.Convert(color.Black), color.RGBAModel.Convert(masked.At(2, 2)))
+	assert.Equal(t, color.RGBAModel.Convert(color.Black), color.RGBAModel.Convert(masked.At(6, 6)))
+	assert.Equal(t, color.RGBAModel.Convert(color.White), color.RGBAModel.Convert(masked.At(1, 1)))
+
+	// images of other layers pass, the frame covers the masks of the app and of the host
+	buffer := NewInstruction("img", "2", "14", "-1", "image/png", "0", "0").Byte()
+	assert.Equal(t, buffer, masks.filter(buffer))
+	room.SetMasks([]settings.MaskRegion{{X: 0, Y: 0, Width: 100, Height: 20}})
+	cover := NewInstruction("rect", "0", "10", "10", "5", "5").String() +
+		NewInstruction("cfill", "14", "0", "0", "0", "0", "255").String() +
+		NewInstruction("rect", "0", "0", "0", "100", "20").String() +
+		NewInstruction("cfill", "14", "0", "0", "0", "0", "255").String()
+	assert.Equal(t, cover+string(sync), string(masks.filter(sync)))
+
+	// masked participants can't change the masks
+	resp := SetMasksCommand{}.Exec(NewInstruction(APPAEGIS_OP, "r1", SET_MASKS, "[]"), ses, viewer)
+	assert.Equal(t, `{"status":"403"}`, resp.Args[1])
+	resp = SetMasksCommand{}.Exec(NewInstruction(APPAEGIS_OP, "r1", SET_MASKS, "[]"), ses, &RdpClient{UserId: "cohost@appaegis.com", Role: ROLE_CO_HOST})
+	assert.Equal(t, `{"status":"403"}`, resp.Args[1])
+	resp = SetMasksCommand{}.Exec(NewInstruction(APPAEGIS_OP, "r1", SET_MASKS, "[]"), ses, host)
+	assert.Equal(t, `{"status":"200"}`, resp.Args[1])
+	assert.Empty(t, room.Masks())
+}
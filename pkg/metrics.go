@@ -58,6 +58,83 @@ var (
 	requestsDur = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Name: "http_requests_dur",
 	}, []string{"url", "method"})
+
+	policySubscriberConnected = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "policy_subscriber_connected",
+		Help: "1 while the policy event subscriber is connected",
+	})
+
+	policySubscriberReconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "policy_subscriber_reconnects",
+		Help: "The number of times the policy event subscriber lost or failed its connection",
+	})
+
+	policyEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "policy_events",
+		Help: "The number of policy events received",
+	}, []string{"type"})
+
+	trafficBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rdp_traffic_bytes",
+		Help: "The bytes relayed between the clients and guacd by tenant, direction and opcode class",
+	}, []string{"tenantId", "direction", "class"})
+
+	trafficInstructions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rdp_traffic_instructions",
+		Help: "The instructions relayed between the clients and guacd by tenant, direction and opcode class",
+	}, []string{"tenantId", "direction", "class"})
+
+	sessionTrafficBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rdp_session_traffic_bytes",
+		Help: "The bytes relayed in an open session by direction and opcode class",
+	}, []string{"sessionId", "tenantId", "direction", "class"})
+
+	sessionTrafficInstructions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rdp_session_traffic_instructions",
+		Help: "The instructions relayed in an open session by direction and opcode class",
+	}, []string{"sessionId", "tenantId", "direction", "class"})
+
+	syncRoundTrip = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rdp_sync_round_trip_seconds",
+		Help:    "The time from relaying a sync to a client of an open session to its echo",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 10),
+	}, []string{"sessionId", "tenantId"})
+
+	frameLag = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rdp_frame_lag_seconds",
+		Help:    "How far the frame a client of an open session rendered is behind the frames relayed to it",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 10),
+	}, []string{"sessionId", "tenantId"})
+
+	slowSessions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rdp_slow_sessions",
+		Help: "The number of times a participant of a session was flagged as slow",
+	}, []string{"tenantId"})
+
+	fanOutViewers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rdp_fanout_viewers",
+		Help: "The viewers relayed the guacd connection of the host",
+	}, []string{"tenantId"})
+
+	leaves = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rdp_leaves",
+		Help: "The participants leaving rooms by reason",
+	}, []string{"tenantId", "reason"})
+
+	rejectedOrigins = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rdp_websocket_rejected_origins",
+		Help: "The websocket upgrades rejected as their origin isn't allowed",
+	})
+
+	wsOverflows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rdp_websocket_overflows",
+		Help: "The display not queued to websockets as their queue was full, by overflow policy",
+	}, []string{"tenantId", "policy"})
+
+	fanOutOverruns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rdp_fanout_overruns",
+		Help: "The viewers disconnected as their queue of the guacd connection of the host overran",
+	}, []string{"tenantId"})
 )
 
 func WithMetrics(fn func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
@@ -88,3 +165,27 @@ func RecordHttpRequest(url, method string, status int) {
 func RecordHttpRequestDur(url, method string, duration float64) {
 	requestsDur.WithLabelValues(url, method).Observe(duration)
 }
+
+func setPolicySubscriberConnected(connected bool) {
+	if connected {
+		policySubscriberConnected.Set(1)
+	} else {
+		policySubscriberConnected.Set(0)
+	}
+}
+
+func incPolicySubscriberReconnects() {
+	policySubscriberReconnects.Inc()
+}
+
+func incLeaves(tenantId, reason string) {
+	leaves.WithLabelValues(tenantId, reason).Inc()
+}
+
+func incSlowSessions(tenantId string) {
+	slowSessions.WithLabelValues(tenantId).Inc()
+}
+
+func incPolicyEvents(t PolicyEventType) {
+	policyEvents.WithLabelValues(string(t)).Inc()
+}
@@ -0,0 +1,80 @@
+package guac
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/appaegis/golang-common/pkg/config"
+	"github.com/sirupsen/logrus"
+	"github.com/wwt/guac/lib/settings"
+)
+
+// checkOrigin allows the upgrade of a request from a page of an allowed origin, the
+// appauthz cookie is sent whichever page opens the websocket. Requests without an
+// Origin aren't from a browser, which is what the cookie could be hijacked by. The
+// allowed origins are the same for all tenants, as the tenant of the request isn't
+// authenticated yet.
+func checkOrigin(r *http.Request) bool {
+	header := r.Header.Get("Origin")
+	if header == "" {
+		return true
+	}
+	origin, err := url.Parse(header)
+	if err == nil && originAllowed(origin, r.Host) {
+		return true
+	}
+	query := r.URL.Query()
+	logrus.Warnf("reject websocket of %s for tenant %s, app %s, from origin %s", query.Get("userId"), query.Get("tenantId"), query.Get("appId"), header)
+	rejectedOrigins.Inc()
+	return false
+}
+
+// originAllowed returns if the pages of origin may open the websocket of host, the
+// portals of the tenants are allowed with the portal
+func originAllowed(origin *url.URL, host string) bool {
+	if origin.Host == "" {
+		return false
+	}
+	if strings.EqualFold(origin.Host, host) {
+		return true
+	}
+	cfg := settings.Origins()
+	for _, pattern := range cfg.Allowed {
+		if matchOrigin(pattern, origin) {
+			return true
+		}
+	}
+	portal := config.GetPortalHostName()
+	if !cfg.Portal || portal == "" {
+		return false
+	}
+	if matchOrigin("https://"+portal, origin) {
+		return true
+	}
+	// the portal of a tenant is named by its IdP domain in the domain of the portal,
+	// see tenantPortal, so the origin names the portal without a lookup
+	_, suffix, _ := strings.Cut(portal, ".")
+	if suffix == "" || !strings.EqualFold(origin.Scheme, "https") {
+		return false
+	}
+	idpDomain, ok := strings.CutSuffix(strings.ToLower(origin.Host), "."+strings.ToLower(suffix))
+	return ok && idpDomain != "" && !strings.Contains(idpDomain, ".")
+}
+
+// matchOrigin returns if origin is of pattern, a host such as app.example.com or
+// *.example.com for its subdomains, optionally with a scheme
+func matchOrigin(pattern string, origin *url.URL) bool {
+	if scheme, host, ok := strings.Cut(pattern, "://"); ok {
+		if !strings.EqualFold(scheme, origin.Scheme) {
+			return false
+		}
+		pattern = host
+	}
+	host := strings.ToLower(origin.Host)
+	pattern = strings.ToLower(pattern)
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
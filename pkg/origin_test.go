@@ -0,0 +1,72 @@
+package guac
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/appaegis/golang-common/pkg/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/wwt/guac/lib/settings"
+	"github.com/wwt/guac/mocks"
+)
+
+func TestMatchOrigin(t *testing.T) {
+	parse := func(origin string) *url.URL {
+		u, err := url.Parse(origin)
+		assert.Nil(t, err)
+		return u
+	}
+	assert.True(t, matchOrigin("app.example.com", parse("https://App.Example.com")))
+	assert.True(t, matchOrigin("https://app.example.com", parse("https://app.example.com")))
+	assert.False(t, matchOrigin("https://app.example.com", parse("http://app.example.com")))
+	assert.False(t, matchOrigin("app.example.com", parse("https://app.example.com.evil.com")))
+	assert.True(t, matchOrigin("*.example.com", parse("https://tenant.example.com")))
+	assert.True(t, matchOrigin("*.example.com", parse("https://a.tenant.example.com")))
+	assert.False(t, matchOrigin("*.example.com", parse("https://example.com")))
+	assert.False(t, matchOrigin("*.example.com", parse("https://evilexample.com")))
+	assert.True(t, matchOrigin("app.example.com:8443", parse("https://app.example.com:8443")))
+}
+
+func TestCheckOrigin(t *testing.T) {
+	s := settings.Defaults()
+	s.Origins = &settings.OriginSettings{Allowed: []string{"*.example.com"}, Portal: true}
+	settings.Set(s)
+	defer settings.Set(settings.Defaults())
+
+	config.AddConfig(config.PORTAL_HOSTNAME, "dev.appaegistest.com")
+	db := new(mocks.DbAccess)
+	dbAccess = db // inject mock
+	defer func() { dbAccess = DynamodbAccess{} }()
+
+	request := func(origin, tenantId string) bool {
+		r := httptest.NewRequest("GET", "http://guac.internal/websocket-tunnel?tenantId="+tenantId+"&appId=a1", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		return checkOrigin(r)
+	}
+	rejected := testutil.ToFloat64(rejectedOrigins)
+
+	// not from a browser
+	assert.True(t, request("", "origin-tenant"))
+	// the page is served with the websocket
+	assert.True(t, request("http://guac.internal", "other-tenant"))
+	// the allowed origins don't depend on the tenant named by the request
+	assert.True(t, request("https://portal.example.com", "origin-tenant"))
+	assert.True(t, request("https://portal.example.com", "other-tenant"))
+	assert.False(t, request("https://evil.com", "origin-tenant"))
+	assert.False(t, request("null", "origin-tenant"))
+	// the portals share the session, the portal of any tenant is allowed
+	assert.True(t, request("https://dev.appaegistest.com", "other-tenant"))
+	assert.True(t, request("https://kchung.appaegistest.com", "origin-tenant"))
+	assert.True(t, request("https://kchung.appaegistest.com", "other-tenant"))
+	assert.False(t, request("http://kchung.appaegistest.com", "origin-tenant"))
+	assert.False(t, request("https://a.kchung.appaegistest.com", "origin-tenant"))
+
+	assert.Equal(t, rejected+4, testutil.ToFloat64(rejectedOrigins))
+	// the portals of the tenants are known without looking the tenants up
+	db.AssertNotCalled(t, "GetTenantById", mock.Anything)
+}
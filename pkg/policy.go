@@ -0,0 +1,117 @@
+package guac
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/wwt/guac/lib/logging"
+	"github.com/wwt/guac/pkg/session"
+)
+
+// Allowed returns if the policy of the app grants the user an action such as copy
+// or paste, everything is allowed until the policy was evaluated as they connected
+func (c *RdpClient) Allowed(action string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.actions == nil {
+		return true
+	}
+	for _, a := range c.actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// setActions updates what the policy grants the user, nil actions are a failed
+// lookup which keeps the current grant. It returns true if a grant of some actions
+// became one of none, which revokes their access.
+func (c *RdpClient) setActions(actions []string) bool {
+	if actions == nil {
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	revoked := len(c.actions) > 0 && len(actions) == 0
+	c.actions = append([]string{}, actions...)
+	return revoked
+}
+
+// reevaluatePolicy applies the current policy of the app to the session of a
+// participant, as they connect and whenever it changes. The participants are granted
+// what the host is, as they act on the connection of the host. The clipboard filters
+// follow the granted actions, the monitor rules of the session are refreshed for the
+// host, and a participant whose access was revoked is disconnected, which ends the
+// session for the host. The disable-copy and disable-paste parameters of guacd are
+// fixed at connect, so a policy can only restrict the clipboard further during the
+// session.
+func reevaluatePolicy(ses *session.SessionCommonData, client *RdpClient) {
+	if ses == nil || client == nil {
+		return
+	}
+	actions := dbAccess.QueryPolicyByAstraea(ses.AppID, ses.Email).Actions
+	revoked := client.setActions(actions)
+	logrus.Infof("policy of %s in session %s of %s: %v, revoked %v", client.UserId, ses.RdpSessionId, ses.Email, actions, revoked)
+
+	if client.Role == ROLE_ADMIN {
+		refreshMonitorRules(ses)
+	}
+	if !revoked {
+		return
+	}
+	logging.Log(logging.Action{
+		Session:         ses,
+		AppTag:          "rdp.revoked",
+		UserEmail:       client.UserId,
+		ClientIP:        ses.ClientIP,
+		ClientPrivateIp: ses.ClientPrivateIp,
+		Destination:     ses.ServerName,
+		Reason:          "access revoked",
+	})
+	if client.Role == ROLE_ADMIN {
+		if room, ok := lookupRdpSessionRoom(ses.RdpSessionId); ok {
+			room.disconnect()
+			return
+		}
+	}
+	if e := client.Websocket.Close(); e != nil {
+		logrus.Errorf("close %s ws failed %v", client.UserId, e)
+	}
+}
+
+// refreshMonitorRules reloads the monitor policy of the app for the host
+func refreshMonitorRules(ses *session.SessionCommonData) {
+	app := dbAccess.QueryResource(ses.AppID)
+	if app == nil {
+		return
+	}
+	if app.MonitorPolicyEntryId == "" {
+		ses.SetMonitor(session.MonitorPolicy{})
+		return
+	}
+	monitorPolicy := dbAccess.QueryMonitorPolicyEntryById(app.MonitorPolicyEntryId)
+	ses.SetMonitor(session.MonitorPolicy{
+		Id:    monitorPolicy.ID,
+		Name:  monitorPolicy.Name,
+		Rules: dbAccess.QueryMonitorRuleForUser(monitorPolicy.ID, ses.Email),
+	})
+}
+
+// AppsWithMonitorPolicy returns the apps of the sessions using one of the monitor policies
+func AppsWithMonitorPolicy(monitorPolicyIds []string) []string {
+	SessionDataStore.RLock()
+	defer SessionDataStore.RUnlock()
+	var apps []string
+	for _, data := range SessionDataStore.Data {
+		ses, ok := data.(*session.SessionCommonData)
+		if !ok {
+			continue
+		}
+		for _, id := range monitorPolicyIds {
+			if ses.Monitor().Id == id {
+				apps = append(apps, ses.AppID)
+				break
+			}
+		}
+	}
+	return apps
+}
@@ -0,0 +1,184 @@
+package guac
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// PolicyEventType is the kind of object a policy management event is about
+type PolicyEventType string
+
+const (
+	PolicyEventPolicy        PolicyEventType = "policy"
+	PolicyEventMonitorPolicy PolicyEventType = "monitorPolicy"
+	PolicyEventApp           PolicyEventType = "app"
+	PolicyEventUser          PolicyEventType = "user"
+	PolicyEventUnknown       PolicyEventType = "unknown"
+)
+
+// policyEventTypes maps the type names of policy management, lower cased, to event types
+var policyEventTypes = map[string]PolicyEventType{
+	"policy":         PolicyEventPolicy,
+	"policyentry":    PolicyEventPolicy,
+	"monitorpolicy":  PolicyEventMonitorPolicy,
+	"monitor_policy": PolicyEventMonitorPolicy,
+	"app":            PolicyEventApp,
+	"resource":       PolicyEventApp,
+	"user":           PolicyEventUser,
+	"userentry":      PolicyEventUser,
+}
+
+// ParsePolicyEventType returns the event type of a type name, PolicyEventUnknown if it's not known
+func ParsePolicyEventType(typeName string) PolicyEventType {
+	if t, ok := policyEventTypes[strings.ToLower(typeName)]; ok {
+		return t
+	}
+	return PolicyEventUnknown
+}
+
+// PolicyEvent is a change of the objects with IDs
+type PolicyEvent struct {
+	Type     PolicyEventType
+	TypeName string
+	IDs      []string
+}
+
+type policyNotifyEvent struct {
+	TypeName string   `json:"typeName"`
+	IDs      []string `json:"ids"`
+}
+
+type policyNotifyRequest struct {
+	Events []policyNotifyEvent `json:"events"`
+}
+
+// PolicySubscriber receives the change events of policy management over a websocket.
+// It reconnects with exponential backoff, detects dead connections with ping/pong
+// and dispatches the events by type to the handlers registered before Run.
+type PolicySubscriber struct {
+	URL    string
+	Dialer *websocket.Dialer
+	// MinBackoff and MaxBackoff bound the delay between connection attempts
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// PingInterval is how often a ping is sent, the connection is dropped when no pong
+	// or message arrived within PongTimeout after it
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+
+	handlers map[PolicyEventType][]func(PolicyEvent)
+}
+
+// NewPolicySubscriber returns a subscriber of the websocket at url
+func NewPolicySubscriber(url string) *PolicySubscriber {
+	return &PolicySubscriber{
+		URL:          url,
+		Dialer:       websocket.DefaultDialer,
+		MinBackoff:   time.Second,
+		MaxBackoff:   time.Minute,
+		PingInterval: 30 * time.Second,
+		PongTimeout:  10 * time.Second,
+		handlers:     map[PolicyEventType][]func(PolicyEvent){},
+	}
+}
+
+// Handle registers a handler of the events of a type, PolicyEventUnknown gets the
+// events of types which aren't known
+func (s *PolicySubscriber) Handle(t PolicyEventType, handler func(PolicyEvent)) {
+	s.handlers[t] = append(s.handlers[t], handler)
+}
+
+// Run connects and dispatches events until ctx is done
+func (s *PolicySubscriber) Run(ctx context.Context) {
+	backoff := s.MinBackoff
+	for ctx.Err() == nil {
+		logrus.Infof("policy subscriber connecting to %s", s.URL)
+		conn, _, err := s.Dialer.DialContext(ctx, s.URL, nil)
+		if err == nil {
+			backoff = s.MinBackoff
+			setPolicySubscriberConnected(true)
+			err = s.serve(ctx, conn)
+			setPolicySubscriberConnected(false)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		// the jitter keeps the guac instances from reconnecting together
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		logrus.Errorf("policy subscriber disconnected: %v, reconnect in %v", err, delay)
+		incPolicySubscriberReconnects()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if backoff *= 2; backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+	}
+}
+
+// serve reads the events of a connection until it fails
+func (s *PolicySubscriber) serve(ctx context.Context, conn *websocket.Conn) error {
+	deadline := func() time.Time { return time.Now().Add(s.PingInterval + s.PongTimeout) }
+	_ = conn.SetReadDeadline(deadline())
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(deadline())
+	})
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(s.PingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				// unblocks the read of the connection
+				conn.Close()
+				return
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.PongTimeout)); err != nil {
+					logrus.Errorf("policy subscriber ping failed %v", err)
+				}
+			}
+		}
+	}()
+	defer func() {
+		close(done)
+		wg.Wait()
+		conn.Close()
+	}()
+
+	for {
+		request := policyNotifyRequest{}
+		if err := conn.ReadJSON(&request); err != nil {
+			return err
+		}
+		_ = conn.SetReadDeadline(deadline())
+		for _, e := range request.Events {
+			s.dispatch(PolicyEvent{Type: ParsePolicyEventType(e.TypeName), TypeName: e.TypeName, IDs: e.IDs})
+		}
+	}
+}
+
+func (s *PolicySubscriber) dispatch(event PolicyEvent) {
+	incPolicyEvents(event.Type)
+	handlers := s.handlers[event.Type]
+	if len(handlers) == 0 {
+		logrus.Debugf("no handler of policy event %s", event.TypeName)
+	}
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
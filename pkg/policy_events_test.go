@@ -0,0 +1,88 @@
+package guac
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePolicyEventType(t *testing.T) {
+	assert.Equal(t, PolicyEventMonitorPolicy, ParsePolicyEventType("MonitorPolicy"))
+	assert.Equal(t, PolicyEventApp, ParsePolicyEventType("resource"))
+	assert.Equal(t, PolicyEventUnknown, ParsePolicyEventType("tenant"))
+}
+
+func TestPolicySubscriber(t *testing.T) {
+	// a local policy management server, which drops the first connection after an event
+	var connections atomic.Int32
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if connections.Add(1) == 1 {
+			_ = conn.WriteJSON(policyNotifyRequest{Events: []policyNotifyEvent{{TypeName: "policy", IDs: []string{"a1"}}}})
+			return
+		}
+		_ = conn.WriteJSON(policyNotifyRequest{Events: []policyNotifyEvent{
+			{TypeName: "user", IDs: []string{"u1", "u2"}},
+			{TypeName: "tenant", IDs: []string{"t1"}},
+		}})
+		// answers the pings of the subscriber until it goes away
+		for {
+			if _, _, err = conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	subscriber := NewPolicySubscriber("ws" + strings.TrimPrefix(server.URL, "http"))
+	subscriber.MinBackoff = 10 * time.Millisecond
+	subscriber.PingInterval = 20 * time.Millisecond
+	subscriber.PongTimeout = 50 * time.Millisecond
+	events := make(chan PolicyEvent, 10)
+	for _, eventType := range []PolicyEventType{PolicyEventPolicy, PolicyEventUser, PolicyEventUnknown} {
+		subscriber.Handle(eventType, func(event PolicyEvent) { events <- event })
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		subscriber.Run(ctx)
+		close(stopped)
+	}()
+
+	expected := []PolicyEvent{
+		{Type: PolicyEventPolicy, TypeName: "policy", IDs: []string{"a1"}},
+		{Type: PolicyEventUser, TypeName: "user", IDs: []string{"u1", "u2"}},
+		{Type: PolicyEventUnknown, TypeName: "tenant", IDs: []string{"t1"}},
+	}
+	for _, e := range expected {
+		select {
+		case event := <-events:
+			assert.Equal(t, e, event)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no policy event")
+		}
+	}
+
+	// the heartbeat keeps the connection
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, int32(2), connections.Load())
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscriber didn't stop")
+	}
+}
@@ -0,0 +1,75 @@
+package guac
+
+import (
+	"testing"
+
+	"github.com/appaegis/golang-common/pkg/db_data/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/wwt/guac/lib/logging"
+	"github.com/wwt/guac/mocks"
+	"github.com/wwt/guac/pkg/session"
+)
+
+func TestReevaluatePolicy(t *testing.T) {
+	db := new(mocks.DbAccess)
+	dbAccess = db
+	defer func() { dbAccess = DynamodbAccess{} }()
+	db.On("QueryResource", "a1").Return(&schema.Resource{MonitorPolicyEntryId: "m1"})
+	db.On("QueryMonitorPolicyEntryById", "m1").Return(schema.MonitorPolicyEntry{ID: "m1", Name: "monitor"})
+	db.On("QueryMonitorRuleForUser", "m1", "host@appaegis.com").Return(map[string]*schema.MonitorPolicyRule{"upload": {}})
+
+	ses := &session.SessionCommonData{TenantID: "t1", AppID: "a1", Email: "host@appaegis.com", RdpSessionId: "policy-session"}
+	ws := &fakeWriterCloser{}
+	host := NewRdpSessionRoom(ses.RdpSessionId, ses.Email, ws, "c1", true, "a1", "app", logging.LoggingInfo{})
+	defer delete(rdpRooms, ses.RdpSessionId)
+	assert.True(t, host.Allowed("paste"))
+
+	policy := db.On("QueryPolicyByAstraea", "a1", "host@appaegis.com").Return(schema.PolicyEntry{Actions: []string{"copy"}})
+	reevaluatePolicy(ses, host)
+	assert.True(t, host.Allowed("copy"))
+	assert.False(t, host.Allowed("paste"))
+	assert.Equal(t, "monitor", ses.Monitor().Name)
+	assert.Equal(t, 1, len(ses.Monitor().Rules))
+	assert.False(t, ws.Closed)
+
+	// pastes are dropped once the policy denies them
+	paste := newClipboardFilter(ClipboardPaste, ses, host.UserId, host.WriteMessage)
+	paste.allowed = func() bool { return host.Allowed("paste") }
+	for _, ins := range clipboardStream("1", "some text") {
+		assert.Empty(t, paste.filter(ins))
+	}
+	assert.Equal(t, NewInstruction(CLIPBOARD_VERDICT, ClipboardPaste, "block", "Denied by policy").Byte(), ws.Messages[0])
+
+	// a failed lookup keeps the grant
+	policy.Unset()
+	lookup := db.On("QueryPolicyByAstraea", "a1", "host@appaegis.com").Return(schema.PolicyEntry{})
+	reevaluatePolicy(ses, host)
+	assert.True(t, host.Allowed("copy"))
+	assert.False(t, ws.Closed)
+
+	// the session ends when the access is revoked
+	lookup.Unset()
+	db.On("QueryPolicyByAstraea", "a1", "host@appaegis.com").Return(schema.PolicyEntry{Actions: []string{}})
+	reevaluatePolicy(ses, host)
+	assert.True(t, ws.Closed)
+}
+
+func TestReevaluatePolicyOfViewer(t *testing.T) {
+	db := new(mocks.DbAccess)
+	dbAccess = db
+	defer func() { dbAccess = DynamodbAccess{} }()
+	db.On("QueryPolicyByAstraea", "a1", "host@appaegis.com").Return(schema.PolicyEntry{Actions: []string{}})
+
+	ses := &session.SessionCommonData{TenantID: "t1", AppID: "a1", Email: "host@appaegis.com", RdpSessionId: "policy-viewer-session"}
+	NewRdpSessionRoom(ses.RdpSessionId, ses.Email, &fakeWriterCloser{}, "c1", true, "a1", "app", logging.LoggingInfo{})
+	defer delete(rdpRooms, ses.RdpSessionId)
+	ws := &fakeWriterCloser{}
+	viewer, err := JoinRoom(ses.RdpSessionId, "viewer@appaegis.com", ws, "")
+	assert.Nil(t, err)
+
+	// the viewer is granted what the host is, a first grant of nothing doesn't revoke
+	reevaluatePolicy(ses, viewer)
+	assert.False(t, viewer.Allowed("copy"))
+	assert.False(t, ws.Closed)
+	db.AssertNotCalled(t, "QueryPolicyByAstraea", "a1", "viewer@appaegis.com")
+}
@@ -6,11 +6,14 @@ import (
 	"io"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/appaegis/golang-common/pkg/db_data/schema"
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
 	"github.com/wwt/guac/lib/logging"
+	"github.com/wwt/guac/lib/settings"
 	"github.com/wwt/guac/pkg/session"
 )
 
@@ -19,6 +22,28 @@ var (
 	rdpRooms = make(map[string]*RdpSessionRoom)
 )
 
+// the reasons a participant leaves a room
+const (
+	// LeaveClosed is the client closing its websocket
+	LeaveClosed = "closed"
+	// LeaveTimeout is a missed heartbeat or write deadline, e.g. of a half-open connection
+	LeaveTimeout = "timeout"
+	// LeaveMessageTooLarge is a message of the client over the read limit
+	LeaveMessageTooLarge = "messageTooLarge"
+	// LeaveError is another failure of the websocket
+	LeaveError = "error"
+	// LeaveDisconnected is the server closing the websocket, e.g. as it fell behind
+	LeaveDisconnected = "disconnected"
+	// LeaveGuacd is the connection to guacd ending
+	LeaveGuacd = "guacd"
+	// LeaveRemoved is a host removing the participant
+	LeaveRemoved = "removed"
+	// LeaveShareStopped is the host stopping to share the session
+	LeaveShareStopped = "shareStopped"
+	// LeaveRoomClosed is the room closing with the participant in it
+	LeaveRoomClosed = "roomClosed"
+)
+
 type UserList struct {
 	Users []User `json:"users"`
 }
@@ -38,10 +63,17 @@ type RdpClient struct {
 	Websocket WriterCloser
 	UserAgent schema.UserAgent
 	UserId    string
+	ClientIp  string
 	Role      string // admin or cohost or viewer
 	Mouse     bool
 	Keyboard  bool
 	lock      sync.Mutex
+	// transferCredits are the file transfers allowed by upload and download checks, by direction
+	transferCredits map[string]int
+	// actions are what the policy of the app last granted the user, nil until evaluated
+	actions []string
+	// syncTracker measures the latency of the client, see syncs
+	syncTracker *syncTracker
 }
 
 func (c *RdpClient) WriteMessage(ins *Instruction) {
@@ -52,6 +84,27 @@ func (c *RdpClient) WriteMessage(ins *Instruction) {
 	}
 }
 
+// grantTransfers allows the client to start count file transfers in a direction
+func (c *RdpClient) grantTransfers(direction string, count int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.transferCredits == nil {
+		c.transferCredits = map[string]int{}
+	}
+	c.transferCredits[direction] += count
+}
+
+// takeTransfer uses a file transfer allowed by a check, it returns false if there is none
+func (c *RdpClient) takeTransfer(direction string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.transferCredits[direction] <= 0 {
+		return false
+	}
+	c.transferCredits[direction]--
+	return true
+}
+
 func (c *RdpClient) SendPermission() {
 	var permissions []string
 	if c.Keyboard {
@@ -76,6 +129,46 @@ type RdpSessionRoom struct {
 	Invitees        map[string]string
 	lock            *sync.Mutex
 	loggingInfo     *logging.LoggingInfo
+	// masks are the screen regions the host hides from the other participants
+	masks []settings.MaskRegion
+	// lastInput is the time of the last key or mouse input, in unix nanoseconds
+	lastInput atomic.Int64
+	// done is closed with the room
+	done chan struct{}
+	// stats are summarized when the room closes
+	stats sessionStats
+	// fanOut relays the connection of the host to the viewers, nil if they connect to guacd
+	fanOut *roomFanOut
+	// clipboardQuotas are the clipboard rate limits of the participants, by user and direction
+	clipboardQuotas map[string]*clipboardQuota
+}
+
+// SetMasks replaces the screen regions the host hides from the other participants
+func (r *RdpSessionRoom) SetMasks(masks []settings.MaskRegion) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.masks = masks
+}
+
+// Masks returns the screen regions the host hides from the other participants
+func (r *RdpSessionRoom) Masks() []settings.MaskRegion {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.masks
+}
+
+// clipboardQuota returns the clipboard rate limits of a user in a direction, they last as long as the room
+func (r *RdpSessionRoom) clipboardQuota(user, direction string) *clipboardQuota {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.clipboardQuotas == nil {
+		r.clipboardQuotas = map[string]*clipboardQuota{}
+	}
+	key := user + "/" + direction
+	if _, ok := r.clipboardQuotas[key]; !ok {
+		r.clipboardQuotas[key] = &clipboardQuota{}
+	}
+	return r.clipboardQuotas[key]
 }
 
 func (r *RdpSessionRoom) GetRdpClient(userId string) *RdpClient {
@@ -173,14 +266,16 @@ func (r *RdpSessionRoom) join(user string, ws WriterCloser, permissions string)
 		Mouse:     strings.Contains(permissions, "mouse"),
 		Keyboard:  strings.Contains(permissions, "keyboard"),
 	}
+	r.stats.joined(user, role, time.Now())
 	logrus.Infof("room %s, user size %d", r.SessionId, len(r.Users))
 	return r.Users[user]
 }
 
-func (r *RdpSessionRoom) leave(user string) {
+func (r *RdpSessionRoom) leave(user, reason string) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
 	delete(r.Users, user)
+	r.stats.left(user, reason, time.Now())
 }
 
 func (r *RdpSessionRoom) RemoveUser(user string) {
@@ -194,6 +289,7 @@ func (r *RdpSessionRoom) RemoveUser(user string) {
 			logrus.Errorf("close client %s ws failed %v", user, e)
 		}
 		delete(r.Users, user)
+		r.stats.left(user, LeaveRemoved, time.Now())
 	}
 }
 
@@ -224,6 +320,7 @@ func (r *RdpSessionRoom) StopShare() {
 			logrus.Errorf("close %s ws failed %v", c.UserId, e)
 		}
 		delete(r.Users, c.UserId)
+		r.stats.left(c.UserId, LeaveShareStopped, time.Now())
 	}
 
 	var users []User
@@ -238,6 +335,13 @@ func GetRdpSessionRoom(sessionId string) (*RdpSessionRoom, bool) {
 	return result, ok
 }
 
+// lookupRdpSessionRoom returns the room of a session for callers which don't hold the lock of the rooms
+func lookupRdpSessionRoom(sessionId string) (*RdpSessionRoom, bool) {
+	lock.Lock()
+	defer lock.Unlock()
+	return GetRdpSessionRoom(sessionId)
+}
+
 func NewRdpSessionRoom(sessionId string, user string, closer WriterCloser, connectionId string, allowSharing bool, appId, appName string, loggingInfo logging.LoggingInfo) *RdpClient {
 	lock.Lock()
 	defer lock.Unlock()
@@ -252,7 +356,11 @@ func NewRdpSessionRoom(sessionId string, user string, closer WriterCloser, conne
 		Invitees:        make(map[string]string),
 		AllowSharing:    allowSharing,
 		lock:            &sync.Mutex{},
+		done:            make(chan struct{}),
+		fanOut:          newRoomFanOut(loggingInfo.TenantId, appId),
 	}
+	room.lastInput.Store(time.Now().UnixNano())
+	room.stats.joined(user, ROLE_ADMIN, time.Now())
 	room.Invitees[user] = "admin,keyboard,mouse"
 	room.Users[user] = &RdpClient{
 		Websocket: closer,
@@ -296,7 +404,8 @@ func JoinRoom(sessionId string, user string, ws WriterCloser, permissions string
 	}
 }
 
-func LeaveRoom(session *session.SessionCommonData, sessionId, user, clientIp, clientPrivateIp string) error {
+// LeaveRoom removes a participant from the room, reason is why they left, e.g. LeaveTimeout
+func LeaveRoom(session *session.SessionCommonData, sessionId, user, clientIp, clientPrivateIp, reason string) error {
 	lock.Lock()
 	defer lock.Unlock()
 
@@ -308,11 +417,13 @@ func LeaveRoom(session *session.SessionCommonData, sessionId, user, clientIp, cl
 			ClientIP:        clientIp,
 			ClientPrivateIp: clientPrivateIp,
 			Destination:     session.ServerName,
+			Reason:          reason,
 		})
 	}
+	incLeaves(session.TenantID, reason)
 
 	if room, ok := GetRdpSessionRoom(sessionId); ok {
-		room.leave(user)
+		room.leave(user, reason)
 
 		hasAdmin := false
 		for _, u := range room.Users {
@@ -351,12 +462,17 @@ func closeRoom(room *RdpSessionRoom) {
 	ses, _ := SessionDataStore.Get(room.SessionId).(*session.SessionCommonData)
 
 	delete(rdpRooms, room.SessionId)
+	close(room.done)
+	room.fanOut.close()
 	SessionDataStore.Delete(room.SessionId)
 	e := dbAccess.DeleteRdpSession(room.SessionId)
 	e2 := kv.Delete(fmt.Sprintf("guac-%s", room.SessionId))
 	logrus.Infof("remove session data %s, room size %d, session store size %d, e %v, e2 %v", room.SessionId, len(rdpRooms), len(SessionDataStore.Data), e, e2)
 	room.loggingInfo.SessionId = ses.RdpSessionId
 	AddEncodeRecoding(*room.loggingInfo)
+	room.logSummary(ses)
+	deleteSessionTrafficMetrics(room.SessionId, ses.TenantID)
+	deleteSessionLatencyMetrics(room.SessionId, ses.TenantID)
 
 	if ses.Auth {
 		go SendEvent("exit", logging.Action{
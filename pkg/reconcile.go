@@ -0,0 +1,198 @@
+package guac
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wwt/guac/lib/logging"
+)
+
+const (
+	// queuedSuffix marks a raw recording queued for encoding
+	queuedSuffix = ".queued"
+	// leaseDir holds a file per guac process, touched while the process runs
+	leaseDir = ".leases"
+	// leaseRenewInterval is how often a guac process renews its lease
+	leaseRenewInterval = 30 * time.Second
+	// leaseTTL is how long a lease lasts without being renewed, the recordings of
+	// a process whose lease expired are orphaned
+	leaseTTL = 4 * leaseRenewInterval
+	// orphanIdleTime is how long a recording without a lease is not written to
+	// before its session is considered dead, guacd syncs every few seconds while a
+	// session is alive
+	orphanIdleTime = 10 * time.Minute
+)
+
+// RecordingLease identifies this guac process in the logging info of the recordings
+// of its sessions, they are alive as long as it renews the lease
+var RecordingLease = newRecordingLease()
+
+func newRecordingLease() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, time.Now().UnixNano())
+}
+
+// ReconcileReport is the result of a recording reconciliation
+type ReconcileReport struct {
+	// Queued are the orphaned recordings queued for encoding
+	Queued []string
+	// Unattributed are the recordings without logging info, they can't be encoded
+	Unattributed []string
+	// Invalid are files which are not recordings
+	Invalid []string
+}
+
+// ReconcileRecordings queues the recordings of sessions which died before they
+// were closed, such as the sessions of a crashed guac pod.
+func ReconcileRecordings() {
+	report := reconcileRecordings("/efs/rdp", time.Now(), AddEncodeRecoding)
+	logrus.Infof("reconciled recordings, %d queued, %d unattributed, %d invalid", len(report.Queued), len(report.Unattributed), len(report.Invalid))
+	for _, name := range report.Unattributed {
+		logging.Log(logging.Action{
+			AppTag: "rdp.recording.unattributed",
+			Files:  []string{name},
+			Reason: "no logging info saved for the recording",
+		})
+	}
+	for _, name := range report.Invalid {
+		logging.Log(logging.Action{
+			AppTag: "rdp.recording.invalid",
+			Files:  []string{name},
+			Reason: "file is not a guacamole recording",
+		})
+	}
+}
+
+// KeepRecordingLease renews the lease of this process on the recordings of its
+// sessions for as long as it runs
+func KeepRecordingLease() {
+	for {
+		if err := renewLease("/efs/rdp", RecordingLease, time.Now()); err != nil {
+			logrus.Errorf("cannot renew recording lease %s: %v", RecordingLease, err)
+		}
+		time.Sleep(leaseRenewInterval)
+	}
+}
+
+func renewLease(dir, lease string, now time.Time) error {
+	if err := os.MkdirAll(filepath.Join(dir, leaseDir), 0o777); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, leaseDir, lease)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err = os.WriteFile(path, nil, 0o744); err != nil {
+			return err
+		}
+	}
+	return os.Chtimes(path, now, now)
+}
+
+// leaseAlive returns if the process of a lease renewed it lately
+func leaseAlive(dir, lease string, now time.Time) bool {
+	fi, err := os.Stat(filepath.Join(dir, leaseDir, lease))
+	return err == nil && now.Sub(fi.ModTime()) < leaseTTL
+}
+
+// pruneLeases deletes the expired leases, their processes are gone
+func pruneLeases(dir string, now time.Time) {
+	entries, err := os.ReadDir(filepath.Join(dir, leaseDir))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !leaseAlive(dir, entry.Name(), now) {
+			os.Remove(filepath.Join(dir, leaseDir, entry.Name()))
+		}
+	}
+}
+
+// markRecordingQueued claims a raw recording for encoding, it returns false
+// if the recording was already queued
+func markRecordingQueued(dir, name string) bool {
+	f, err := os.OpenFile(filepath.Join(dir, name+queuedSuffix), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o744)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+func reconcileRecordings(dir string, now time.Time, queue func(logging.LoggingInfo)) ReconcileReport {
+	var report ReconcileReport
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		logrus.Errorf("cannot read recording dir %s: %v", dir, err)
+		return report
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if _, ok := isRecordingArtifact(name); ok {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if _, e := os.Stat(filepath.Join(dir, name+queuedSuffix)); e == nil {
+			continue
+		}
+
+		// the session is alive while the process recording it renews its lease
+		var info logging.LoggingInfo
+		data, err := os.ReadFile(filepath.Join(dir, name+logging.RecordingInfoSuffix))
+		if err == nil {
+			err = json.Unmarshal(data, &info)
+		}
+		if err == nil && info.GetRecordingFileName() != name {
+			err = fmt.Errorf("logging info is of recording %s", info.GetRecordingFileName())
+		}
+		if err == nil && info.Lease != "" {
+			if leaseAlive(dir, info.Lease, now) {
+				continue
+			}
+		} else if now.Sub(fi.ModTime()) < orphanIdleTime {
+			continue
+		}
+
+		if e := checkRecording(filepath.Join(dir, name), fi.Size()); e != nil {
+			logrus.Errorf("invalid recording %s: %v", name, e)
+			report.Invalid = append(report.Invalid, name)
+			continue
+		}
+		if err != nil {
+			logrus.Errorf("cannot attribute recording %s: %v", name, err)
+			report.Unattributed = append(report.Unattributed, name)
+			continue
+		}
+		if !markRecordingQueued(dir, name) {
+			continue
+		}
+		logrus.Infof("queue orphaned recording %s of tenant %s", name, info.TenantId)
+		info.EnableRecording = true
+		queue(info)
+		report.Queued = append(report.Queued, name)
+	}
+	pruneLeases(dir, now)
+	return report
+}
+
+// checkRecording verifies the file starts with a guacamole instruction
+func checkRecording(path string, size int64) error {
+	if size == 0 {
+		return fmt.Errorf("recording is empty")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = NewRecordingReader(f).Next()
+	return err
+}
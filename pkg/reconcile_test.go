@@ -0,0 +1,67 @@
+package guac
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wwt/guac/lib/logging"
+)
+
+func TestReconcileRecordings(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-time.Hour)
+	write := func(name, content string, mtime time.Time) {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+		assert.Nil(t, os.Chtimes(filepath.Join(dir, name), mtime, mtime))
+	}
+	recording := "4.sync,13.1700000000000;"
+	orphan := logging.LoggingInfo{TenantId: "t1", Email: "a@b.com", S3Key: "orphan"}
+	info, _ := json.Marshal(orphan)
+
+	write(orphan.GetRecordingFileName(), recording, old)
+	write(orphan.GetRecordingFileName()+logging.RecordingInfoSuffix, string(info), old)
+	write("a@b.com-active", recording, time.Now())
+	write("a@b.com-closed", recording, old)
+	write("a@b.com-closed"+queuedSuffix, "", old)
+	write("a@b.com-unknown", recording, old)
+	write("a@b.com-empty", "", old)
+	write("a@b.com-garbage", "garbage", old)
+
+	// a session is alive while its lease is renewed, however long it is idle
+	assert.Nil(t, renewLease(dir, "live", time.Now()))
+	assert.Nil(t, renewLease(dir, "dead", old))
+	for _, leased := range []logging.LoggingInfo{
+		{TenantId: "t1", Email: "a@b.com", S3Key: "idle", Lease: "live"},
+		{TenantId: "t1", Email: "a@b.com", S3Key: "crashed", Lease: "dead"},
+	} {
+		info, _ := json.Marshal(leased)
+		write(leased.GetRecordingFileName(), recording, time.Now())
+		write(leased.GetRecordingFileName()+logging.RecordingInfoSuffix, string(info), time.Now())
+	}
+	assert.Nil(t, os.Chtimes(filepath.Join(dir, "a@b.com-idle"), old, old))
+
+	var queued []logging.LoggingInfo
+	queue := func(info logging.LoggingInfo) { queued = append(queued, info) }
+	report := reconcileRecordings(dir, time.Now(), queue)
+
+	assert.Equal(t, []string{"a@b.com-crashed", "a@b.com-orphan"}, report.Queued)
+	assert.Equal(t, []string{"a@b.com-unknown"}, report.Unattributed)
+	assert.Equal(t, []string{"a@b.com-empty", "a@b.com-garbage"}, report.Invalid)
+	assert.Equal(t, 2, len(queued))
+	assert.Equal(t, "t1", queued[0].TenantId)
+	assert.True(t, queued[0].EnableRecording)
+	// the expired lease is pruned, the live one kept
+	assert.False(t, leaseAlive(dir, "dead", time.Now()))
+	_, err := os.Stat(filepath.Join(dir, leaseDir, "dead"))
+	assert.True(t, os.IsNotExist(err))
+	assert.True(t, leaseAlive(dir, "live", time.Now()))
+
+	// a second pod starting at the same time doesn't queue it again
+	report = reconcileRecordings(dir, time.Now(), queue)
+	assert.Empty(t, report.Queued)
+	assert.Equal(t, 2, len(queued))
+}
@@ -1,6 +1,7 @@
 package guac
 
 import (
+	"encoding/base64"
 	"fmt"
 	"net/url"
 	"os"
@@ -12,10 +13,16 @@ import (
 	"github.com/appaegis/golang-common/pkg/storage"
 	"github.com/sirupsen/logrus"
 	"github.com/wwt/guac/lib/logging"
+	"github.com/wwt/guac/lib/settings"
+	"go.uber.org/zap"
 )
 
 func AddEncodeRecoding(loggingInfo logging.LoggingInfo) {
 	logrus.Infof("add encoding %s", loggingInfo.S3Key)
+	if loggingInfo.EnableRecording {
+		// keeps the startup reconciliation from queueing the recording again
+		markRecordingQueued("/efs/rdp", loggingInfo.GetRecordingFileName())
+	}
 	PushToQueue(loggingInfo)
 }
 
@@ -26,6 +33,7 @@ func EncodeRecording(index int) {
 			logrus.Infof("handle %#v form queue %d", info, index)
 			if _, e := os.Stat(fmt.Sprintf("/efs/rdp/%s", info.GetRecordingFileName())); e != nil {
 				logrus.Infof("file %s not found, skip", info.GetRecordingFileName())
+				removeRecordingArtifacts(info.GetRecordingFileName())
 				PopFromQueue(index)
 			} else {
 				Encode(*info)
@@ -72,33 +80,133 @@ func Encode(loggingInfo logging.LoggingInfo) {
 	}
 
 	// ffmpeg -i c57fc449-c352-4efb-8501-b5203eaaafdb.m4v -vcodec libx264 -acodec aac output2.mp4
-	command := fmt.Sprintf("ffmpeg -i /efs/rdp/%s.m4v -vcodec libx264 -acodec aac /efs/rdp/%s.mp4", loggingInfo.GetRecordingFileName(), loggingInfo.GetRecordingFileName())
-	strs := strings.Split(command, " ")
-	output, _ := exec.Command(strs[0], strs[1:]...).CombinedOutput()
+	args := []string{"-i", fmt.Sprintf("/efs/rdp/%s.m4v", loggingInfo.GetRecordingFileName())}
+	watermark := settings.Watermark(loggingInfo.TenantId, loggingInfo.AppId)
+	if filter := watermarkFilter(watermark, loggingInfo.Email, loggingInfo.ClientIp, loggingInfo.StartTime); filter != "" {
+		args = append(args, "-vf", filter)
+	}
+	args = append(args, "-vcodec", "libx264", "-acodec", "aac", fmt.Sprintf("/efs/rdp/%s.mp4", loggingInfo.GetRecordingFileName()))
+	output, _ := exec.Command("ffmpeg", args...).CombinedOutput()
 	logrus.Infof("ffmpeg output %s", output)
 
 	// RDP auth error still have m4v file
 	// we check valid recording by ffmpeg result
 	if !strings.Contains(string(output), "video:0kB") {
 
-		f1, err := os.OpenFile(fmt.Sprintf("/efs/rdp/%s.mp4", loggingInfo.GetRecordingFileName()), os.O_RDONLY, 0o744)
-		if err != nil {
-			logrus.Errorf("cannot open file %s.mp4", loggingInfo.GetRecordingFileName())
-			return
-		}
 		tag := url.QueryEscape(fmt.Sprintf("sku=%s", loggingInfo.Sku))
 		s, appaegis := storage.GetStorageByTenantId(loggingInfo.TenantId, config.GetRegion())
-		key := fmt.Sprintf("rdp/%s/%s/%s.mp4", loggingInfo.TenantId, loggingInfo.Email, loggingInfo.S3Key)
+		base := fmt.Sprintf("rdp/%s/%s/%s", loggingInfo.TenantId, loggingInfo.Email, loggingInfo.S3Key)
 		if appaegis {
-			key = fmt.Sprintf("%s/%s/%s.mp4", loggingInfo.TenantId, loggingInfo.Email, loggingInfo.S3Key)
+			base = fmt.Sprintf("%s/%s/%s", loggingInfo.TenantId, loggingInfo.Email, loggingInfo.S3Key)
 		} else {
 			tag = ""
 		}
-		_ = s.UploadRdp(key, f1, tag)
+		var upload recordingUploader = func(key, path string) (string, error) {
+			f, err := os.OpenFile(path, os.O_RDONLY, 0o744)
+			if err != nil {
+				logrus.Errorf("cannot open file %s", path)
+				return "", err
+			}
+			defer f.Close()
+			return key, s.UploadRdp(key, f, tag)
+		}
 
-		logging.LogRecording(loggingInfo, key, s.GetRdpBucket(), s.GetKeyId(), s.GetStorageType(), s.GetRegion(), loggingInfo.SessionId)
+		var extras []zap.Field
+		if encryption := settings.Encryption(loggingInfo.TenantId, loggingInfo.AppId); encryption.Enabled {
+			// never fall back to a plain upload for a tenant requiring encryption
+			dataKey, err := newRecordingDataKey(encryption, loggingInfo.TenantId)
+			if err != nil {
+				logrus.Errorf("cannot get data key of tenant %s, recording %s not uploaded: %v", loggingInfo.TenantId, loggingInfo.GetRecordingFileName(), err)
+				os.Remove(fmt.Sprintf("/efs/rdp/%s%s", loggingInfo.GetRecordingFileName(), queuedSuffix))
+				return
+			}
+			upload = encryptingUploader(upload, dataKey)
+			extras = append(extras,
+				zap.String("encryption_algorithm", RecordingEncryptionAlgorithm),
+				zap.String("encryption_key_id", dataKey.KeyID),
+				zap.String("wrapped_key", base64.StdEncoding.EncodeToString(dataKey.Wrapped)),
+			)
+		}
+
+		key, err := upload(base+".mp4", fmt.Sprintf("/efs/rdp/%s.mp4", loggingInfo.GetRecordingFileName()))
+		if err != nil {
+			// the recording is kept for the reconciliation to queue it again
+			logrus.Errorf("cannot upload %s.mp4, it is retried: %v", loggingInfo.GetRecordingFileName(), err)
+			os.Remove(fmt.Sprintf("/efs/rdp/%s%s", loggingInfo.GetRecordingFileName(), queuedSuffix))
+			return
+		}
+
+		keys := []string{key}
+		if transcriptKey := uploadKeystrokeTranscript(upload, loggingInfo, base); transcriptKey != "" {
+			extras = append(extras, zap.String("transcript_key", transcriptKey))
+			keys = append(keys, transcriptKey)
+		}
+		timelineKey, thumbnailsKey := uploadTimeline(upload, loggingInfo, base)
+		if timelineKey != "" {
+			extras = append(extras, zap.String("timeline_key", timelineKey))
+			keys = append(keys, timelineKey)
+		}
+		if thumbnailsKey != "" {
+			extras = append(extras, zap.String("thumbnails_key", thumbnailsKey))
+			keys = append(keys, thumbnailsKey)
+		}
+
+		logging.LogRecording(loggingInfo, key, s.GetRdpBucket(), s.GetKeyId(), s.GetStorageType(), s.GetRegion(), loggingInfo.SessionId, extras...)
+		if e := saveUploadRecord("/efs/rdp", loggingInfo, keys); e != nil {
+			logrus.Errorf("cannot index uploaded recording %s, it is kept forever: %v", loggingInfo.GetRecordingFileName(), e)
+		}
 	}
-	os.Remove(fmt.Sprintf("/efs/rdp/%s.mp4", loggingInfo.GetRecordingFileName()))
-	os.Remove(fmt.Sprintf("/efs/rdp/%s.m4v", loggingInfo.GetRecordingFileName()))
+	removeRecordingArtifacts(loggingInfo.GetRecordingFileName())
 	os.Remove(fmt.Sprintf("/efs/rdp/%s", loggingInfo.GetRecordingFileName()))
 }
+
+// recordingUploader uploads a local file to the tenant storage and returns the key it is stored with
+type recordingUploader func(key, path string) (string, error)
+
+func newRecordingDataKey(cfg settings.EncryptionSettings, tenantID string) (*DataKey, error) {
+	provider, err := GetKeyProvider(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return provider.DataKey(tenantID)
+}
+
+// uploadKeystrokeTranscript stores the keystroke transcript next to the recording
+// and returns its key, or an empty key if there is no transcript.
+func uploadKeystrokeTranscript(upload recordingUploader, loggingInfo logging.LoggingInfo, base string) string {
+	keylog := settings.Keylog(loggingInfo.TenantId, loggingInfo.AppId)
+	if !keylog.Enabled {
+		return ""
+	}
+	raw, err := os.Open(fmt.Sprintf("/efs/rdp/%s", loggingInfo.GetRecordingFileName()))
+	if err != nil {
+		logrus.Errorf("cannot open recording for transcript %v", err)
+		return ""
+	}
+	transcript, err := BuildKeystrokeTranscript(raw)
+	raw.Close()
+	if err != nil || len(transcript.Lines) == 0 {
+		return ""
+	}
+	transcript.Redact(keylog.Redact)
+
+	path := fmt.Sprintf("/efs/rdp/%s.keys.txt", loggingInfo.GetRecordingFileName())
+	f, err := os.Create(path)
+	if err != nil {
+		logrus.Errorf("cannot create transcript %s %v", path, err)
+		return ""
+	}
+	_, err = transcript.WriteTo(f)
+	f.Close()
+	if err != nil {
+		logrus.Errorf("write transcript %s failed %v", path, err)
+		return ""
+	}
+
+	key, err := upload(base+".keys.txt", path)
+	if err != nil {
+		logrus.Errorf("upload transcript %s failed %v", key, err)
+		return ""
+	}
+	return key
+}
@@ -0,0 +1,298 @@
+package guac
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/wwt/guac/lib/settings"
+)
+
+const (
+	// RecordingEncryptionAlgorithm encrypts recordings in AES-256-GCM chunks, the
+	// data key is wrapped by the tenant key of the key provider
+	RecordingEncryptionAlgorithm = "AES-256-GCM-STREAM"
+	recordingMagic               = "GREC"
+	recordingFormatVersion       = 1
+	recordingChunkSize           = 64 * 1024
+)
+
+// DataKey is a per recording key, Plaintext encrypts the recording and
+// Wrapped is stored with it so only the key provider can recover Plaintext.
+type DataKey struct {
+	KeyID     string
+	Plaintext []byte
+	Wrapped   []byte
+}
+
+// KeyProvider issues data keys wrapped by per tenant keys
+type KeyProvider interface {
+	// DataKey generates a new data key for the tenant
+	DataKey(tenantID string) (*DataKey, error)
+	// Unwrap recovers the plaintext of a wrapped data key
+	Unwrap(tenantID, keyID string, wrapped []byte) ([]byte, error)
+}
+
+var keyProviders = map[string]func(settings.EncryptionSettings) (KeyProvider, error){
+	"file": func(cfg settings.EncryptionSettings) (KeyProvider, error) {
+		return &FileKeyProvider{Dir: cfg.KeyDir}, nil
+	},
+}
+
+// RegisterKeyProvider makes a key provider available to the encryption settings
+func RegisterKeyProvider(name string, factory func(settings.EncryptionSettings) (KeyProvider, error)) {
+	keyProviders[name] = factory
+}
+
+// GetKeyProvider returns the key provider configured by the encryption settings
+func GetKeyProvider(cfg settings.EncryptionSettings) (KeyProvider, error) {
+	factory, ok := keyProviders[cfg.Provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown key provider %s", cfg.Provider)
+	}
+	return factory(cfg)
+}
+
+// FileKeyProvider keeps a 256 bit tenant key per file, <Dir>/<tenant id>.key
+// holding the key hex encoded.
+type FileKeyProvider struct {
+	Dir string
+}
+
+func (p *FileKeyProvider) tenantKey(tenantID string) ([]byte, string, error) {
+	if tenantID == "" || strings.ContainsAny(tenantID, `/\`) {
+		return nil, "", fmt.Errorf("invalid tenant id %q", tenantID)
+	}
+	data, err := os.ReadFile(filepath.Join(p.Dir, tenantID+".key"))
+	if err != nil {
+		return nil, "", err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, "", fmt.Errorf("tenant key of %s is not 32 hex encoded bytes", tenantID)
+	}
+	fingerprint := sha256.Sum256(key)
+	return key, fmt.Sprintf("file:%s:%x", tenantID, fingerprint[:8]), nil
+}
+
+// DataKey generates a data key wrapped by the tenant key
+func (p *FileKeyProvider) DataKey(tenantID string) (*DataKey, error) {
+	tenantKey, keyID, err := p.tenantKey(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, 32)
+	if _, err = rand.Read(plaintext); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(tenantKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &DataKey{
+		KeyID:     keyID,
+		Plaintext: plaintext,
+		Wrapped:   aead.Seal(nonce, nonce, plaintext, []byte(keyID)),
+	}, nil
+}
+
+// Unwrap decrypts a data key wrapped by DataKey
+func (p *FileKeyProvider) Unwrap(tenantID, keyID string, wrapped []byte) ([]byte, error) {
+	tenantKey, currentID, err := p.tenantKey(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if currentID != keyID {
+		return nil, fmt.Errorf("key %s is not the tenant key %s", keyID, currentID)
+	}
+	aead, err := newGCM(tenantKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped key too short")
+	}
+	return aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(keyID))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptRecording writes src to dst in the encrypted recording format:
+//
+//	"GREC" | version | key id length, key id | wrapped key length, wrapped key | nonce prefix
+//
+// followed by chunks of a 4 byte length and AES-GCM sealed data. The nonce of
+// a chunk is the prefix and the chunk counter, the last chunk is authenticated
+// as such so a truncated recording fails to decrypt.
+func EncryptRecording(src io.Reader, dst io.Writer, key *DataKey) error {
+	aead, err := newGCM(key.Plaintext)
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, aead.NonceSize()-4)
+	if _, err = rand.Read(prefix); err != nil {
+		return err
+	}
+	// bufio.Writer errors are sticky, the header errors are reported by the chunk writes or Flush
+	w := bufio.NewWriter(dst)
+	w.WriteString(recordingMagic)
+	w.WriteByte(recordingFormatVersion)
+	writeField(w, []byte(key.KeyID))
+	writeField(w, key.Wrapped)
+	w.Write(prefix)
+
+	reader := bufio.NewReaderSize(src, recordingChunkSize)
+	chunk := make([]byte, recordingChunkSize)
+	var sealed []byte
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(reader, chunk)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		_, peekErr := reader.Peek(1)
+		last := peekErr != nil
+		sealed = aead.Seal(sealed[:0], chunkNonce(prefix, counter), chunk[:n], chunkAAD(last))
+		if err := binary.Write(w, binary.BigEndian, uint32(len(sealed))); err != nil {
+			return err
+		}
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			break
+		}
+	}
+	return w.Flush()
+}
+
+// DecryptRecording reverses EncryptRecording, unwrap recovers the data key from the key id and wrapped key
+func DecryptRecording(src io.Reader, dst io.Writer, unwrap func(keyID string, wrapped []byte) ([]byte, error)) error {
+	r := bufio.NewReader(src)
+	header := make([]byte, len(recordingMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if string(header[:len(recordingMagic)]) != recordingMagic || header[len(recordingMagic)] != recordingFormatVersion {
+		return fmt.Errorf("not an encrypted recording")
+	}
+	keyID, err := readField(r)
+	if err != nil {
+		return err
+	}
+	wrapped, err := readField(r)
+	if err != nil {
+		return err
+	}
+	plaintext, err := unwrap(string(keyID), wrapped)
+	if err != nil {
+		return err
+	}
+	aead, err := newGCM(plaintext)
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, aead.NonceSize()-4)
+	if _, err = io.ReadFull(r, prefix); err != nil {
+		return err
+	}
+	var chunk []byte
+	for counter := uint32(0); ; counter++ {
+		var length uint32
+		if err = binary.Read(r, binary.BigEndian, &length); err != nil {
+			return fmt.Errorf("recording truncated: %v", err)
+		}
+		if length > recordingChunkSize+uint32(aead.Overhead()) {
+			return fmt.Errorf("invalid chunk length %d", length)
+		}
+		sealed := make([]byte, length)
+		if _, err = io.ReadFull(r, sealed); err != nil {
+			return fmt.Errorf("recording truncated: %v", err)
+		}
+		_, peekErr := r.Peek(1)
+		last := peekErr != nil
+		chunk, err = aead.Open(chunk[:0], chunkNonce(prefix, counter), sealed, chunkAAD(last))
+		if err != nil {
+			return fmt.Errorf("chunk %d: %v", counter, err)
+		}
+		if _, err = dst.Write(chunk); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func chunkNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, len(prefix)+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[len(prefix):], counter)
+	return nonce
+}
+
+func chunkAAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+func writeField(w *bufio.Writer, data []byte) {
+	_ = binary.Write(w, binary.BigEndian, uint16(len(data)))
+	w.Write(data)
+}
+
+func readField(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	data := make([]byte, length)
+	_, err := io.ReadFull(r, data)
+	return data, err
+}
+
+// encryptingUploader encrypts files with the data key before handing them to upload,
+// encrypted files are stored with an .enc suffix
+func encryptingUploader(upload recordingUploader, key *DataKey) recordingUploader {
+	return func(storageKey, path string) (string, error) {
+		src, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer src.Close()
+		encrypted := path + ".enc"
+		dst, err := os.Create(encrypted)
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(encrypted)
+		err = EncryptRecording(src, dst, key)
+		if e := dst.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return "", fmt.Errorf("encrypt %s failed %v", path, err)
+		}
+		return upload(storageKey+".enc", encrypted)
+	}
+}
@@ -0,0 +1,50 @@
+package guac
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wwt/guac/lib/settings"
+)
+
+func TestEncryptRecording(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "tenantId.key"), []byte("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n"), 0o600))
+	provider, err := GetKeyProvider(settings.EncryptionSettings{Provider: "file", KeyDir: dir})
+	assert.Nil(t, err)
+
+	dataKey, err := provider.DataKey("tenantId")
+	assert.Nil(t, err)
+	assert.Contains(t, dataKey.KeyID, "file:tenantId:")
+
+	for _, size := range []int{0, 10, recordingChunkSize, recordingChunkSize*2 + 7} {
+		plain := make([]byte, size)
+		_, _ = rand.Read(plain)
+
+		var encrypted bytes.Buffer
+		assert.Nil(t, EncryptRecording(bytes.NewReader(plain), &encrypted, dataKey))
+		assert.False(t, size > 0 && bytes.Contains(encrypted.Bytes(), plain))
+
+		unwrap := func(keyID string, wrapped []byte) ([]byte, error) {
+			return provider.Unwrap("tenantId", keyID, wrapped)
+		}
+		var decrypted bytes.Buffer
+		assert.Nil(t, DecryptRecording(bytes.NewReader(encrypted.Bytes()), &decrypted, unwrap))
+		assert.True(t, bytes.Equal(plain, decrypted.Bytes()), "size %d", size)
+
+		if size > recordingChunkSize {
+			// dropping the last chunk must be detected
+			truncated := encrypted.Bytes()[:encrypted.Len()-7-16-4]
+			assert.NotNil(t, DecryptRecording(bytes.NewReader(truncated), &bytes.Buffer{}, unwrap))
+		}
+	}
+
+	_, err = provider.DataKey("../tenantId")
+	assert.NotNil(t, err)
+	_, err = provider.DataKey("unknown")
+	assert.NotNil(t, err)
+}
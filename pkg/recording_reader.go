@@ -0,0 +1,69 @@
+package guac
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// RecordingReader reads the instructions of a guacd session recording one at a time
+type RecordingReader struct {
+	r *bufio.Reader
+}
+
+// NewRecordingReader creates a reader over a recording file
+func NewRecordingReader(r io.Reader) *RecordingReader {
+	return &RecordingReader{r: bufio.NewReaderSize(r, MaxGuacMessage)}
+}
+
+// Next returns the next instruction, io.EOF is returned at the end of the recording.
+// A recording cut off by a crashed guacd ends with io.ErrUnexpectedEOF.
+func (rr *RecordingReader) Next() (*Instruction, error) {
+	var elements []string
+	for {
+		element, terminator, err := rr.readElement()
+		if err != nil {
+			if err == io.EOF && len(elements) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		elements = append(elements, element)
+		switch terminator {
+		case ';':
+			return NewInstruction(elements[0], elements[1:]...), nil
+		case ',':
+		default:
+			return nil, ErrServer.NewError("Element terminator of instruction was not ';' nor ','")
+		}
+	}
+}
+
+// readElement reads one length prefixed element, the length counts unicode characters
+func (rr *RecordingReader) readElement() (string, byte, error) {
+	prefix, err := rr.r.ReadString('.')
+	if err != nil {
+		if err == io.EOF && strings.TrimSpace(prefix) != "" {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", 0, err
+	}
+	length, err := strconv.Atoi(strings.TrimSpace(prefix[:len(prefix)-1]))
+	if err != nil {
+		return "", 0, ErrServer.NewError("Non-numeric character in element length:", prefix)
+	}
+	var element strings.Builder
+	for i := 0; i < length; i++ {
+		r, _, err := rr.r.ReadRune()
+		if err != nil {
+			return "", 0, io.ErrUnexpectedEOF
+		}
+		element.WriteRune(r)
+	}
+	terminator, err := rr.r.ReadByte()
+	if err != nil {
+		return "", 0, io.ErrUnexpectedEOF
+	}
+	return element.String(), terminator, nil
+}
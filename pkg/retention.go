@@ -0,0 +1,228 @@
+package guac
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/appaegis/golang-common/pkg/config"
+	"github.com/appaegis/golang-common/pkg/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/wwt/guac/lib/logging"
+	"github.com/wwt/guac/lib/settings"
+)
+
+const (
+	// uploadIndexDir keeps an UploadRecord per uploaded recording, relative to the recording dir
+	uploadIndexDir = "uploads"
+	// reapingSuffix marks an upload record claimed by a reaper, a claim older
+	// than reapingClaimTimeout was left by a crashed reaper and is taken over
+	reapingSuffix       = ".reaping"
+	reapingClaimTimeout = time.Hour
+)
+
+// UploadRecord is the index entry of an uploaded recording, the reaper deletes
+// Keys from storage when the retention of the recording expires.
+type UploadRecord struct {
+	Info     logging.LoggingInfo `json:"info"`
+	Keys     []string            `json:"keys"`
+	Uploaded time.Time           `json:"uploaded"`
+}
+
+// recordingDeleter is implemented by storages which can delete recordings
+type recordingDeleter interface {
+	DeleteRdp(key string) error
+}
+
+func init() {
+	settings.StorageDeletes = storageDeletes
+}
+
+// storageDeletes returns if the storage of a tenant can delete recordings
+func storageDeletes(tenantID string) bool {
+	s, _ := storage.GetStorageByTenantId(tenantID, config.GetRegion())
+	_, ok := s.(recordingDeleter)
+	return ok
+}
+
+// ReapRecordings enforces the retention settings on the recordings in /efs/rdp and in storage
+func ReapRecordings() {
+	now := time.Now()
+	reapRawRecordings("/efs/rdp", now)
+	reapUploadedRecordings("/efs/rdp", now, deleteStoredRecording)
+}
+
+func deleteStoredRecording(info logging.LoggingInfo, key string) error {
+	s, _ := storage.GetStorageByTenantId(info.TenantId, config.GetRegion())
+	deleter, ok := s.(recordingDeleter)
+	if !ok {
+		return fmt.Errorf("storage of tenant %s cannot delete recordings", info.TenantId)
+	}
+	return deleter.DeleteRdp(key)
+}
+
+// saveUploadRecord adds an uploaded recording to the upload index
+func saveUploadRecord(dir string, info logging.LoggingInfo, keys []string) error {
+	if err := os.MkdirAll(filepath.Join(dir, uploadIndexDir), 0o777); err != nil {
+		return err
+	}
+	data, err := json.Marshal(UploadRecord{Info: info, Keys: keys, Uploaded: time.Now()})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, uploadIndexDir, info.GetRecordingFileName()+".json"), data, 0o744)
+}
+
+// recordingInfo returns the logging info kept next to a raw recording, recordings
+// without one are attributed to nobody and get the default retention
+func recordingInfo(dir, name string) logging.LoggingInfo {
+	var info logging.LoggingInfo
+	data, err := os.ReadFile(filepath.Join(dir, name+logging.RecordingInfoSuffix))
+	if err == nil {
+		err = json.Unmarshal(data, &info)
+	}
+	if err != nil {
+		logrus.Infof("no recording info of %s: %v", name, err)
+	}
+	return info
+}
+
+// isRecordingArtifact returns the raw recording a file was built from
+func isRecordingArtifact(name string) (string, bool) {
+	for _, suffix := range recordingArtifactSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix), true
+		}
+	}
+	return "", false
+}
+
+// reapRawRecordings deletes raw recordings which were not uploaded within their
+// raw retention, and artifacts whose raw recording is gone.
+func reapRawRecordings(dir string, now time.Time) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		logrus.Errorf("cannot read recording dir %s: %v", dir, err)
+		return
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		name := entry.Name()
+		if raw, ok := isRecordingArtifact(name); ok {
+			// the encoder removes the artifacts with the raw recording, leftovers are from crashes
+			if _, e := os.Stat(filepath.Join(dir, raw)); os.IsNotExist(e) && now.Sub(fi.ModTime()) > 24*time.Hour {
+				os.Remove(filepath.Join(dir, name))
+			}
+			continue
+		}
+
+		info := recordingInfo(dir, name)
+		retention := settings.Retention(info.TenantId, info.AppId)
+		// an active session keeps writing its recording
+		if retention.RawTTL <= 0 || now.Sub(fi.ModTime()) < time.Duration(retention.RawTTL)*time.Hour {
+			continue
+		}
+		if retention.Held(info.Email) {
+			logrus.Infof("recording %s is on legal hold, keep it", name)
+			continue
+		}
+		if err = os.Remove(filepath.Join(dir, name)); err != nil {
+			logrus.Errorf("cannot delete recording %s: %v", name, err)
+			continue
+		}
+		for _, suffix := range recordingArtifactSuffixes {
+			os.Remove(filepath.Join(dir, name+suffix))
+		}
+		logrus.Infof("deleted recording %s, not uploaded within %d hours", name, retention.RawTTL)
+		logging.Log(logging.Action{
+			AppTag:    "rdp.recording.delete",
+			TenantID:  info.TenantId,
+			AppID:     info.AppId,
+			AppName:   info.AppName,
+			UserEmail: info.Email,
+			Files:     []string{name},
+			Reason:    fmt.Sprintf("raw recording not uploaded within %d hours", retention.RawTTL),
+		})
+	}
+}
+
+// reapUploadedRecordings deletes uploaded recordings from storage after their storage retention
+func reapUploadedRecordings(dir string, now time.Time, deleteKey func(logging.LoggingInfo, string) error) {
+	indexDir := filepath.Join(dir, uploadIndexDir)
+	entries, err := os.ReadDir(indexDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.Errorf("cannot read upload index %s: %v", indexDir, err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		path := filepath.Join(indexDir, entry.Name())
+		if strings.HasSuffix(path, reapingSuffix) {
+			fi, e := entry.Info()
+			if e != nil || now.Sub(fi.ModTime()) < reapingClaimTimeout {
+				continue
+			}
+			path = strings.TrimSuffix(path, reapingSuffix)
+			if e = os.Rename(path+reapingSuffix, path); e != nil {
+				continue
+			}
+		}
+		if !strings.HasSuffix(path, ".json") {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var record UploadRecord
+		if err = json.Unmarshal(data, &record); err != nil {
+			logrus.Errorf("invalid upload record %s: %v", path, err)
+			continue
+		}
+		retention := settings.Retention(record.Info.TenantId, record.Info.AppId)
+		if retention.StorageTTL <= 0 || now.Sub(record.Uploaded) < time.Duration(retention.StorageTTL)*time.Hour {
+			continue
+		}
+		if retention.Held(record.Info.Email) {
+			continue
+		}
+		reapUploadedRecording(path, record, retention, now, deleteKey)
+	}
+}
+
+func reapUploadedRecording(path string, record UploadRecord, retention settings.RetentionSettings, now time.Time, deleteKey func(logging.LoggingInfo, string) error) {
+	// guac runs several replicas, the one renaming the record deletes the recording
+	claimed := path + reapingSuffix
+	if err := os.Rename(path, claimed); err != nil {
+		return
+	}
+	_ = os.Chtimes(claimed, now, now)
+	for _, key := range record.Keys {
+		if err := deleteKey(record.Info, key); err != nil {
+			logrus.Errorf("cannot delete %s from storage: %v", key, err)
+			os.Rename(claimed, path)
+			return
+		}
+	}
+	os.Remove(claimed)
+	logrus.Infof("deleted recording %s from storage, uploaded %s", record.Info.GetRecordingFileName(), record.Uploaded)
+	logging.Log(logging.Action{
+		AppTag:    "rdp.recording.delete",
+		TenantID:  record.Info.TenantId,
+		AppID:     record.Info.AppId,
+		AppName:   record.Info.AppName,
+		UserEmail: record.Info.Email,
+		Files:     record.Keys,
+		Reason:    fmt.Sprintf("storage retention of %d hours expired", retention.StorageTTL),
+	})
+}
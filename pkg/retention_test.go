@@ -0,0 +1,111 @@
+package guac
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wwt/guac/lib/logging"
+	"github.com/wwt/guac/lib/settings"
+)
+
+func TestReapRawRecordings(t *testing.T) {
+	s := settings.Defaults()
+	s.Tenants = map[string]*settings.TenantScope{
+		"held": {Scope: settings.Scope{Retention: &settings.RetentionSettings{RawTTL: 1, LegalHold: true}}},
+	}
+	settings.Set(s)
+	defer settings.Set(settings.Defaults())
+
+	dir := t.TempDir()
+	old := time.Now().Add(-8 * 24 * time.Hour)
+	write := func(name string, mtime time.Time) {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, name), []byte("x"), 0o644))
+		assert.Nil(t, os.Chtimes(filepath.Join(dir, name), mtime, mtime))
+	}
+	// crashed session past the default retention of a week
+	write("a@b.com-crashed", old)
+	write("a@b.com-crashed.events", old)
+	// session still being recorded
+	write("a@b.com-active", time.Now())
+	// recording of a tenant on legal hold
+	write("c@d.com-held", old)
+	info, _ := json.Marshal(logging.LoggingInfo{TenantId: "held", Email: "c@d.com", S3Key: "held"})
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "c@d.com-held"+logging.RecordingInfoSuffix), info, 0o644))
+	// artifact left behind after the raw recording was removed
+	write("e@f.com-gone.mp4", old)
+
+	reapRawRecordings(dir, time.Now())
+
+	for name, exists := range map[string]bool{
+		"a@b.com-crashed":        false,
+		"a@b.com-crashed.events": false,
+		"a@b.com-active":         true,
+		"c@d.com-held":           true,
+		"e@f.com-gone.mp4":       false,
+	} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		assert.Equal(t, exists, err == nil, name)
+	}
+}
+
+func TestReapUploadedRecordings(t *testing.T) {
+	s := settings.Defaults()
+	s.Tenants = map[string]*settings.TenantScope{
+		"t1": {
+			Scope: settings.Scope{Retention: &settings.RetentionSettings{StorageTTL: 24, LegalHoldUsers: []string{"Held@b.com"}}},
+		},
+	}
+	settings.Set(s)
+	defer settings.Set(settings.Defaults())
+
+	dir := t.TempDir()
+	for _, info := range []logging.LoggingInfo{
+		{TenantId: "t1", Email: "a@b.com", S3Key: "1"},
+		{TenantId: "t1", Email: "held@b.com", S3Key: "2"},
+		{TenantId: "t2", Email: "a@b.com", S3Key: "3"},
+	} {
+		assert.Nil(t, saveUploadRecord(dir, info, []string{info.S3Key + ".mp4", info.S3Key + ".keys.txt"}))
+	}
+
+	var deleted []string
+	deleteKey := func(info logging.LoggingInfo, key string) error {
+		deleted = append(deleted, key)
+		return nil
+	}
+	reapUploadedRecordings(dir, time.Now(), deleteKey)
+	assert.Empty(t, deleted)
+
+	// only t1 has a storage retention and held@b.com is on legal hold
+	reapUploadedRecordings(dir, time.Now().Add(25*time.Hour), deleteKey)
+	assert.Equal(t, []string{"1.mp4", "1.keys.txt"}, deleted)
+	entries, _ := os.ReadDir(filepath.Join(dir, uploadIndexDir))
+	assert.Equal(t, 2, len(entries))
+}
+
+func TestStorageTTLNeedsDeletingStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settings.json")
+	assert.Nil(t, os.WriteFile(path, []byte(`{
+		"default": {"retention": {"rawTTL": 24, "storageTTL": 24}},
+		"tenants": {
+			"t1": {"retention": {"storageTTL": 48}},
+			"t2": {"retention": {"storageTTL": 48}, "apps": {"a1": {"retention": {"storageTTL": 72}}}}
+		}
+	}`), 0o644))
+	t.Setenv("GUAC_SETTINGS", path)
+	deletes := settings.StorageDeletes
+	settings.StorageDeletes = func(tenantID string) bool { return tenantID == "t1" }
+	defer func() { settings.StorageDeletes = deletes }()
+	settings.Init()
+	defer settings.Set(settings.Defaults())
+
+	// the recordings are only deleted from the storage of tenants whose storage can
+	assert.Equal(t, 48, settings.Retention("t1", "a1").StorageTTL)
+	assert.Equal(t, 0, settings.Retention("t2", "a1").StorageTTL)
+	assert.Equal(t, 0, settings.Retention("t2", "a2").StorageTTL)
+	assert.Equal(t, 0, settings.Retention("t3", "a1").StorageTTL)
+	assert.Equal(t, 24, settings.Retention("t3", "a1").RawTTL)
+}
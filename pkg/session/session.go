@@ -1,6 +1,7 @@
 package session
 
 import (
+	"sync/atomic"
 	"time"
 
 	"github.com/appaegis/golang-common/pkg/db_data/schema"
@@ -22,12 +23,32 @@ type SessionCommonData struct {
 	RoleIDs          []string
 	SessionStartTime time.Time
 
-	Recording         bool
-	MonitorPolicyId   string
-	MonitorPolicyName string
-	MonitorRules      map[string]*schema.MonitorPolicyRule
+	Recording     bool
+	RecordingName string
+	// monitor is replaced as a whole as the policy changes during the session, see Monitor
+	monitor atomic.Pointer[MonitorPolicy]
 
 	RdpSessionId string
 	GuacdAddr    string
 	Websocket    *websocket.Conn
 }
+
+// MonitorPolicy is the monitor policy of the app of a session and its rules for the host
+type MonitorPolicy struct {
+	Id    string
+	Name  string
+	Rules map[string]*schema.MonitorPolicyRule
+}
+
+// Monitor returns the monitor policy of the session, empty if the app has none
+func (s *SessionCommonData) Monitor() MonitorPolicy {
+	if policy := s.monitor.Load(); policy != nil {
+		return *policy
+	}
+	return MonitorPolicy{}
+}
+
+// SetMonitor replaces the monitor policy of the session, the rules mustn't be changed afterwards
+func (s *SessionCommonData) SetMonitor(policy MonitorPolicy) {
+	s.monitor.Store(&policy)
+}
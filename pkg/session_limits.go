@@ -0,0 +1,117 @@
+package guac
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wwt/guac/lib/logging"
+	"github.com/wwt/guac/lib/settings"
+	"github.com/wwt/guac/pkg/session"
+)
+
+const (
+	SessionIdle     = "idle"
+	SessionDuration = "duration"
+
+	defaultSessionLimitWarning = time.Minute
+	// sessionLimitInterval is how often the limits of a room are checked
+	sessionLimitInterval = 5 * time.Second
+)
+
+// nextSessionLimit returns the limit which a session reaches first and when, an empty
+// limit if the session has none
+func nextSessionLimit(cfg settings.SessionLimitSettings, start, lastInput time.Time) (string, time.Time) {
+	var limit string
+	var deadline time.Time
+	if cfg.IdleTimeout > 0 {
+		limit, deadline = SessionIdle, lastInput.Add(time.Duration(cfg.IdleTimeout)*time.Minute)
+	}
+	if cfg.MaxDuration > 0 {
+		if end := start.Add(time.Duration(cfg.MaxDuration) * time.Minute); limit == "" || end.Before(deadline) {
+			limit, deadline = SessionDuration, end
+		}
+	}
+	return limit, deadline
+}
+
+// touch records key or mouse input of a participant
+func (r *RdpSessionRoom) touch() {
+	if r != nil {
+		r.lastInput.Store(time.Now().UnixNano())
+	}
+}
+
+// enforceLimits checks the limits of the session until the room is closed
+func (r *RdpSessionRoom) enforceLimits(ses *session.SessionCommonData) {
+	if ses == nil {
+		return
+	}
+	ticker := time.NewTicker(sessionLimitInterval)
+	defer ticker.Stop()
+	var warned time.Time
+	for {
+		select {
+		case <-r.done:
+			return
+		case now := <-ticker.C:
+			if r.checkLimits(ses, now, &warned) {
+				return
+			}
+		}
+	}
+}
+
+// checkLimits warns the participants once before a limit and disconnects them when it
+// is reached, which closes the room. warned is the deadline last warned about.
+func (r *RdpSessionRoom) checkLimits(ses *session.SessionCommonData, now time.Time, warned *time.Time) bool {
+	cfg := settings.Limits(ses.TenantID, ses.AppID)
+	limit, deadline := nextSessionLimit(cfg, ses.SessionStartTime, time.Unix(0, r.lastInput.Load()))
+	if limit == "" {
+		return false
+	}
+	if remaining := deadline.Sub(now); remaining > 0 {
+		warning := time.Duration(cfg.Warning) * time.Second
+		if warning <= 0 {
+			warning = defaultSessionLimitWarning
+		}
+		if remaining <= warning && !deadline.Equal(*warned) {
+			*warned = deadline
+			r.broadcast(NewInstruction(SESSION_LIMIT, limit, strconv.Itoa(int(remaining.Seconds()))))
+		}
+		return false
+	}
+
+	logrus.Infof("session %s reached the %s limit, close it", r.SessionId, limit)
+	logging.Log(logging.Action{
+		Session:         ses,
+		AppTag:          "rdp.timeout",
+		UserEmail:       r.Creator,
+		ClientIP:        ses.ClientIP,
+		ClientPrivateIp: ses.ClientPrivateIp,
+		Destination:     ses.ServerName,
+		Reason:          limit,
+	})
+	r.broadcast(NewInstruction(SESSION_LIMIT, limit, "0"))
+	r.disconnect()
+	return true
+}
+
+func (r *RdpSessionRoom) broadcast(ins *Instruction) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, u := range r.Users {
+		u.WriteMessage(ins)
+	}
+}
+
+// disconnect closes the connections of the participants, their leaving closes the room
+func (r *RdpSessionRoom) disconnect() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, u := range r.Users {
+		if e := u.Websocket.Close(); e != nil {
+			logrus.Errorf("close %s ws failed %v", u.UserId, e)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package guac
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wwt/guac/lib/logging"
+	"github.com/wwt/guac/lib/settings"
+	"github.com/wwt/guac/pkg/session"
+)
+
+func TestNextSessionLimit(t *testing.T) {
+	start := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	input := start.Add(50 * time.Minute)
+
+	limit, _ := nextSessionLimit(settings.SessionLimitSettings{}, start, input)
+	assert.Empty(t, limit)
+
+	limit, deadline := nextSessionLimit(settings.SessionLimitSettings{IdleTimeout: 15, MaxDuration: 60}, start, input)
+	assert.Equal(t, SessionDuration, limit)
+	assert.Equal(t, start.Add(time.Hour), deadline)
+
+	limit, deadline = nextSessionLimit(settings.SessionLimitSettings{IdleTimeout: 5, MaxDuration: 60}, start, input)
+	assert.Equal(t, SessionIdle, limit)
+	assert.Equal(t, input.Add(5*time.Minute), deadline)
+}
+
+func TestCheckSessionLimits(t *testing.T) {
+	s := settings.Defaults()
+	s.Default.Limits = &settings.SessionLimitSettings{IdleTimeout: 10, Warning: 120}
+	settings.Set(s)
+	defer settings.Set(settings.Defaults())
+
+	ses := &session.SessionCommonData{TenantID: "t1", AppID: "a1", Email: "host@appaegis.com", RdpSessionId: "limit-session", SessionStartTime: time.Now()}
+	ws := &fakeWriterCloser{}
+	NewRdpSessionRoom(ses.RdpSessionId, ses.Email, ws, "c1", true, "a1", "app", logging.LoggingInfo{})
+	room, _ := GetRdpSessionRoom(ses.RdpSessionId)
+	defer delete(rdpRooms, ses.RdpSessionId)
+	input := time.Unix(0, room.lastInput.Load())
+
+	var warned time.Time
+	assert.False(t, room.checkLimits(ses, input.Add(5*time.Minute), &warned))
+	assert.Empty(t, ws.Messages)
+
+	// warned once before the limit
+	assert.False(t, room.checkLimits(ses, input.Add(9*time.Minute), &warned))
+	assert.False(t, room.checkLimits(ses, input.Add(9*time.Minute+30*time.Second), &warned))
+	assert.Equal(t, 1, len(ws.Messages))
+	assert.Equal(t, NewInstruction(SESSION_LIMIT, SessionIdle, "60").Byte(), ws.Messages[0])
+
+	// input moves the deadline
+	room.touch()
+	assert.False(t, room.checkLimits(ses, input.Add(10*time.Minute), &warned))
+	assert.False(t, ws.Closed)
+
+	assert.True(t, room.checkLimits(ses, time.Now().Add(10*time.Minute), &warned))
+	assert.Equal(t, NewInstruction(SESSION_LIMIT, SessionIdle, "0").Byte(), ws.Messages[len(ws.Messages)-1])
+	assert.True(t, ws.Closed)
+}
@@ -0,0 +1,146 @@
+package guac
+
+import (
+	"sync"
+	"time"
+
+	"github.com/wwt/guac/lib/logging"
+	"github.com/wwt/guac/pkg/session"
+)
+
+// maxSummaryTransfers bounds the file transfers listed in a session summary, the
+// counts include all of them
+const maxSummaryTransfers = 256
+
+// sessionStats counts what happens in a session for the summary logged when it closes
+type sessionStats struct {
+	lock             sync.Mutex
+	participants     []logging.SessionParticipant
+	transfers        []logging.FileTransfer
+	uploads          int
+	downloads        int
+	blockedUploads   int
+	blockedDownloads int
+	// tunnels are those of all participants, their traffic is summed when summarized
+	tunnels []Tunnel
+	// traffic is counted by the relays of all participants
+	traffic sessionTraffic
+}
+
+func (s *sessionStats) joined(user, role string, at time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.participants = append(s.participants, logging.SessionParticipant{UserEmail: user, Role: role, Joined: at})
+}
+
+func (s *sessionStats) left(user, reason string, at time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := len(s.participants) - 1; i >= 0; i-- {
+		if p := &s.participants[i]; p.UserEmail == user && p.Left.IsZero() {
+			p.Left, p.LeftReason = at, reason
+			return
+		}
+	}
+}
+
+// addTunnel counts the traffic of the tunnel of a participant
+func (s *sessionStats) addTunnel(tunnel Tunnel) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tunnels = append(s.tunnels, tunnel)
+}
+
+func (s *sessionStats) addTransfer(transfer logging.FileTransfer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch {
+	case transfer.Direction == FileUpload && transfer.Blocked:
+		s.blockedUploads++
+	case transfer.Direction == FileUpload:
+		s.uploads++
+	case transfer.Blocked:
+		s.blockedDownloads++
+	default:
+		s.downloads++
+	}
+	if len(s.transfers) < maxSummaryTransfers {
+		s.transfers = append(s.transfers, transfer)
+	}
+}
+
+// summary returns the summary of a session ending at end, the participants still
+// connected leave at end
+func (s *sessionStats) summary(start, end time.Time) *logging.SessionSummary {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	participants := make([]logging.SessionParticipant, 0, len(s.participants))
+	for _, p := range s.participants {
+		if p.Left.IsZero() {
+			p.Left, p.LeftReason = end, LeaveRoomClosed
+		}
+		participants = append(participants, p)
+	}
+	traffic := TunnelTraffic{}
+	for _, tunnel := range s.tunnels {
+		t := tunnel.Traffic()
+		traffic.FromGuacd += t.FromGuacd
+		traffic.ToGuacd += t.ToGuacd
+	}
+	return &logging.SessionSummary{
+		Start:            start,
+		End:              end,
+		DurationSeconds:  int64(end.Sub(start).Seconds()),
+		Participants:     participants,
+		BytesToClient:    traffic.FromGuacd,
+		BytesFromClient:  traffic.ToGuacd,
+		Traffic:          s.traffic.counts(),
+		Uploads:          s.uploads,
+		Downloads:        s.downloads,
+		BlockedUploads:   s.blockedUploads,
+		BlockedDownloads: s.blockedDownloads,
+		FileTransfers:    append([]logging.FileTransfer{}, s.transfers...),
+	}
+}
+
+// recordTransfer counts file transfers in the summary of the session
+func recordTransfer(ses *session.SessionCommonData, direction, user string, files []string, blocked bool) {
+	if ses == nil {
+		return
+	}
+	room, ok := lookupRdpSessionRoom(ses.RdpSessionId)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	for _, file := range files {
+		room.stats.addTransfer(logging.FileTransfer{Time: now, Direction: direction, UserEmail: user, File: file, Blocked: blocked})
+	}
+}
+
+// logSummary logs the summary of the session of the room as it closes, with the
+// S3Key of its recording. The recording log has the full storage key once it's
+// uploaded, with the session id of the summary.
+func (r *RdpSessionRoom) logSummary(ses *session.SessionCommonData) {
+	start, recording := time.Now(), false
+	if r.loggingInfo != nil {
+		start = r.loggingInfo.StartTime
+		recording = r.loggingInfo.EnableRecording
+	}
+	action := logging.Action{
+		Session:   ses,
+		AppTag:    "rdp.summary",
+		UserEmail: r.Creator,
+		Summary:   r.stats.summary(start, time.Now()),
+	}
+	if recording {
+		action.Summary.RecordingS3Key = r.loggingInfo.S3Key
+	}
+	if ses != nil {
+		action.ClientIP = ses.ClientIP
+		action.ClientPrivateIp = ses.ClientPrivateIp
+		action.Destination = ses.ServerName
+		action.Recording = recording
+	}
+	logging.Log(action)
+}
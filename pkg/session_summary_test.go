@@ -0,0 +1,105 @@
+package guac
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/wwt/guac/lib/logging"
+	"github.com/wwt/guac/mocks"
+	"github.com/wwt/guac/pkg/session"
+)
+
+type trafficTunnel struct {
+	fakeTunnel
+	traffic TunnelTraffic
+}
+
+func (t *trafficTunnel) Traffic() TunnelTraffic {
+	return t.traffic
+}
+
+// loggedSummary returns the summary logged to out
+func loggedSummary(t *testing.T, out string) *logging.SessionSummary {
+	return loggedSummaryAction(t, out).Summary
+}
+
+// loggedSummaryAction returns the action of the summary logged to out
+func loggedSummaryAction(t *testing.T, out string) logging.Action {
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.Contains(line, `"app_tag":"rdp.summary"`) {
+			continue
+		}
+		action := logging.Action{}
+		assert.Nil(t, json.Unmarshal([]byte(line[strings.IndexByte(line, '{'):]), &action))
+		return action
+	}
+	t.Fatalf("no summary in %s", out)
+	return logging.Action{}
+}
+
+func TestSessionSummaryOnClose(t *testing.T) {
+	db := new(mocks.DbAccess)
+	dbAccess = db
+	db.On("DeleteRdpSession", mock.Anything).Return(nil)
+
+	sessionId := "summary-session"
+	ses := &session.SessionCommonData{RdpSessionId: sessionId, Email: "host@appaegis.com", ServerName: "desktop"}
+	SessionDataStore.Set(sessionId, ses)
+	start := time.Now().Add(-time.Hour)
+	NewRdpSessionRoom(sessionId, ses.Email, &fakeWriterCloser{}, "c1", true, "a1", "app", logging.LoggingInfo{StartTime: start})
+	room, _ := GetRdpSessionRoom(sessionId)
+	_, _ = JoinRoom(sessionId, "viewer@appaegis.com", &fakeWriterCloser{}, "mouse")
+	room.stats.addTunnel(&trafficTunnel{traffic: TunnelTraffic{FromGuacd: 1000, ToGuacd: 100}})
+	room.stats.addTunnel(&trafficTunnel{traffic: TunnelTraffic{FromGuacd: 500, ToGuacd: 50}})
+	recordTransfer(ses, FileUpload, ses.Email, []string{"a.txt", "b.txt"}, false)
+	recordTransfer(ses, FileDownload, "viewer@appaegis.com", []string{"c.txt"}, true)
+	_ = LeaveRoom(ses, sessionId, "viewer@appaegis.com", "", "", LeaveClosed)
+
+	out := bytes.Buffer{}
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	_ = LeaveRoom(ses, sessionId, ses.Email, "", "", LeaveClosed)
+
+	summary := loggedSummary(t, out.String())
+	assert.Equal(t, start.Unix(), summary.Start.Unix())
+	assert.InDelta(t, 3600, summary.DurationSeconds, 5)
+	assert.Equal(t, int64(1500), summary.BytesToClient)
+	assert.Equal(t, int64(150), summary.BytesFromClient)
+	assert.Equal(t, 2, summary.Uploads)
+	assert.Equal(t, 0, summary.Downloads)
+	assert.Equal(t, 1, summary.BlockedDownloads)
+	assert.Len(t, summary.FileTransfers, 3)
+	assert.Empty(t, summary.RecordingS3Key)
+
+	assert.Len(t, summary.Participants, 2)
+	assert.Equal(t, ROLE_ADMIN, summary.Participants[0].Role)
+	assert.Equal(t, "viewer@appaegis.com", summary.Participants[1].UserEmail)
+	assert.Equal(t, ROLE_VIEWER, summary.Participants[1].Role)
+	assert.False(t, summary.Participants[1].Left.After(summary.End))
+	assert.Equal(t, LeaveClosed, summary.Participants[1].LeftReason)
+	assert.False(t, summary.Participants[0].Left.IsZero())
+}
+
+func TestSessionSummaryRecording(t *testing.T) {
+	info := logging.LoggingInfo{Email: "host@appaegis.com", S3Key: "k1", EnableRecording: true, StartTime: time.Now()}
+	room := &RdpSessionRoom{Creator: info.Email, loggingInfo: &info}
+
+	out := bytes.Buffer{}
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	room.logSummary(&session.SessionCommonData{Email: info.Email, RdpSessionId: "recorded-session"})
+
+	// the recording log has the storage key of the recording for the session id
+	action := loggedSummaryAction(t, out.String())
+	assert.True(t, action.Recording)
+	assert.Equal(t, "recorded-session", action.RdpSessionId)
+	assert.Equal(t, "k1", action.Summary.RecordingS3Key)
+	assert.NotContains(t, out.String(), info.GetRecordingFileName())
+}
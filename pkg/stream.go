@@ -3,6 +3,7 @@ package guac
 import (
 	"fmt"
 	"net"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 
@@ -28,6 +29,10 @@ type Stream struct {
 	parseStart int
 	buffer     []byte
 	reset      []byte
+
+	// bytesRead and bytesWritten count the traffic with guacd
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
 }
 
 // NewStream creates a new stream
@@ -47,7 +52,9 @@ func (s *Stream) Write(data []byte) (n int, err error) {
 		logrus.Error(err)
 		return
 	}
-	return s.conn.Write(data)
+	n, err = s.conn.Write(data)
+	s.bytesWritten.Add(int64(n))
+	return
 }
 
 // Available returns true if there are messages buffered
@@ -141,6 +148,7 @@ func (s *Stream) ReadSome() (instruction []byte, err error) {
 		}
 
 		n, err = s.conn.Read(s.buffer[len(s.buffer):cap(s.buffer)])
+		s.bytesRead.Add(int64(n))
 		if err != nil && n == 0 {
 			switch t := err.(type) {
 			case net.Error:
@@ -163,6 +171,11 @@ func (s *Stream) ReadSome() (instruction []byte, err error) {
 	}
 }
 
+// Traffic returns the bytes read from and written to guacd
+func (s *Stream) Traffic() TunnelTraffic {
+	return TunnelTraffic{FromGuacd: s.bytesRead.Load(), ToGuacd: s.bytesWritten.Load()}
+}
+
 // Close closes the underlying network connection
 func (s *Stream) Close() error {
 	return s.conn.Close()
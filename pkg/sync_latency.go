@@ -0,0 +1,160 @@
+package guac
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/wwt/guac/lib/settings"
+	"github.com/wwt/guac/pkg/session"
+)
+
+// maxPendingSyncs bounds the syncs waiting for the echo of a client, the oldest are dropped
+const maxPendingSyncs = 256
+
+type pendingSync struct {
+	timestamp int64
+	sent      time.Time
+}
+
+// syncTracker correlates the syncs relayed to a client with the syncs the client
+// echoes once it rendered the frame. The round trip is the time from the relay of
+// a sync to its echo, the lag is how far, in the frame time of guacd, the last
+// frame the client rendered is behind the last frame relayed to it.
+type syncTracker struct {
+	ses  *session.SessionCommonData
+	user string
+	cfg  settings.LatencySettings
+	rtt  prometheus.Observer
+	lag  prometheus.Observer
+
+	lock     sync.Mutex
+	pending  []pendingSync
+	lastSent int64
+	// lastRTT and lastLag are of the last echo
+	lastRTT time.Duration
+	lastLag time.Duration
+	// streak counts the consecutive syncs on the other side of the slow flag
+	streak int
+	slow   bool
+}
+
+func newSyncTracker(ses *session.SessionCommonData, user string) *syncTracker {
+	return &syncTracker{
+		ses:  ses,
+		user: user,
+		cfg:  settings.Latency(ses.TenantID, ses.AppID),
+		rtt:  syncRoundTrip.WithLabelValues(ses.RdpSessionId, ses.TenantID),
+		lag:  frameLag.WithLabelValues(ses.RdpSessionId, ses.TenantID),
+	}
+}
+
+// syncs returns the sync tracker of the client in the session
+func (c *RdpClient) syncs(ses *session.SessionCommonData) *syncTracker {
+	if c == nil || ses == nil {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.syncTracker == nil {
+		c.syncTracker = newSyncTracker(ses, c.UserId)
+	}
+	return c.syncTracker
+}
+
+// syncTimestamp returns the timestamp of a sync instruction
+func syncTimestamp(ins []byte) (int64, bool) {
+	elements, size := scanInstruction(ins, 2)
+	if size == 0 || len(elements) < 2 || elements[0] != "sync" {
+		return 0, false
+	}
+	timestamp, err := strconv.ParseInt(elements[1], 10, 64)
+	return timestamp, err == nil
+}
+
+// sent records a sync relayed to the client
+func (t *syncTracker) sent(ins []byte, at time.Time) {
+	if t == nil {
+		return
+	}
+	timestamp, ok := syncTimestamp(ins)
+	if !ok {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.pending) >= maxPendingSyncs {
+		t.pending = t.pending[1:]
+	}
+	t.pending = append(t.pending, pendingSync{timestamp: timestamp, sent: at})
+	t.lastSent = timestamp
+}
+
+// acked records a sync echoed by the client, the syncs before it are acknowledged with it
+func (t *syncTracker) acked(ins []byte, at time.Time) {
+	if t == nil {
+		return
+	}
+	timestamp, ok := syncTimestamp(ins)
+	if !ok {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var sent time.Time
+	for len(t.pending) > 0 && t.pending[0].timestamp <= timestamp {
+		if t.pending[0].timestamp == timestamp {
+			sent = t.pending[0].sent
+		}
+		t.pending = t.pending[1:]
+	}
+	if sent.IsZero() {
+		// the sync was dropped from pending or never relayed
+		return
+	}
+	rtt := at.Sub(sent)
+	lag := time.Duration(t.lastSent-timestamp) * time.Millisecond
+	t.lastRTT, t.lastLag = rtt, lag
+	t.rtt.Observe(rtt.Seconds())
+	t.lag.Observe(lag.Seconds())
+	t.flag(rtt, lag)
+}
+
+// flag flags the participant as slow after SlowSamples slow syncs in a row, and
+// clears it after as many fast ones
+func (t *syncTracker) flag(rtt, lag time.Duration) {
+	if t.cfg.SlowSamples <= 0 {
+		return
+	}
+	slow := (t.cfg.SlowRoundTrip > 0 && rtt > time.Duration(t.cfg.SlowRoundTrip)*time.Millisecond) ||
+		(t.cfg.SlowLag > 0 && lag > time.Duration(t.cfg.SlowLag)*time.Millisecond)
+	if slow == t.slow {
+		t.streak = 0
+		return
+	}
+	if t.streak++; t.streak < t.cfg.SlowSamples {
+		return
+	}
+	t.slow, t.streak = slow, 0
+	if slow {
+		incSlowSessions(t.ses.TenantID)
+		logrus.Warnf("session %s of %s is slow for %s, round trip %v, lag %v", t.ses.RdpSessionId, t.ses.Email, t.user, rtt, lag)
+	} else {
+		logrus.Infof("session %s of %s recovered for %s, round trip %v, lag %v", t.ses.RdpSessionId, t.ses.Email, t.user, rtt, lag)
+	}
+}
+
+// latency returns the round trip and lag of the last echo, and if the participant is slow
+func (t *syncTracker) latency() (rtt, lag time.Duration, slow bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.lastRTT, t.lastLag, t.slow
+}
+
+// deleteSessionLatencyMetrics removes the metrics of a closed session
+func deleteSessionLatencyMetrics(sessionId, tenantId string) {
+	syncRoundTrip.DeleteLabelValues(sessionId, tenantId)
+	frameLag.DeleteLabelValues(sessionId, tenantId)
+}
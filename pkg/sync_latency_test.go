@@ -0,0 +1,93 @@
+package guac
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/wwt/guac/lib/settings"
+	"github.com/wwt/guac/pkg/session"
+)
+
+func syncIns(timestamp int) []byte {
+	return NewInstruction("sync", strconv.Itoa(timestamp)).Byte()
+}
+
+func TestSyncTimestamp(t *testing.T) {
+	timestamp, ok := syncTimestamp([]byte("4.sync,4.1234,1.0;"))
+	assert.True(t, ok)
+	assert.Equal(t, int64(1234), timestamp)
+
+	_, ok = syncTimestamp([]byte("4.sync,3.abc;"))
+	assert.False(t, ok)
+	_, ok = syncTimestamp([]byte("5.mouse,1.1,1.2;"))
+	assert.False(t, ok)
+}
+
+func TestSyncTrackerLatency(t *testing.T) {
+	ses := &session.SessionCommonData{TenantID: "latency-tenant", RdpSessionId: "latency-session"}
+	client := &RdpClient{UserId: "viewer@appaegis.com"}
+	syncs := client.syncs(ses)
+	assert.Same(t, syncs, client.syncs(ses))
+
+	start := time.Now()
+	syncs.sent(syncIns(100), start)
+	syncs.sent(syncIns(150), start.Add(50*time.Millisecond))
+	syncs.sent(syncIns(400), start.Add(300*time.Millisecond))
+
+	// the echo of 150 acknowledges 100 with it
+	syncs.acked(syncIns(150), start.Add(250*time.Millisecond))
+	rtt, lag, slow := syncs.latency()
+	assert.Equal(t, 200*time.Millisecond, rtt)
+	assert.Equal(t, 250*time.Millisecond, lag)
+	assert.False(t, slow)
+	assert.Len(t, syncs.pending, 1)
+
+	// an echo of a sync which isn't pending is ignored
+	syncs.acked(syncIns(100), start.Add(time.Second))
+	rtt, _, _ = syncs.latency()
+	assert.Equal(t, 200*time.Millisecond, rtt)
+
+	observed := testutil.CollectAndCount(syncRoundTrip)
+	deleteSessionLatencyMetrics(ses.RdpSessionId, ses.TenantID)
+	assert.Equal(t, observed-1, testutil.CollectAndCount(syncRoundTrip))
+
+	var none *RdpClient
+	assert.Nil(t, none.syncs(ses))
+	none.syncs(ses).sent(syncIns(1), start)
+}
+
+func TestSyncTrackerSlow(t *testing.T) {
+	s := settings.Defaults()
+	s.Default.Latency = &settings.LatencySettings{SlowRoundTrip: 100, SlowLag: 1000, SlowSamples: 3}
+	settings.Set(s)
+	defer settings.Set(settings.Defaults())
+
+	ses := &session.SessionCommonData{TenantID: "slow-tenant", RdpSessionId: "slow-session"}
+	defer deleteSessionLatencyMetrics(ses.RdpSessionId, ses.TenantID)
+	slowed := testutil.ToFloat64(slowSessions.WithLabelValues("slow-tenant"))
+	syncs := newSyncTracker(ses, "viewer@appaegis.com")
+	echo := func(timestamp int, rtt time.Duration) bool {
+		at := time.Now()
+		syncs.sent(syncIns(timestamp), at)
+		syncs.acked(syncIns(timestamp), at.Add(rtt))
+		_, _, slow := syncs.latency()
+		return slow
+	}
+
+	assert.False(t, echo(1, 200*time.Millisecond))
+	assert.False(t, echo(2, 200*time.Millisecond))
+	// a fast sync breaks the streak
+	assert.False(t, echo(3, 10*time.Millisecond))
+	assert.False(t, echo(4, 200*time.Millisecond))
+	assert.False(t, echo(5, 200*time.Millisecond))
+	assert.True(t, echo(6, 200*time.Millisecond))
+	assert.Equal(t, slowed+1, testutil.ToFloat64(slowSessions.WithLabelValues("slow-tenant")))
+
+	assert.True(t, echo(7, 10*time.Millisecond))
+	assert.True(t, echo(8, 10*time.Millisecond))
+	assert.False(t, echo(9, 10*time.Millisecond))
+	assert.Equal(t, slowed+1, testutil.ToFloat64(slowSessions.WithLabelValues("slow-tenant")))
+}
@@ -0,0 +1,331 @@
+package guac
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wwt/guac/lib/logging"
+	"github.com/wwt/guac/lib/settings"
+)
+
+const (
+	timelineVersion = 1
+	// timelineBurstRate is the number of keys and clicks per second which counts as a burst of input
+	timelineBurstRate = 4
+	// timelineBurstGap merges bursts which are at most this many seconds apart
+	timelineBurstGap = 2
+)
+
+// journaled actions shown on the timeline, by app tag
+var timelineEventTypes = map[string]string{
+	"rdp.upload":         "upload",
+	"rdp.download":       "download",
+	"rdp.upload.block":   "upload.block",
+	"rdp.download.block": "download.block",
+	"rdp.join":           "join",
+	"rdp.leave":          "leave",
+}
+
+// ActivityTimeline summarizes a recording for a player UI, offsets are
+// milliseconds from the start of the recording.
+type ActivityTimeline struct {
+	Version    int                 `json:"version"`
+	Start      time.Time           `json:"start"`
+	Duration   int64               `json:"durationMs"`
+	Idle       []TimelinePeriod    `json:"idle"`
+	Bursts     []TimelineBurst     `json:"bursts"`
+	Events     []TimelineEvent     `json:"events"`
+	Thumbnails *TimelineThumbnails `json:"thumbnails,omitempty"`
+}
+
+// TimelinePeriod is a period of a recording
+type TimelinePeriod struct {
+	Start int64 `json:"startMs"`
+	End   int64 `json:"endMs"`
+}
+
+// TimelineBurst is a period of heavy input
+type TimelineBurst struct {
+	TimelinePeriod
+	Keys   int `json:"keys"`
+	Clicks int `json:"clicks"`
+}
+
+// TimelineEvent is a session event such as a file transfer or a share join
+type TimelineEvent struct {
+	Offset int64    `json:"offsetMs"`
+	Type   string   `json:"type"`
+	User   string   `json:"user"`
+	Files  []string `json:"files,omitempty"`
+	Reason string   `json:"reason,omitempty"`
+}
+
+// TimelineThumbnails describes the sprite sheet of thumbnails, thumbnail n is
+// taken at n*Interval seconds and placed row by row.
+type TimelineThumbnails struct {
+	Key      string `json:"key"`
+	Interval int    `json:"interval"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Columns  int    `json:"columns"`
+	Rows     int    `json:"rows"`
+	Count    int    `json:"count"`
+}
+
+type inputSecond struct {
+	keys   int
+	clicks int
+}
+
+// BuildActivityTimeline reads the input of a recording and the journal of the session
+func BuildActivityTimeline(recording io.Reader, journal io.Reader, idleThreshold time.Duration) (*ActivityTimeline, error) {
+	reader := NewRecordingReader(recording)
+	timeline := &ActivityTimeline{Version: timelineVersion}
+
+	var start, now, lastInput time.Time
+	seconds := map[int64]*inputSecond{}
+	mouseMask := "0"
+	input := func(t time.Time, key, click bool) {
+		if start.IsZero() {
+			start = t
+		}
+		if !lastInput.IsZero() && t.Sub(lastInput) >= idleThreshold {
+			timeline.Idle = append(timeline.Idle, TimelinePeriod{
+				Start: lastInput.Sub(start).Milliseconds(),
+				End:   t.Sub(start).Milliseconds(),
+			})
+		} else if lastInput.IsZero() && t.Sub(start) >= idleThreshold {
+			timeline.Idle = append(timeline.Idle, TimelinePeriod{End: t.Sub(start).Milliseconds()})
+		}
+		lastInput = t
+		second := t.Sub(start).Milliseconds() / 1000
+		if seconds[second] == nil {
+			seconds[second] = &inputSecond{}
+		}
+		if key {
+			seconds[second].keys++
+		}
+		if click {
+			seconds[second].clicks++
+		}
+	}
+	for {
+		ins, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logrus.Infof("stop reading recording for timeline: %v", err)
+			break
+		}
+		switch ins.Opcode {
+		case "sync":
+			if len(ins.Args) > 0 {
+				if ts, e := parseGuacTimestamp(ins.Args[0]); e == nil {
+					now = ts
+					if start.IsZero() {
+						start = ts
+					}
+				}
+			}
+		case "key":
+			if len(ins.Args) >= 2 && ins.Args[1] == "1" {
+				input(instructionTime(ins, 2, now), true, false)
+			}
+		case "mouse":
+			if len(ins.Args) >= 3 {
+				click := ins.Args[2] != mouseMask && ins.Args[2] != "0"
+				mouseMask = ins.Args[2]
+				input(instructionTime(ins, 3, now), false, click)
+			}
+		}
+	}
+	if start.IsZero() {
+		return nil, fmt.Errorf("recording has no frames")
+	}
+	timeline.Start = start
+	timeline.Duration = now.Sub(start).Milliseconds()
+	if lastInput.IsZero() {
+		lastInput = start
+	}
+	if now.Sub(lastInput) >= idleThreshold {
+		timeline.Idle = append(timeline.Idle, TimelinePeriod{
+			Start: lastInput.Sub(start).Milliseconds(),
+			End:   timeline.Duration,
+		})
+	}
+	timeline.Bursts = inputBursts(seconds)
+
+	if journal != nil {
+		timeline.Events = journalEvents(journal, start)
+	}
+	return timeline, nil
+}
+
+// instructionTime returns the timestamp argument of a recorded input instruction,
+// guacd before 1.5 didn't record it so fall back to the last sync
+func instructionTime(ins *Instruction, index int, fallback time.Time) time.Time {
+	if len(ins.Args) > index {
+		if ts, e := parseGuacTimestamp(ins.Args[index]); e == nil {
+			return ts
+		}
+	}
+	return fallback
+}
+
+func inputBursts(seconds map[int64]*inputSecond) []TimelineBurst {
+	var last int64
+	for s := range seconds {
+		if s > last {
+			last = s
+		}
+	}
+	var bursts []TimelineBurst
+	var current *TimelineBurst
+	for s := int64(0); s <= last; s++ {
+		in, ok := seconds[s]
+		if !ok || in.keys+in.clicks < timelineBurstRate {
+			continue
+		}
+		if current != nil && s*1000-current.End <= timelineBurstGap*1000 {
+			current.End = (s + 1) * 1000
+		} else {
+			bursts = append(bursts, TimelineBurst{TimelinePeriod: TimelinePeriod{Start: s * 1000, End: (s + 1) * 1000}})
+			current = &bursts[len(bursts)-1]
+		}
+		current.Keys += in.keys
+		current.Clicks += in.clicks
+	}
+	return bursts
+}
+
+func journalEvents(journal io.Reader, start time.Time) []TimelineEvent {
+	var events []TimelineEvent
+	scanner := bufio.NewScanner(journal)
+	scanner.Buffer(make([]byte, 0, MaxGuacMessage), 1024*1024)
+	for scanner.Scan() {
+		var entry logging.JournalEntry
+		if e := json.Unmarshal(scanner.Bytes(), &entry); e != nil {
+			logrus.Errorf("invalid journal entry %v", e)
+			continue
+		}
+		eventType, ok := timelineEventTypes[entry.AppTag]
+		if !ok {
+			continue
+		}
+		offset := entry.Time.Sub(start).Milliseconds()
+		if offset < 0 {
+			offset = 0
+		}
+		events = append(events, TimelineEvent{
+			Offset: offset,
+			Type:   eventType,
+			User:   entry.UserEmail,
+			Files:  entry.Files,
+			Reason: entry.BlockReason,
+		})
+	}
+	return events
+}
+
+// generateThumbnails tiles a thumbnail of every interval of the video into one jpeg
+func generateThumbnails(video, output string, duration time.Duration, cfg settings.TimelineSettings) (*TimelineThumbnails, error) {
+	interval := cfg.ThumbnailInterval
+	count := int(duration/time.Second)/interval + 1
+	columns := cfg.Columns
+	if count < columns {
+		columns = count
+	}
+	rows := (count + columns - 1) / columns
+	// recordings are encoded at 1280x720
+	height := cfg.ThumbnailWidth * 720 / 1280
+	filter := fmt.Sprintf("fps=1/%d,scale=%d:%d,tile=%dx%d", interval, cfg.ThumbnailWidth, height, columns, rows)
+
+	os.Remove(output)
+	out, err := exec.Command("ffmpeg", "-i", video, "-vf", filter, "-frames:v", "1", "-q:v", "5", output).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg thumbnails failed %v: %s", err, out)
+	}
+	return &TimelineThumbnails{
+		Interval: interval,
+		Width:    cfg.ThumbnailWidth,
+		Height:   height,
+		Columns:  columns,
+		Rows:     rows,
+		Count:    count,
+	}, nil
+}
+
+// uploadTimeline stores the thumbnails and the activity timeline next to the
+// recording and returns their keys, keys are empty if not uploaded.
+func uploadTimeline(upload recordingUploader, loggingInfo logging.LoggingInfo, base string) (timelineKey string, thumbnailsKey string) {
+	cfg := settings.Timeline(loggingInfo.TenantId, loggingInfo.AppId)
+	if !cfg.Enabled || cfg.ThumbnailInterval <= 0 || cfg.Columns <= 0 {
+		return "", ""
+	}
+	name := loggingInfo.GetRecordingFileName()
+	raw, err := os.Open(fmt.Sprintf("/efs/rdp/%s", name))
+	if err != nil {
+		logrus.Errorf("cannot open recording for timeline %v", err)
+		return "", ""
+	}
+	defer raw.Close()
+	var journal io.Reader
+	if f, e := os.Open(logging.GetJournalPath(name)); e == nil {
+		defer f.Close()
+		journal = f
+	}
+	timeline, err := BuildActivityTimeline(raw, journal, time.Duration(cfg.IdleThreshold)*time.Second)
+	if err != nil {
+		logrus.Errorf("build timeline of %s failed %v", name, err)
+		return "", ""
+	}
+
+	thumbnailsPath := fmt.Sprintf("/efs/rdp/%s.thumbs.jpg", name)
+	thumbnails, err := generateThumbnails(fmt.Sprintf("/efs/rdp/%s.mp4", name), thumbnailsPath, time.Duration(timeline.Duration)*time.Millisecond, cfg)
+	if err != nil {
+		logrus.Errorf("generate thumbnails of %s failed %v", name, err)
+	} else {
+		key, err := upload(base+".thumbs.jpg", thumbnailsPath)
+		if err != nil {
+			logrus.Errorf("upload thumbnails %s failed %v", key, err)
+		} else {
+			thumbnails.Key = key
+			thumbnailsKey = key
+			timeline.Thumbnails = thumbnails
+		}
+	}
+
+	timelinePath := fmt.Sprintf("/efs/rdp/%s.timeline.json", name)
+	data, err := json.Marshal(timeline)
+	if err != nil {
+		logrus.Errorf("marshal timeline failed %v", err)
+		return "", thumbnailsKey
+	}
+	if err = os.WriteFile(timelinePath, data, 0o744); err != nil {
+		logrus.Errorf("write timeline %s failed %v", timelinePath, err)
+		return "", thumbnailsKey
+	}
+	key, err := upload(base+".timeline.json", timelinePath)
+	if err != nil {
+		logrus.Errorf("upload timeline %s failed %v", key, err)
+		return "", thumbnailsKey
+	}
+	return key, thumbnailsKey
+}
+
+// suffixes of the local files kept next to a raw recording
+var recordingArtifactSuffixes = []string{".mp4", ".m4v", ".keys.txt", ".thumbs.jpg", ".timeline.json", ".events", ".enc", queuedSuffix, logging.RecordingInfoSuffix}
+
+// removeRecordingArtifacts deletes the local files built from a recording
+func removeRecordingArtifacts(name string) {
+	for _, suffix := range recordingArtifactSuffixes {
+		os.Remove(fmt.Sprintf("/efs/rdp/%s%s", name, suffix))
+	}
+}
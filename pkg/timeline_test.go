@@ -0,0 +1,41 @@
+package guac
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildActivityTimeline(t *testing.T) {
+	var recording strings.Builder
+	recording.WriteString("4.sync,13.1700000000000;")
+	// a burst of typing at 70s, after more than a minute without input
+	for i := 0; i < 6; i++ {
+		recording.WriteString(NewInstruction("key", "97", "1", strconv.Itoa(1700000070000+i*100)).String())
+	}
+	recording.WriteString("5.mouse,2.10,2.10,1.1,13.1700000072000;")
+	recording.WriteString("4.sync,13.1700000200000;")
+
+	journal := strings.Join([]string{
+		`{"time":"2023-11-14T22:13:50Z","app_tag":"rdp.join","userEmail":"viewer@appaegis.com"}`,
+		`{"time":"2023-11-14T22:14:00Z","app_tag":"rdp.open","userEmail":"host@appaegis.com"}`,
+		`{"time":"2023-11-14T22:14:30Z","app_tag":"rdp.download.block","userEmail":"host@appaegis.com","files":["a.txt"],"blockReason":"Out of quota"}`,
+	}, "\n")
+
+	timeline, err := BuildActivityTimeline(strings.NewReader(recording.String()), strings.NewReader(journal), time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(200000), timeline.Duration)
+	assert.Equal(t, []TimelinePeriod{{Start: 0, End: 70000}, {Start: 72000, End: 200000}}, timeline.Idle)
+	assert.Equal(t, 1, len(timeline.Bursts))
+	assert.Equal(t, int64(70000), timeline.Bursts[0].Start)
+	assert.Equal(t, 6, timeline.Bursts[0].Keys)
+
+	assert.Equal(t, 2, len(timeline.Events))
+	assert.Equal(t, "join", timeline.Events[0].Type)
+	assert.Equal(t, int64(30000), timeline.Events[0].Offset)
+	assert.Equal(t, "download.block", timeline.Events[1].Type)
+	assert.Equal(t, []string{"a.txt"}, timeline.Events[1].Files)
+}
@@ -0,0 +1,231 @@
+package guac
+
+import (
+	"strconv"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/wwt/guac/lib/logging"
+	"github.com/wwt/guac/pkg/session"
+)
+
+const (
+	TrafficToClient   = "toClient"
+	TrafficFromClient = "fromClient"
+)
+
+var trafficDirections = []string{TrafficToClient, TrafficFromClient}
+
+// opcode classes the traffic is broken down by
+const (
+	classImage = iota
+	classAudio
+	classInput
+	classClipboard
+	classFile
+	classOther
+	numOpcodeClasses
+)
+
+var opcodeClassNames = [numOpcodeClasses]string{"image", "audio", "input", "clipboard", "file", "other"}
+
+// opcodeClasses are the classes of the opcodes, the others are classOther
+var opcodeClasses = map[string]int{
+	"img":       classImage,
+	"png":       classImage,
+	"jpeg":      classImage,
+	"webp":      classImage,
+	"video":     classImage,
+	"audio":     classAudio,
+	"mouse":     classInput,
+	"key":       classInput,
+	"touch":     classInput,
+	"clipboard": classClipboard,
+	"file":      classFile,
+	"put":       classFile,
+	"body":      classFile,
+}
+
+// streamArgs are the args of the streams the opcodes open, their blobs have the class of the opcode
+var streamArgs = map[string]int{
+	"img":       0,
+	"video":     0,
+	"audio":     0,
+	"clipboard": 0,
+	"file":      0,
+	"put":       1,
+	"body":      1,
+}
+
+// trafficCount is the traffic of an opcode class in a direction
+type trafficCount struct {
+	bytes        atomic.Int64
+	instructions atomic.Int64
+}
+
+// sessionTraffic is the traffic of all participants of a session
+type sessionTraffic [2][numOpcodeClasses]trafficCount
+
+// counts returns the classes with traffic
+func (t *sessionTraffic) counts() []logging.TrafficCount {
+	var counts []logging.TrafficCount
+	for d, direction := range trafficDirections {
+		for c := range t[d] {
+			if n := t[d][c].instructions.Load(); n > 0 {
+				counts = append(counts, logging.TrafficCount{
+					Direction:    direction,
+					Class:        opcodeClassNames[c],
+					Bytes:        t[d][c].bytes.Load(),
+					Instructions: n,
+				})
+			}
+		}
+	}
+	return counts
+}
+
+// trafficMeter counts the instructions relayed in a direction of a connection by
+// opcode class, for the session and the metrics of the session and the tenant
+type trafficMeter struct {
+	session *sessionTraffic
+	counts  *[numOpcodeClasses]trafficCount
+	// streams are the classes of the open streams
+	streams             map[string]int
+	bytes               [numOpcodeClasses]prometheus.Counter
+	instructions        [numOpcodeClasses]prometheus.Counter
+	sessionBytes        [numOpcodeClasses]prometheus.Counter
+	sessionInstructions [numOpcodeClasses]prometheus.Counter
+}
+
+// newTrafficMeter returns the meter of a direction of a connection to the session, nil
+// if there is no session
+func newTrafficMeter(direction string, ses *session.SessionCommonData) *trafficMeter {
+	if ses == nil {
+		return nil
+	}
+	m := &trafficMeter{streams: map[string]int{}}
+	if room, ok := lookupRdpSessionRoom(ses.RdpSessionId); ok {
+		m.session = &room.stats.traffic
+	} else {
+		m.session = &sessionTraffic{}
+	}
+	d := 0
+	if direction == TrafficFromClient {
+		d = 1
+	}
+	m.counts = &m.session[d]
+	for c, class := range opcodeClassNames {
+		m.bytes[c] = trafficBytes.WithLabelValues(ses.TenantID, direction, class)
+		m.instructions[c] = trafficInstructions.WithLabelValues(ses.TenantID, direction, class)
+		m.sessionBytes[c] = sessionTrafficBytes.WithLabelValues(ses.RdpSessionId, ses.TenantID, direction, class)
+		m.sessionInstructions[c] = sessionTrafficInstructions.WithLabelValues(ses.RdpSessionId, ses.TenantID, direction, class)
+	}
+	return m
+}
+
+// count counts the instructions of data, which may be several
+func (m *trafficMeter) count(data []byte) {
+	if m == nil {
+		return
+	}
+	for len(data) > 0 {
+		elements, size := scanInstruction(data, 3)
+		if size == 0 {
+			// counts what can't be parsed as it's relayed anyway
+			m.add(classOther, len(data))
+			return
+		}
+		m.add(m.classOf(elements), size)
+		data = data[size:]
+	}
+}
+
+func (m *trafficMeter) classOf(elements []string) int {
+	opcode := elements[0]
+	switch opcode {
+	case "blob", "end":
+		if len(elements) < 2 {
+			return classOther
+		}
+		class, ok := m.streams[elements[1]]
+		if !ok {
+			return classOther
+		}
+		if opcode == "end" {
+			delete(m.streams, elements[1])
+		}
+		return class
+	}
+	class, ok := opcodeClasses[opcode]
+	if !ok {
+		return classOther
+	}
+	if arg, ok := streamArgs[opcode]; ok && arg+1 < len(elements) {
+		m.streams[elements[arg+1]] = class
+	}
+	return class
+}
+
+func (m *trafficMeter) add(class, size int) {
+	m.counts[class].bytes.Add(int64(size))
+	m.counts[class].instructions.Add(1)
+	m.bytes[class].Add(float64(size))
+	m.instructions[class].Inc()
+	m.sessionBytes[class].Add(float64(size))
+	m.sessionInstructions[class].Inc()
+}
+
+// scanInstruction returns the first n elements of the instruction data starts with
+// and its size in bytes, the size is 0 if data doesn't start with a complete instruction.
+// Like the stream, the lengths are in characters.
+func scanInstruction(data []byte, n int) (elements []string, size int) {
+	i := 0
+	for i < len(data) {
+		dot := i
+		for dot < len(data) && data[dot] >= '0' && data[dot] <= '9' {
+			dot++
+		}
+		if dot == i || dot >= len(data) || data[dot] != '.' {
+			return nil, 0
+		}
+		length, err := strconv.Atoi(string(data[i:dot]))
+		if err != nil {
+			return nil, 0
+		}
+		start := dot + 1
+		end := start
+		for c := 0; c < length; c++ {
+			if end >= len(data) {
+				return nil, 0
+			}
+			_, runeSize := utf8.DecodeRune(data[end:])
+			end += runeSize
+		}
+		if end >= len(data) {
+			return nil, 0
+		}
+		if len(elements) < n {
+			elements = append(elements, string(data[start:end]))
+		}
+		i = end + 1
+		switch data[end] {
+		case ';':
+			return elements, i
+		case ',':
+		default:
+			return nil, 0
+		}
+	}
+	return nil, 0
+}
+
+// deleteSessionTrafficMetrics removes the metrics of a closed session
+func deleteSessionTrafficMetrics(sessionId, tenantId string) {
+	for _, direction := range trafficDirections {
+		for _, class := range opcodeClassNames {
+			sessionTrafficBytes.DeleteLabelValues(sessionId, tenantId, direction, class)
+			sessionTrafficInstructions.DeleteLabelValues(sessionId, tenantId, direction, class)
+		}
+	}
+}
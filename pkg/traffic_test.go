@@ -0,0 +1,69 @@
+package guac
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/wwt/guac/lib/logging"
+	"github.com/wwt/guac/pkg/session"
+)
+
+func TestScanInstruction(t *testing.T) {
+	elements, size := scanInstruction([]byte("4.blob,1.3,4.AAAA;5.mouse,1.1;"), 2)
+	assert.Equal(t, []string{"blob", "3"}, elements)
+	assert.Equal(t, len("4.blob,1.3,4.AAAA;"), size)
+
+	// lengths are in characters
+	elements, size = scanInstruction([]byte("4.file,1.1,5.ä.txt;"), 3)
+	assert.Equal(t, []string{"file", "1", "ä.txt"}, elements)
+	assert.Equal(t, len("4.file,1.1,5.ä.txt;"), size)
+
+	_, size = scanInstruction([]byte("4.blob,1.3,4.AA"), 2)
+	assert.Zero(t, size)
+	_, size = scanInstruction([]byte("blob;"), 2)
+	assert.Zero(t, size)
+}
+
+func TestTrafficMeter(t *testing.T) {
+	ses := &session.SessionCommonData{TenantID: "traffic-tenant", RdpSessionId: "traffic-session", Email: "host@appaegis.com"}
+	NewRdpSessionRoom(ses.RdpSessionId, ses.Email, &fakeWriterCloser{}, "c1", true, "a1", "app", logging.LoggingInfo{})
+	room, _ := GetRdpSessionRoom(ses.RdpSessionId)
+	defer delete(rdpRooms, ses.RdpSessionId)
+
+	toClient := newTrafficMeter(TrafficToClient, ses)
+	img := "3.img,1.5,2.14,1.0,9.image/png,1.0,1.0;"
+	blob := "4.blob,1.5,4.AAAA;"
+	end := "3.end,1.5;"
+	toClient.count([]byte(img))
+	toClient.count([]byte(blob))
+	toClient.count([]byte(end))
+	// the stream is closed, a blob of it is no longer an image
+	toClient.count([]byte(blob))
+	toClient.count([]byte("4.sync,3.100;"))
+
+	inputs := testutil.ToFloat64(trafficInstructions.WithLabelValues("traffic-tenant", TrafficFromClient, "input"))
+	fromClient := newTrafficMeter(TrafficFromClient, ses)
+	fromClient.count([]byte("5.mouse,1.1,1.2;3.key,5.65307,1.1;"))
+	fromClient.count([]byte("3.put,1.1,1.7,10.text/plain,5.a.txt;4.blob,1.7,4.AAAA;"))
+	fromClient.count([]byte("9.clipboard,1.2,10.text/plain;4.blob,1.2,4.AAAA;"))
+
+	counts := map[string]logging.TrafficCount{}
+	for _, c := range room.stats.traffic.counts() {
+		counts[c.Direction+"/"+c.Class] = c
+	}
+	assert.Equal(t, int64(len(img+blob+end)), counts["toClient/image"].Bytes)
+	assert.Equal(t, int64(3), counts["toClient/image"].Instructions)
+	assert.Equal(t, int64(2), counts["toClient/other"].Instructions)
+	assert.Equal(t, int64(2), counts["fromClient/input"].Instructions)
+	assert.Equal(t, int64(2), counts["fromClient/file"].Instructions)
+	assert.Equal(t, int64(2), counts["fromClient/clipboard"].Instructions)
+	assert.Len(t, counts, 5)
+
+	assert.Equal(t, inputs+2, testutil.ToFloat64(trafficInstructions.WithLabelValues("traffic-tenant", TrafficFromClient, "input")))
+	assert.Equal(t, float64(len(img+blob+end)), testutil.ToFloat64(sessionTrafficBytes.WithLabelValues("traffic-session", "traffic-tenant", TrafficToClient, "image")))
+
+	deleteSessionTrafficMetrics("traffic-session", "traffic-tenant")
+	assert.Zero(t, testutil.ToFloat64(sessionTrafficBytes.WithLabelValues("traffic-session", "traffic-tenant", TrafficToClient, "image")))
+	assert.Equal(t, inputs+2, testutil.ToFloat64(trafficInstructions.WithLabelValues("traffic-tenant", TrafficFromClient, "input")))
+}
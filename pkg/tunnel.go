@@ -51,6 +51,14 @@ type Tunnel interface {
 	Close() error
 
 	GetLoggingInfo() logging.LoggingInfo
+	// Traffic returns the bytes the tunnel exchanged with guacd
+	Traffic() TunnelTraffic
+}
+
+// TunnelTraffic is the bytes a tunnel exchanged with guacd
+type TunnelTraffic struct {
+	FromGuacd int64
+	ToGuacd   int64
 }
 
 // Base Tunnel implementation which synchronizes access to the underlying reader and writer with locks
@@ -123,6 +131,11 @@ func (t *SimpleTunnel) Close() (err error) {
 	return t.stream.Close()
 }
 
+// Traffic returns the bytes of the underlying stream
+func (t *SimpleTunnel) Traffic() TunnelTraffic {
+	return t.stream.Traffic()
+}
+
 // GetUUID returns the tunnel's UUID
 func (t *SimpleTunnel) GetUUID() string {
 	return t.uuid.String()
@@ -1,26 +1,239 @@
 package guac
 
 import (
+	"errors"
+	"net"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/wwt/guac/lib/settings"
 )
 
+// wsControlQueueSize bounds the control messages queued to a websocket, a client
+// not taking them is disconnected
+const wsControlQueueSize = 256
+
+// the policies of a websocket whose display queue is full, the display is never
+// dropped as its instructions depend on each other
+const (
+	// OverflowDisconnect disconnects the participant
+	OverflowDisconnect = "disconnect"
+	// OverflowBlock waits for the queue up to the write timeout, holding up guacd
+	OverflowBlock = "block"
+)
+
+type wsMessage struct {
+	messageType int
+	data        []byte
+}
+
+// WrappedWebSocket writes to the websocket from a goroutine of its own, so a slow
+// client doesn't hold up its callers. The messages are queued, the control messages
+// are written before the display, and each write has a deadline. Once the display
+// queue is full, the client is disconnected or the display waits for it, as configured. The client is pinged, and reads fail once a pong is late,
+// so a half-open connection doesn't keep a room open.
 type WrappedWebSocket struct {
 	*websocket.Conn
-	mux sync.Mutex
+	cfg       settings.WebsocketSettings
+	overflows prometheus.Counter
+
+	control chan wsMessage
+	display chan wsMessage
+	// closing is closed once the websocket is closing, done once the writer stopped
+	closing chan struct{}
+	done    chan struct{}
+	once    sync.Once
+	err     error
+}
+
+// NewWrappedWebSocket starts the writer of a websocket of a session of the app
+func NewWrappedWebSocket(con *websocket.Conn, tenantId, appId string) *WrappedWebSocket {
+	cfg := settings.Websocket(tenantId, appId)
+	s := &WrappedWebSocket{
+		Conn:      con,
+		cfg:       cfg,
+		overflows: wsOverflows.WithLabelValues(tenantId, cfg.Overflow),
+		control:   make(chan wsMessage, wsControlQueueSize),
+		display:   make(chan wsMessage, cfg.QueueSize),
+		closing:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	limit := int64(cfg.MaxMessageSize)
+	if limit <= 0 {
+		limit = websocketReadBufferSize
+	}
+	con.SetReadLimit(limit)
+	if cfg.PingInterval > 0 {
+		s.extendRead()
+		con.SetPongHandler(func(string) error {
+			s.extendRead()
+			return nil
+		})
+	}
+	go s.write()
+	return s
 }
 
-func NewWrappedWebSocket(con *websocket.Conn) *WrappedWebSocket {
-	r := WrappedWebSocket{
-		Conn: con,
-		mux:  sync.Mutex{},
+// extendRead gives the client until the pong of the next ping to be read from
+func (s *WrappedWebSocket) extendRead() {
+	wait := time.Duration(s.cfg.PingInterval+s.cfg.PongTimeout) * time.Millisecond
+	if err := s.Conn.SetReadDeadline(time.Now().Add(wait)); err != nil {
+		logrus.Traceln("Error extending websocket read deadline", err)
 	}
-	return &r
 }
 
+// WriteMessage queues a control message, written before the display queued
 func (s *WrappedWebSocket) WriteMessage(messageType int, data []byte) error {
-	s.mux.Lock()
-	defer s.mux.Unlock()
-	return s.Conn.WriteMessage(messageType, data)
+	if err := s.closed(); err != nil {
+		return err
+	}
+	select {
+	case s.control <- wsMessage{messageType, append([]byte{}, data...)}:
+		return nil
+	default:
+		logrus.Errorf("websocket %s doesn't take control messages, disconnect it", s.RemoteAddr())
+		s.stop(websocket.ErrCloseSent)
+		return websocket.ErrCloseSent
+	}
+}
+
+// WriteDisplay queues display instructions
+func (s *WrappedWebSocket) WriteDisplay(data []byte) error {
+	if err := s.closed(); err != nil {
+		return err
+	}
+	message := wsMessage{websocket.TextMessage, append([]byte{}, data...)}
+	select {
+	case s.display <- message:
+		return nil
+	default:
+	}
+	s.overflows.Inc()
+	if s.cfg.Overflow == OverflowBlock {
+		var timeout <-chan time.Time
+		if s.cfg.WriteTimeout > 0 {
+			timer := time.NewTimer(time.Duration(s.cfg.WriteTimeout) * time.Millisecond)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case s.display <- message:
+			return nil
+		case <-s.closing:
+			return s.err
+		case <-timeout:
+		}
+	}
+	logrus.Warnf("websocket %s fell %d messages behind, disconnect it", s.RemoteAddr(), len(s.display))
+	s.stop(websocket.ErrCloseSent)
+	return websocket.ErrCloseSent
+}
+
+// Close closes the websocket once the control messages queued are written, it doesn't
+// wait for them as it's called with the rooms locked
+func (s *WrappedWebSocket) Close() error {
+	s.stop(websocket.ErrCloseSent)
+	return nil
+}
+
+func (s *WrappedWebSocket) closed() error {
+	select {
+	case <-s.closing:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+func (s *WrappedWebSocket) stop(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.closing)
+	})
+}
+
+func (s *WrappedWebSocket) write() {
+	defer close(s.done)
+	var pings <-chan time.Time
+	if s.cfg.PingInterval > 0 {
+		ticker := time.NewTicker(time.Duration(s.cfg.PingInterval) * time.Millisecond)
+		defer ticker.Stop()
+		pings = ticker.C
+	}
+	for {
+		var message wsMessage
+		select {
+		case message = <-s.control:
+		default:
+			select {
+			case message = <-s.control:
+			case message = <-s.display:
+			case <-pings:
+				message = wsMessage{messageType: websocket.PingMessage}
+			case <-s.closing:
+				s.flush()
+				_ = s.Conn.Close()
+				return
+			}
+		}
+		if err := s.send(message); err != nil {
+			logrus.Errorf("Failed writing to websocket %s: %v", s.RemoteAddr(), err)
+			s.stop(err)
+			// unblocks the reader of the websocket
+			_ = s.Conn.Close()
+			return
+		}
+	}
+}
+
+// flush writes the control messages queued as the websocket closes
+func (s *WrappedWebSocket) flush() {
+	for {
+		select {
+		case message := <-s.control:
+			if s.send(message) != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (s *WrappedWebSocket) send(message wsMessage) error {
+	deadline := time.Time{}
+	if s.cfg.WriteTimeout > 0 {
+		deadline = time.Now().Add(time.Duration(s.cfg.WriteTimeout) * time.Millisecond)
+	}
+	if message.messageType == websocket.PingMessage {
+		return s.Conn.WriteControl(websocket.PingMessage, nil, deadline)
+	}
+	if err := s.Conn.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	return s.Conn.WriteMessage(message.messageType, message.data)
+}
+
+// leaveReason returns why the participant left as reading the websocket failed with
+// err, or for the failure of the writer if it stopped
+func (s *WrappedWebSocket) leaveReason(err error) string {
+	if closed := s.closed(); closed != nil {
+		if closed == websocket.ErrCloseSent {
+			return LeaveDisconnected
+		}
+		err = closed
+	}
+	var netErr net.Error
+	switch {
+	case websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived):
+		return LeaveClosed
+	case errors.Is(err, websocket.ErrReadLimit):
+		return LeaveMessageTooLarge
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return LeaveTimeout
+	}
+	return LeaveError
 }
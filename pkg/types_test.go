@@ -0,0 +1,180 @@
+package guac
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/wwt/guac/lib/settings"
+)
+
+// wsPair returns the server and client ends of a websocket
+func wsPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		assert.Nil(t, err)
+		conns <- conn
+	}))
+	t.Cleanup(server.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+	return <-conns, client
+}
+
+// unstartedWebSocket returns a websocket whose writer isn't started
+func unstartedWebSocket(conn *websocket.Conn, cfg settings.WebsocketSettings) *WrappedWebSocket {
+	return &WrappedWebSocket{
+		Conn:      conn,
+		cfg:       cfg,
+		overflows: wsOverflows.WithLabelValues("ws-tenant", cfg.Overflow),
+		control:   make(chan wsMessage, wsControlQueueSize),
+		display:   make(chan wsMessage, cfg.QueueSize),
+		closing:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+func readMessages(t *testing.T, conn *websocket.Conn, n int) []string {
+	var messages []string
+	for i := 0; i < n; i++ {
+		_, data, err := conn.ReadMessage()
+		if !assert.Nil(t, err) {
+			break
+		}
+		messages = append(messages, string(data))
+	}
+	return messages
+}
+
+func TestWrappedWebSocketPriority(t *testing.T) {
+	server, client := wsPair(t)
+	ws := unstartedWebSocket(server, settings.WebsocketSettings{QueueSize: 4, WriteTimeout: 1000, Overflow: OverflowDisconnect})
+
+	buf := []byte("display-1")
+	assert.Nil(t, ws.WriteDisplay(buf))
+	// the message is copied as it's queued
+	copy(buf, "overwrite")
+	assert.Nil(t, ws.WriteDisplay([]byte("display-2")))
+	assert.Nil(t, ws.WriteMessage(websocket.TextMessage, []byte("control")))
+	go ws.write()
+
+	assert.Equal(t, []string{"control", "display-1", "display-2"}, readMessages(t, client, 3))
+	assert.Nil(t, ws.Close())
+	assert.Equal(t, websocket.ErrCloseSent, ws.WriteMessage(websocket.TextMessage, []byte("closed")))
+}
+
+func TestWrappedWebSocketOverflow(t *testing.T) {
+	server, client := wsPair(t)
+	overflows := testutil.ToFloat64(wsOverflows.WithLabelValues("ws-tenant", OverflowBlock))
+	ws := unstartedWebSocket(server, settings.WebsocketSettings{QueueSize: 1, WriteTimeout: 5000, Overflow: OverflowBlock})
+	display := []string{
+		NewInstruction("img", "1", "14", "0", "image/png", "0", "0").String() + NewInstruction("blob", "1", "AAAA").String(),
+		NewInstruction("end", "1").String() + NewInstruction("sync", "1234", "0").String(),
+	}
+	assert.Nil(t, ws.WriteDisplay([]byte(display[0])))
+	// the display waits for the client, none of it is lost
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		ws.write()
+	}()
+	assert.Nil(t, ws.WriteDisplay([]byte(display[1])))
+	assert.Equal(t, overflows+1, testutil.ToFloat64(wsOverflows.WithLabelValues("ws-tenant", OverflowBlock)))
+	assert.Equal(t, display, readMessages(t, client, 2))
+	assert.Nil(t, ws.Close())
+
+	// a client which doesn't catch up in time is disconnected
+	ws = unstartedWebSocket(server, settings.WebsocketSettings{QueueSize: 1, WriteTimeout: 50, Overflow: OverflowBlock})
+	assert.Nil(t, ws.WriteDisplay([]byte("display-1")))
+	assert.Equal(t, websocket.ErrCloseSent, ws.WriteDisplay([]byte("display-2")))
+
+	ws = unstartedWebSocket(server, settings.WebsocketSettings{QueueSize: 1, Overflow: OverflowDisconnect})
+	assert.Nil(t, ws.WriteDisplay([]byte("display-1")))
+	assert.Equal(t, websocket.ErrCloseSent, ws.WriteDisplay([]byte("display-2")))
+	assert.Equal(t, websocket.ErrCloseSent, ws.WriteMessage(websocket.TextMessage, []byte("control")))
+}
+
+func TestWrappedWebSocketCloseFlushesControl(t *testing.T) {
+	server, client := wsPair(t)
+	ws := unstartedWebSocket(server, settings.WebsocketSettings{QueueSize: 4, WriteTimeout: 1000, Overflow: OverflowDisconnect})
+	assert.Nil(t, ws.WriteMessage(websocket.TextMessage, []byte("removed")))
+	go ws.write()
+	assert.Nil(t, ws.Close())
+	<-ws.done
+
+	assert.Equal(t, []string{"removed"}, readMessages(t, client, 1))
+	_, _, err := client.ReadMessage()
+	assert.NotNil(t, err)
+}
+
+func TestWrappedWebSocketKeepalive(t *testing.T) {
+	s := settings.Defaults()
+	s.Default.Websocket = &settings.WebsocketSettings{QueueSize: 4, WriteTimeout: 1000, PingInterval: 20, PongTimeout: 40, MaxMessageSize: 16}
+	settings.Set(s)
+	defer settings.Set(settings.Defaults())
+
+	// the client answers the pings as it reads
+	server, client := wsPair(t)
+	ws := NewWrappedWebSocket(server, "ws-tenant", "a1")
+	defer ws.Close()
+	go func() {
+		for {
+			if _, _, err := client.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	// the pongs are handled as the server reads, as wsToGuacd does
+	read := make(chan error, 1)
+	go func() {
+		_, data, err := ws.ReadMessage()
+		if err == nil {
+			assert.Equal(t, "4.nop;", string(data))
+			_, _, err = ws.ReadMessage()
+		}
+		read <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+	assert.Nil(t, client.WriteMessage(websocket.TextMessage, []byte("4.nop;")))
+	assert.Nil(t, client.WriteMessage(websocket.TextMessage, []byte("4.sync,13.1234567890123;")))
+	assert.Equal(t, LeaveMessageTooLarge, ws.leaveReason(<-read))
+
+	// a half-open connection doesn't answer
+	server, _ = wsPair(t)
+	ws = NewWrappedWebSocket(server, "ws-tenant", "a1")
+	defer ws.Close()
+	_, _, err := ws.ReadMessage()
+	assert.Equal(t, LeaveTimeout, ws.leaveReason(err))
+}
+
+func TestWrappedWebSocketPartialSettings(t *testing.T) {
+	s := settings.Defaults()
+	s.Tenants = map[string]*settings.TenantScope{"ws-tenant": {Scope: settings.Scope{Websocket: &settings.WebsocketSettings{Overflow: OverflowBlock}}}}
+	settings.Set(s)
+	defer settings.Set(settings.Defaults())
+
+	// the fields the tenant leaves unset are the defaults
+	server, _ := wsPair(t)
+	ws := NewWrappedWebSocket(server, "ws-tenant", "a1")
+	defer ws.Close()
+	assert.Equal(t, settings.WebsocketSettings{QueueSize: 256, WriteTimeout: 10000, Overflow: OverflowBlock, PingInterval: 30000, PongTimeout: 15000}, ws.cfg)
+	assert.Equal(t, 256, cap(ws.display))
+}
+
+func TestWrappedWebSocketLeaveReason(t *testing.T) {
+	server, client := wsPair(t)
+	ws := NewWrappedWebSocket(server, "ws-tenant", "a1")
+	assert.Nil(t, client.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "")))
+	_, _, err := ws.ReadMessage()
+	assert.Equal(t, LeaveClosed, ws.leaveReason(err))
+
+	assert.Nil(t, ws.Close())
+	_, _, err = ws.ReadMessage()
+	assert.Equal(t, LeaveDisconnected, ws.leaveReason(err))
+}
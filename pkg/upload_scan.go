@@ -0,0 +1,345 @@
+package guac
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/appaegis/golang-common/pkg/constants"
+	"github.com/sirupsen/logrus"
+	"github.com/wwt/guac/lib/settings"
+	"github.com/wwt/guac/pkg/session"
+)
+
+const (
+	ScanClean    = "clean"
+	ScanInfected = "infected"
+	ScanFailed   = "failed"
+
+	// clamdChunkSize is the size of the INSTREAM chunks
+	clamdChunkSize = 64 * 1024
+	// eicarSignature is the standard anti virus test file, flagged by the stub scanner
+	eicarSignature = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+)
+
+// ScanResult is the verdict of a scanner, Signature names what was found in an infected file
+type ScanResult struct {
+	Clean     bool
+	Signature string
+}
+
+// FileScanner scans a spooled upload
+type FileScanner interface {
+	Scan(path string) (ScanResult, error)
+}
+
+var fileScanners = map[string]func(settings.UploadScanSettings) (FileScanner, error){
+	"clamd": func(cfg settings.UploadScanSettings) (FileScanner, error) {
+		return &ClamdScanner{Network: cfg.Network, Address: cfg.Address, Timeout: time.Duration(cfg.Timeout) * time.Second}, nil
+	},
+	"stub": func(cfg settings.UploadScanSettings) (FileScanner, error) {
+		return StubScanner{}, nil
+	},
+}
+
+// RegisterFileScanner makes a scanner available to the upload scan settings
+func RegisterFileScanner(name string, factory func(settings.UploadScanSettings) (FileScanner, error)) {
+	fileScanners[name] = factory
+}
+
+// GetFileScanner returns the scanner configured by the upload scan settings
+func GetFileScanner(cfg settings.UploadScanSettings) (FileScanner, error) {
+	factory, ok := fileScanners[cfg.Scanner]
+	if !ok {
+		return nil, fmt.Errorf("unknown file scanner %s", cfg.Scanner)
+	}
+	return factory(cfg)
+}
+
+// ClamdScanner streams files to a clamd daemon with the INSTREAM command
+type ClamdScanner struct {
+	Network string
+	Address string
+	Timeout time.Duration
+}
+
+// Scan implements FileScanner
+func (s *ClamdScanner) Scan(path string) (ScanResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer f.Close()
+	conn, err := net.DialTimeout(s.Network, s.Address, s.Timeout)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer conn.Close()
+	if s.Timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(s.Timeout))
+	}
+
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return ScanResult{}, err
+	}
+	chunk := make([]byte, clamdChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, err := f.Read(chunk)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, e := conn.Write(append(size, chunk[:n]...)); e != nil {
+				return ScanResult{}, e
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ScanResult{}, err
+		}
+	}
+	if _, err = conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return ScanResult{}, err
+	}
+
+	// "stream: OK", "stream: <signature> FOUND" or "<message> ERROR"
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return ScanResult{}, err
+	}
+	reply = strings.TrimSpace(strings.TrimSuffix(reply, "\x00"))
+	switch {
+	case strings.HasSuffix(reply, " OK"):
+		return ScanResult{Clean: true}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		signature := strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND")
+		return ScanResult{Signature: signature}, nil
+	}
+	return ScanResult{}, fmt.Errorf("clamd: %s", reply)
+}
+
+// StubScanner finds the EICAR test file only, for environments without a scanner
+type StubScanner struct{}
+
+// Scan implements FileScanner
+func (StubScanner) Scan(path string) (ScanResult, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	if bytes.Contains(data, []byte(eicarSignature)) {
+		return ScanResult{Signature: "Eicar-Test-Signature"}, nil
+	}
+	return ScanResult{Clean: true}, nil
+}
+
+// uploadQuarantine spools the uploads of a client instead of relaying them to
+// guacd, it acks the blobs itself and releases scanned clean files to the drive.
+type uploadQuarantine struct {
+	ses     *session.SessionCommonData
+	client  *RdpClient
+	streams map[string]*quarantinedUpload
+	// drive is the dir clean files are released to
+	drive string
+}
+
+type quarantinedUpload struct {
+	cfg    settings.UploadScanSettings
+	name   string
+	file   *os.File
+	size   int64
+	failed bool
+}
+
+func newUploadQuarantine(ses *session.SessionCommonData, client *RdpClient) *uploadQuarantine {
+	q := &uploadQuarantine{ses: ses, client: client, streams: map[string]*quarantinedUpload{}}
+	if ses != nil {
+		q.drive = GetDrivePathInEFS(ses.TenantID, ses.AppID, ses.Email)
+	}
+	return q
+}
+
+// filter returns ins if it isn't part of a quarantined upload
+func (q *uploadQuarantine) filter(ins []byte) []byte {
+	if q == nil || q.ses == nil || len(ins) == 0 {
+		return ins
+	}
+	var argStart int
+	switch {
+	case bytes.HasPrefix(ins, fileOpcodeIns):
+		argStart = 0
+	case bytes.HasPrefix(ins, putOpcodeIns):
+		argStart = 1
+	case len(q.streams) > 0 && (bytes.HasPrefix(ins, blobOpcodeIns) || bytes.HasPrefix(ins, endOpcodeIns)):
+		return q.data(ins)
+	default:
+		return ins
+	}
+	cfg := settings.UploadScan(q.ses.TenantID, q.ses.AppID)
+	if !cfg.Enabled {
+		return ins
+	}
+	instruction, err := Parse(ins)
+	if err != nil || len(instruction.Args) < argStart+3 {
+		return ins
+	}
+	stream, name := instruction.Args[argStart], instruction.Args[argStart+2]
+	upload := &quarantinedUpload{cfg: cfg, name: name}
+	q.streams[stream] = upload
+
+	dir := filepath.Join(cfg.QuarantineDir, q.ses.RdpSessionId)
+	if err = os.MkdirAll(dir, 0o700); err == nil {
+		upload.file, err = os.CreateTemp(dir, "upload-*")
+	}
+	if err != nil {
+		logrus.Errorf("cannot spool upload %s: %v", name, err)
+		upload.failed = true
+		q.client.WriteMessage(NewInstruction("ack", stream, "quarantine unavailable", "512")) // SERVER_ERROR
+		return nil
+	}
+	q.client.WriteMessage(NewInstruction("ack", stream, "OK", "0"))
+	return nil
+}
+
+func (q *uploadQuarantine) data(ins []byte) []byte {
+	instruction, err := Parse(ins)
+	if err != nil || len(instruction.Args) == 0 {
+		return ins
+	}
+	stream := instruction.Args[0]
+	upload, ok := q.streams[stream]
+	if !ok {
+		return ins
+	}
+	if instruction.Opcode == "end" {
+		delete(q.streams, stream)
+		if !upload.failed {
+			upload.file.Close()
+			go q.scan(upload)
+		}
+		return nil
+	}
+	if upload.failed || len(instruction.Args) < 2 {
+		return nil
+	}
+	data, err := base64.StdEncoding.DecodeString(instruction.Args[1])
+	if err == nil {
+		upload.size += int64(len(data))
+		if upload.cfg.MaxBytes > 0 && upload.size > upload.cfg.MaxBytes {
+			err = fmt.Errorf("upload larger than %d bytes", upload.cfg.MaxBytes)
+		}
+	}
+	if err == nil {
+		_, err = upload.file.Write(data)
+	}
+	if err != nil {
+		logrus.Errorf("spool upload %s failed %v", upload.name, err)
+		upload.failed = true
+		upload.file.Close()
+		os.Remove(upload.file.Name())
+		q.client.WriteMessage(NewInstruction("ack", stream, "upload rejected", guacStatusOverrun))
+		return nil
+	}
+	q.client.WriteMessage(NewInstruction("ack", stream, "OK", "0"))
+	return nil
+}
+
+// scan releases a clean upload to the drive and tells the client the verdict
+func (q *uploadQuarantine) scan(upload *quarantinedUpload) {
+	path := upload.file.Name()
+	defer os.Remove(path)
+
+	verdict, reason := ScanClean, ""
+	scanner, err := GetFileScanner(upload.cfg)
+	var result ScanResult
+	if err == nil {
+		result, err = scanner.Scan(path)
+	}
+	switch {
+	case err != nil:
+		logrus.Errorf("scan upload %s failed %v", upload.name, err)
+		verdict, reason = ScanFailed, "scan failed"
+	case !result.Clean:
+		verdict, reason = ScanInfected, result.Signature
+	default:
+		if err = releaseUpload(path, q.uploadPath(upload.name)); err != nil {
+			logrus.Errorf("release upload %s failed %v", upload.name, err)
+			verdict, reason = ScanFailed, "release failed"
+		}
+	}
+	logrus.Infof("upload %s of %s in session %s scanned: %s %s", upload.name, q.client.UserId, q.ses.RdpSessionId, verdict, reason)
+
+	if verdict != ScanClean {
+		recordTransfer(q.ses, FileUpload, q.client.UserId, []string{upload.name}, true)
+		go sendBlockEvent(BlockEvent{
+			Event:           constants.PolicyV2EventUpload,
+			Files:           []string{upload.name},
+			FileCount:       1,
+			RemotePath:      "Filesystem on Appaegis RDP",
+			Session:         q.ses,
+			UserEmail:       q.client.UserId,
+			BlockPolicyType: "malware",
+			BlockReason:     reason,
+		})
+	}
+	data, _ := json.Marshal(J{
+		"file":    upload.name,
+		"verdict": verdict,
+		"reason":  reason,
+	})
+	q.client.WriteMessage(NewInstruction(APPAEGIS_RESP_OP, UPLOAD_SCAN, string(data)))
+}
+
+// uploadPath returns the path of an upload in the drive, put names are paths in
+// the drive and file names go to its root
+func (q *uploadQuarantine) uploadPath(name string) string {
+	return filepath.Join(q.drive, filepath.Clean("/"+name))
+}
+
+// close removes the spools of the uploads which didn't complete
+func (q *uploadQuarantine) close() {
+	if q == nil {
+		return
+	}
+	for stream, upload := range q.streams {
+		if upload.file != nil {
+			upload.file.Close()
+			os.Remove(upload.file.Name())
+		}
+		delete(q.streams, stream)
+	}
+}
+
+func releaseUpload(path, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0o777); err != nil {
+		return err
+	}
+	if err := os.Rename(path, dest); err == nil {
+		return nil
+	}
+	// the quarantine may be on another file system
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if e := dst.Close(); err == nil {
+		err = e
+	}
+	return err
+}
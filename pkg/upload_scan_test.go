@@ -0,0 +1,149 @@
+package guac
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wwt/guac/lib/settings"
+	"github.com/wwt/guac/pkg/session"
+)
+
+func TestUploadQuarantine(t *testing.T) {
+	dir := t.TempDir()
+	s := settings.Defaults()
+	s.Default.UploadScan = &settings.UploadScanSettings{
+		Enabled:       true,
+		Scanner:       "stub",
+		QuarantineDir: filepath.Join(dir, "quarantine"),
+		MaxBytes:      1024,
+	}
+	settings.Set(s)
+	defer settings.Set(settings.Defaults())
+
+	ses := &session.SessionCommonData{TenantID: "t1", AppID: "a1", Email: "host@appaegis.com", RdpSessionId: "s1"}
+	ws := &fakeWriterCloser{}
+	client := &RdpClient{UserId: "host@appaegis.com", Websocket: ws}
+	q := newUploadQuarantine(ses, client)
+	q.drive = filepath.Join(dir, "drive")
+	blob := func(stream, text string) []byte {
+		return NewInstruction("blob", stream, base64.StdEncoding.EncodeToString([]byte(text))).Byte()
+	}
+	verdict := func() map[string]interface{} {
+		ins, err := Parse(ws.Messages[len(ws.Messages)-1])
+		assert.Nil(t, err)
+		assert.Equal(t, APPAEGIS_RESP_OP, ins.Opcode)
+		assert.Equal(t, UPLOAD_SCAN, ins.Args[0])
+		result := map[string]interface{}{}
+		assert.Nil(t, json.Unmarshal([]byte(ins.Args[1]), &result))
+		return result
+	}
+
+	// the streams are spooled and acked instead of relayed
+	assert.Empty(t, q.filter(NewInstruction("put", "0", "1", "text/plain", "/docs/../notes.txt").Byte()))
+	assert.Empty(t, q.filter(blob("1", "hello")))
+	assert.Empty(t, q.filter(NewInstruction("file", "2", "text/plain", "eicar.com").Byte()))
+	assert.Empty(t, q.filter(blob("2", eicarSignature)))
+	other := blob("3", "AAAA")
+	assert.Equal(t, other, q.filter(other))
+	assert.Equal(t, 4, len(ws.Messages))
+	assert.Equal(t, NewInstruction("ack", "1", "OK", "0").Byte(), ws.Messages[1])
+
+	clean := q.streams["1"]
+	clean.file.Close()
+	q.scan(clean)
+	assert.Equal(t, ScanClean, verdict()["verdict"])
+	data, err := os.ReadFile(filepath.Join(dir, "drive", "notes.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	infected := q.streams["2"]
+	infected.file.Close()
+	q.scan(infected)
+	assert.Equal(t, ScanInfected, verdict()["verdict"])
+	assert.Equal(t, "Eicar-Test-Signature", verdict()["reason"])
+	_, err = os.Stat(filepath.Join(dir, "drive", "eicar.com"))
+	assert.True(t, os.IsNotExist(err))
+
+	// an upload over the limit is rejected and its spool removed
+	q.streams = map[string]*quarantinedUpload{}
+	assert.Empty(t, q.filter(NewInstruction("file", "4", "text/plain", "big.txt").Byte()))
+	assert.Empty(t, q.filter(blob("4", strings.Repeat("a", 2048))))
+	assert.Equal(t, NewInstruction("ack", "4", "upload rejected", guacStatusOverrun).Byte(), ws.Messages[len(ws.Messages)-1])
+	assert.Empty(t, q.filter(NewInstruction("end", "4").Byte()))
+	assert.Empty(t, q.streams)
+	spools, _ := os.ReadDir(filepath.Join(dir, "quarantine", "s1"))
+	assert.Empty(t, spools)
+
+	// disabled for the app
+	s.Tenants = map[string]*settings.TenantScope{"t1": {Apps: map[string]*settings.Scope{
+		"a1": {UploadScan: &settings.UploadScanSettings{}},
+	}}}
+	open := NewInstruction("file", "5", "text/plain", "notes.txt").Byte()
+	assert.Equal(t, open, q.filter(open))
+}
+
+func TestClamdScanner(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "clamd.sock")
+	listener, err := net.Listen("unix", sock)
+	assert.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			command, _ := r.ReadString(0)
+			var data []byte
+			size := make([]byte, 4)
+			for command == "zINSTREAM\x00" {
+				if _, err = io.ReadFull(r, size); err != nil {
+					break
+				}
+				n := binary.BigEndian.Uint32(size)
+				if n == 0 {
+					break
+				}
+				chunk := make([]byte, n)
+				if _, err = io.ReadFull(r, chunk); err != nil {
+					break
+				}
+				data = append(data, chunk...)
+			}
+			reply := "stream: OK\x00"
+			if strings.Contains(string(data), "virus") {
+				reply = "stream: Win.Test.Virus FOUND\x00"
+			}
+			conn.Write([]byte(reply))
+			conn.Close()
+		}
+	}()
+
+	path := filepath.Join(t.TempDir(), "upload")
+	scanner, err := GetFileScanner(settings.UploadScanSettings{Scanner: "clamd", Network: "unix", Address: sock, Timeout: 5})
+	assert.Nil(t, err)
+
+	assert.Nil(t, os.WriteFile(path, []byte("a document"), 0o600))
+	result, err := scanner.Scan(path)
+	assert.Nil(t, err)
+	assert.True(t, result.Clean)
+
+	assert.Nil(t, os.WriteFile(path, []byte("a virus"), 0o600))
+	result, err = scanner.Scan(path)
+	assert.Nil(t, err)
+	assert.False(t, result.Clean)
+	assert.Equal(t, "Win.Test.Virus", result.Signature)
+
+	_, err = GetFileScanner(settings.UploadScanSettings{Scanner: "unknown"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,77 @@
+package guac
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wwt/guac/lib/settings"
+	"github.com/wwt/guac/pkg/session"
+)
+
+const (
+	defaultWatermarkFormat   = "{email} {ip} {time}"
+	defaultWatermarkOpacity  = 0.3
+	defaultWatermarkFontSize = 24
+)
+
+// sizeDefaultLayerIns is the size of the default layer, sent by guacd when the session is resized
+var sizeDefaultLayerIns = []byte("4.size,1.0,")
+
+// watermarkText returns the text of the watermark of a session
+func watermarkText(cfg settings.WatermarkSettings, email, ip string, start time.Time) string {
+	format := cfg.Format
+	if format == "" {
+		format = defaultWatermarkFormat
+	}
+	return strings.NewReplacer(
+		"{email}", email,
+		"{ip}", ip,
+		"{time}", start.UTC().Format(time.RFC3339),
+	).Replace(format)
+}
+
+func watermarkStyle(cfg settings.WatermarkSettings) (float64, int) {
+	opacity, size := cfg.Opacity, cfg.FontSize
+	if opacity <= 0 || opacity > 1 {
+		opacity = defaultWatermarkOpacity
+	}
+	if size <= 0 {
+		size = defaultWatermarkFontSize
+	}
+	return opacity, size
+}
+
+// watermarkInstruction returns the watermark,<text>,<opacity>,<font size> instruction
+// the client draws over the display, nil if the app has no watermark. The text names
+// the participant, the host if there is no client.
+func watermarkInstruction(ses *session.SessionCommonData, client *RdpClient) []byte {
+	if ses == nil {
+		return nil
+	}
+	cfg := settings.Watermark(ses.TenantID, ses.AppID)
+	if !cfg.Enabled {
+		return nil
+	}
+	opacity, size := watermarkStyle(cfg)
+	email, ip := ses.Email, ses.ClientIP
+	if client != nil {
+		email, ip = client.UserId, client.ClientIp
+	}
+	text := watermarkText(cfg, email, ip, ses.SessionStartTime)
+	return NewInstruction(WATERMARK, text, strconv.FormatFloat(opacity, 'f', -1, 64), strconv.Itoa(size)).Byte()
+}
+
+// watermarkFilter returns the ffmpeg drawtext filter burning the watermark into a recording,
+// empty if the app has no watermark
+func watermarkFilter(cfg settings.WatermarkSettings, email, ip string, start time.Time) string {
+	if !cfg.Enabled {
+		return ""
+	}
+	opacity, size := watermarkStyle(cfg)
+	// the text is quoted for the filter option and the option for the filter graph
+	text := strings.NewReplacer(`\`, `\\`, `'`, `'\''`, `%`, `\%`, `:`, `\:`).Replace(watermarkText(cfg, email, ip, start))
+	return fmt.Sprintf("drawtext=text='%s':fontcolor=white@%s:fontsize=%d:borderw=1:bordercolor=black@%s:x=(w-text_w)/2:y=(h-text_h)/2",
+		text, strconv.FormatFloat(opacity, 'f', -1, 64), size, strconv.FormatFloat(opacity, 'f', -1, 64))
+}
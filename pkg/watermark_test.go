@@ -0,0 +1,39 @@
+package guac
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wwt/guac/lib/settings"
+	"github.com/wwt/guac/pkg/session"
+)
+
+func TestWatermark(t *testing.T) {
+	start := time.Date(2024, 5, 1, 8, 30, 0, 0, time.UTC)
+	ses := &session.SessionCommonData{TenantID: "t1", AppID: "a1", Email: "host@appaegis.com", ClientIP: "10.0.0.1", SessionStartTime: start}
+	assert.Nil(t, watermarkInstruction(ses, nil))
+	assert.Nil(t, watermarkInstruction(nil, nil))
+
+	s := settings.Defaults()
+	s.Default.Watermark = &settings.WatermarkSettings{Enabled: true, Format: "{email} ({ip}) {time}"}
+	settings.Set(s)
+	defer settings.Set(settings.Defaults())
+
+	watermark := NewInstruction(WATERMARK, "host@appaegis.com (10.0.0.1) 2024-05-01T08:30:00Z", "0.3", "24").Byte()
+	assert.Equal(t, watermark, watermarkInstruction(ses, nil))
+	// a viewer is watermarked with their own identity
+	viewer := &RdpClient{UserId: "viewer@appaegis.com", ClientIp: "10.0.0.2", Role: ROLE_VIEWER}
+	assert.Equal(t, NewInstruction(WATERMARK, "viewer@appaegis.com (10.0.0.2) 2024-05-01T08:30:00Z", "0.3", "24").Byte(), watermarkInstruction(ses, viewer))
+
+	// the watermark is sent again after the display is resized
+	size := NewInstruction("size", "0", "1024", "768").String()
+	cursor := NewInstruction("cursor", "0", "0", "-1", "0", "0", "11", "16").String()
+	msgWriter := &fakeMessageWriter{}
+	guacdToWs(msgWriter, NewStream(&fakeConn{ToRead: []byte(size + cursor)}, time.Minute), nil, ses, nil)
+	assert.Equal(t, size+string(watermark)+cursor, string(msgWriter.Messages[0]))
+
+	filter := watermarkFilter(settings.Watermark("t1", "a1"), "o'neil@appaegis.com", "10.0.0.1", start)
+	assert.Equal(t, `drawtext=text='o'\''neil@appaegis.com (10.0.0.1) 2024-05-01T08\:30\:00Z':fontcolor=white@0.3:fontsize=24:borderw=1:bordercolor=black@0.3:x=(w-text_w)/2:y=(h-text_h)/2`, filter)
+	assert.Empty(t, watermarkFilter(settings.WatermarkSettings{}, "host@appaegis.com", "10.0.0.1", start))
+}
@@ -13,7 +13,6 @@ import (
 	"github.com/appaegis/golang-common/pkg/db_data/adaptor"
 	"github.com/appaegis/golang-common/pkg/db_data/schema"
 	"github.com/gorilla/websocket"
-	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/wwt/guac/lib/logging"
 	"github.com/wwt/guac/pkg/session"
@@ -73,9 +72,7 @@ func (s *WebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	upgrader := websocket.Upgrader{
 		ReadBufferSize:  websocketReadBufferSize,
 		WriteBufferSize: websocketWriteBufferSize,
-		CheckOrigin: func(r *http.Request) bool {
-			return true // TODO
-		},
+		CheckOrigin:     checkOrigin,
 	}
 	protocol := r.Header.Get("Sec-Websocket-Protocol")
 	conn, err := upgrader.Upgrade(w, r, http.Header{
@@ -114,6 +111,15 @@ func (s *WebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	var feed *fanOutFeed
+	if shareSessionId != "" && !strings.Contains(sharePermissions, "admin") {
+		if room, ok := lookupRdpSessionRoom(shareSessionId); ok {
+			// subscribed before joining guacd, the frames after the display it sends are queued
+			feed = room.fanOut.subscribe()
+			defer feed.Close()
+		}
+	}
+
 	logrus.Debug("Connecting to tunnel")
 	var tunnel Tunnel
 	var e error
@@ -156,23 +162,15 @@ func (s *WebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer tunnel.ReleaseWriter()
 	defer tunnel.ReleaseReader()
 
-	ws := NewWrappedWebSocket(conn)
+	ws := NewWrappedWebSocket(conn, tunnel.GetLoggingInfo().TenantId, appId)
+	defer func() {
+		_ = ws.Close()
+	}()
 	sharing := false
 	if appId != "" {
 		app := adaptor.GetDefaultDaoClient().QueryResource(appId)
 		sharing = app.AllowSharing
 	}
-	if s.channelManagement != nil {
-		if userId != "" && appId != "" {
-			ch := make(chan int, 1)
-			channelID := uuid.NewV4()
-			defer func() { _ = s.channelManagement.Remove(appId, userId, channelID.String()) }()
-			_ = s.channelManagement.Add(userId, channelID.String(), ch)
-			_ = s.channelManagement.Add(appId, channelID.String(), ch)
-			go BroadCastToWs(ws, ch, sharing, appId, userId)
-		}
-	}
-
 	var client *RdpClient
 	ses, _ := SessionDataStore.Get(sessionId).(*session.SessionCommonData)
 	if shareSessionId == "" { // rdp session owner connected
@@ -193,6 +191,11 @@ func (s *WebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			logrus.Errorf("put to cache failed %v", e)
 		}
 		client = NewRdpSessionRoom(sessionId, userId, ws, tunnel.ConnectionID(), sharing, appId, tunnel.GetLoggingInfo().AppName, tunnel.GetLoggingInfo())
+		if room, ok := lookupRdpSessionRoom(sessionId); ok {
+			go room.enforceLimits(ses)
+			reader = room.fanOut.source(reader, writer)
+			defer room.fanOut.close()
+		}
 	} else {
 		sessionId = shareSessionId
 		ses, _ = SessionDataStore.Get(sessionId).(*session.SessionCommonData)
@@ -201,6 +204,14 @@ func (s *WebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			logrus.Errorf("join to room failed %s", sessionId)
 			return
 		}
+		if feed != nil {
+			// the viewer follows the connection of the host once it has the display
+			feed.join(reader)
+			if err = tunnel.Close(); err != nil {
+				logrus.Traceln("Error closing tunnel", err)
+			}
+			reader, writer = feed, feed
+		}
 		if _, ok := GetRdpSessionRoom(sessionId); ok {
 			go SendEvent("join", logging.Action{
 				Session:     ses,
@@ -211,16 +222,47 @@ func (s *WebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if s.channelManagement != nil {
+		if userId != "" && appId != "" {
+			subscription := s.channelManagement.Subscribe(AppTopic(appId), UserTopic(userId))
+			defer subscription.Unsubscribe()
+			go BroadCastToWs(ws, subscription, sharing, appId, userId, func() { reevaluatePolicy(ses, client) })
+		}
+	}
+
+	if room, ok := lookupRdpSessionRoom(sessionId); ok {
+		room.stats.addTunnel(tunnel)
+	}
+
+	// the connection of the participant has their address
+	client.ClientIp = tunnel.GetLoggingInfo().ClientIp
+
 	IncRdpCount(tunnel.GetLoggingInfo().TenantId)
 	defer DecRdpCount(tunnel.GetLoggingInfo().TenantId)
 
 	client.SendPermission()
 
-	go wsToGuacd(ws, writer, sessionId, client)
-	guacdToWs(ws, reader, ses)
-
-	logrus.Infof("%s leave %s, connection id %s", userId, sessionId, tunnel.ConnectionID())
-	e = LeaveRoom(ses, sessionId, userId, tunnel.GetLoggingInfo().ClientIp, tunnel.GetLoggingInfo().ClientPrivateIp)
+	left := make(chan string, 1)
+	go func() {
+		left <- wsToGuacd(ws, writer, sessionId, client)
+		// guacdToWs would wait on guacd for the websocket which is gone
+		feed.Close()
+		if err := tunnel.Close(); err != nil {
+			logrus.Traceln("Error closing tunnel", err)
+		}
+	}()
+	guacdToWs(ws, reader, writer, ses, client)
+
+	reason := LeaveGuacd
+	select {
+	case reason = <-left:
+	default:
+		if ws.closed() != nil {
+			reason = ws.leaveReason(nil)
+		}
+	}
+	logrus.Infof("%s leave %s, connection id %s, reason %s", userId, sessionId, tunnel.ConnectionID(), reason)
+	e = LeaveRoom(ses, sessionId, userId, tunnel.GetLoggingInfo().ClientIp, tunnel.GetLoggingInfo().ClientPrivateIp, reason)
 	if e != nil {
 		logrus.Errorf("leave room failed, session %s, e %v", sessionId, e)
 	}
@@ -234,12 +276,22 @@ type MessageReader interface {
 	ReadMessage() (int, []byte, error)
 }
 
-func wsToGuacd(ws *WrappedWebSocket, guacd io.Writer, sessionDataKey string, client *RdpClient) {
+// wsToGuacd relays the websocket to guacd, it returns why the participant left
+func wsToGuacd(ws *WrappedWebSocket, guacd io.Writer, sessionDataKey string, client *RdpClient) string {
+	ses, _ := SessionDataStore.Get(sessionDataKey).(*session.SessionCommonData)
+	clipboard := newClipboardFilter(ClipboardPaste, ses, client.UserId, client.WriteMessage)
+	clipboard.allowed = func() bool { return client.Allowed("paste") }
+	files := newFileTransferFilter(FileUpload, ses, client, client.WriteMessage)
+	quarantine := newUploadQuarantine(ses, client)
+	defer quarantine.close()
+	meter := newTrafficMeter(TrafficFromClient, ses)
+	syncs := client.syncs(ses)
+	room, _ := lookupRdpSessionRoom(sessionDataKey)
 	for {
 		_, data, err := ws.ReadMessage()
 		if err != nil {
 			logrus.Errorf("Error reading message from ws %v", err)
-			return
+			return ws.leaveReason(err)
 		}
 
 		if bytes.HasPrefix(data, internalOpcodeIns) {
@@ -260,9 +312,19 @@ func wsToGuacd(ws *WrappedWebSocket, guacd io.Writer, sessionDataKey string, cli
 		if !client.Keyboard && bytes.HasPrefix(data, keyCmdOpcodeIns) {
 			continue
 		}
+		if bytes.HasPrefix(data, mouseCmdOpcodeIns) || bytes.HasPrefix(data, keyCmdOpcodeIns) {
+			room.touch()
+		}
+		meter.count(data)
+		if bytes.HasPrefix(data, syncOpcodeIns) {
+			syncs.acked(data, time.Now())
+		}
+		if data = quarantine.filter(files.filter(clipboard.filter(data))); len(data) == 0 {
+			continue
+		}
 		if _, err = guacd.Write(data); err != nil {
 			logrus.Traceln("Failed writing to guacd", err)
-			return
+			return LeaveGuacd
 		}
 	}
 }
@@ -273,8 +335,37 @@ type MessageWriter interface {
 	WriteMessage(int, []byte) error
 }
 
-func guacdToWs(ws MessageWriter, guacd InstructionReader, ses *session.SessionCommonData) {
+// DisplayWriter is a MessageWriter queuing the display apart from the other messages
+type DisplayWriter interface {
+	// WriteDisplay writes guac commands of the display
+	WriteDisplay(data []byte) error
+}
+
+// guacdToWs relays guacd to the websocket, guacdWriter acks the streams blocked by guac
+func guacdToWs(ws MessageWriter, guacd InstructionReader, guacdWriter io.Writer, ses *session.SessionCommonData, client *RdpClient) {
 	buf := bytes.NewBuffer(make([]byte, 0, MaxGuacMessage*2))
+	var clipboard *clipboardFilter
+	var files *fileTransferFilter
+	var masks *maskFilter
+	meter := newTrafficMeter(TrafficToClient, ses)
+	syncs := client.syncs(ses)
+	write := func(data []byte) error { return ws.WriteMessage(websocket.TextMessage, data) }
+	if display, ok := ws.(DisplayWriter); ok {
+		write = display.WriteDisplay
+	}
+	if client != nil {
+		ack := func(ins *Instruction) {
+			// one write per instruction, it doesn't interleave with the writes of wsToGuacd
+			if _, err := guacdWriter.Write(ins.Byte()); err != nil {
+				logrus.Errorf("Failed writing ack to guacd %v", err)
+			}
+		}
+		clipboard = newClipboardFilter(ClipboardCopy, ses, client.UserId, client.WriteMessage)
+		clipboard.allowed = func() bool { return client.Allowed("copy") }
+		clipboard.ack = ack
+		masks = newMaskFilter(ses, client)
+		files = newFileTransferFilter(FileDownload, ses, client, ack)
+	}
 
 	for {
 		ins, err := guacd.ReadSome()
@@ -287,6 +378,10 @@ func guacdToWs(ws MessageWriter, guacd InstructionReader, ses *session.SessionCo
 			// messages starting with the InternalDataOpcode are never sent to the websocket
 			continue
 		}
+		meter.count(ins)
+		if bytes.HasPrefix(ins, syncOpcodeIns) {
+			syncs.sent(ins, time.Now())
+		}
 		if bytes.HasPrefix(ins, []byte("11.server_info")) {
 			ses.Auth = true
 			i := bytes.IndexByte(ins, ',')
@@ -307,18 +402,25 @@ func guacdToWs(ws MessageWriter, guacd InstructionReader, ses *session.SessionCo
 				ClientPrivateIp: ses.ClientPrivateIp,
 				Destination:     serverName,
 			})
-			continue
+			ins = watermarkInstruction(ses, client)
+		}
+		var watermark []byte
+		if bytes.HasPrefix(ins, sizeDefaultLayerIns) {
+			// the client redraws the watermark over the resized display
+			watermark = watermarkInstruction(ses, client)
 		}
 
-		if _, err = buf.Write(ins); err != nil {
+		// held clipboard instructions still flush what is buffered
+		if _, err = buf.Write(masks.filter(files.filter(clipboard.filter(ins)))); err != nil {
 			logrus.Errorf("Failed to buffer guacd to ws, e %v", err)
 			return
 		}
+		buf.Write(watermark)
 
 		// if the buffer has more data in it or we've reached the max buffer size, send the data and reset
-		if !guacd.Available() || buf.Len() >= MaxGuacMessage {
+		if buf.Len() > 0 && (!guacd.Available() || buf.Len() >= MaxGuacMessage) {
 			bufbytes := buf.Bytes()
-			if err = ws.WriteMessage(1, bufbytes); err != nil {
+			if err = write(bufbytes); err != nil {
 				logrus.Errorf("Failed sending message to ws %v", err)
 				if err == websocket.ErrCloseSent {
 					return
@@ -330,12 +432,24 @@ func guacdToWs(ws MessageWriter, guacd InstructionReader, ses *session.SessionCo
 	}
 }
 
-func BroadCastToWs(ws MessageWriter, ch chan int, sharing bool, appId string, userId string) {
+// BroadCastToWs sends the policy to the websocket whenever it changes, onChange
+// re-evaluates the session on the server. The events pending together are handled
+// once, as the policy is queried as a whole.
+func BroadCastToWs(ws MessageWriter, subscription *Subscription, sharing bool, appId string, userId string, onChange func()) {
 	logrus.Debug("create BroadCastToWs")
 	BroadCastPolicy(ws, sharing, appId, userId)
-	for op := range ch {
-		if op == 1 {
-			BroadCastPolicy(ws, sharing, appId, userId)
+	if onChange != nil {
+		onChange()
+	}
+	for range subscription.C() {
+		events, overflowed := subscription.Drain()
+		if len(events) == 0 && !overflowed {
+			continue
+		}
+		logrus.Debugf("policy events of %s: %v", userId, events)
+		BroadCastPolicy(ws, sharing, appId, userId)
+		if onChange != nil {
+			onChange()
 		}
 	}
 }
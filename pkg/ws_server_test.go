@@ -37,7 +37,7 @@ func TestWebsocketServer_guacdToWs(t *testing.T) {
 	}
 	guac := NewStream(conn, time.Minute)
 
-	guacdToWs(msgWriter, guac, nil)
+	guacdToWs(msgWriter, guac, nil, nil, nil)
 
 	if len(msgWriter.Messages) != 1 {
 		t.Error("Expected 1 got", len(msgWriter.Messages))
@@ -97,3 +97,7 @@ func (f *fakeTunnel) Close() error {
 func (f *fakeTunnel) GetLoggingInfo() logging.LoggingInfo {
 	return logging.LoggingInfo{}
 }
+
+func (f *fakeTunnel) Traffic() TunnelTraffic {
+	return TunnelTraffic{}
+}